@@ -0,0 +1,97 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/lestrrat-go/xslate/node"
+	"github.com/lestrrat-go/xslate/parser"
+	"github.com/pkg/errors"
+)
+
+// cascade is the result of merging a template with the templates that
+// it cascades from
+type cascade struct {
+	base    *parser.AST // the template at the top, whose root is rendered
+	blocks  map[string]*node.BlockNode
+	origins map[*node.BlockNode]*parser.AST // where each BLOCK came from
+	hidden  int                             // number of BLOCKs renamed so far
+}
+
+// mergeCascade merges `ast` with the templates that it cascades from,
+// which must have been loaded in ast.Parent. BLOCKs in descendants
+// replace those of the same name in their ancestors, and BEFORE, AFTER
+// and AROUND are applied to the BLOCKs inherited so far.
+func mergeCascade(ast *parser.AST) (*cascade, error) {
+	if ast.Cascade == "" {
+		if len(ast.Modifiers) > 0 {
+			return nil, errors.Errorf("template %s modifies BLOCK %s, but does not cascade from another template", ast.Name, ast.Modifiers[0].Name)
+		}
+
+		c := &cascade{
+			base:    ast,
+			blocks:  make(map[string]*node.BlockNode),
+			origins: make(map[*node.BlockNode]*parser.AST),
+		}
+		for name, blk := range ast.Blocks {
+			c.blocks[name] = blk
+			c.origins[blk] = ast
+		}
+		return c, nil
+	}
+
+	if ast.Parent == nil {
+		return nil, errors.Errorf("template %s cascades from %s, which has not been loaded", ast.Name, ast.Cascade)
+	}
+
+	c, err := mergeCascade(ast.Parent)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, blk := range ast.Blocks {
+		c.blocks[name] = blk
+		c.origins[blk] = ast
+	}
+
+	for _, m := range ast.Modifiers {
+		orig, ok := c.blocks[m.Name]
+		if !ok {
+			return nil, errors.Errorf("template %s modifies BLOCK %s, which is not defined in %s", ast.Name, m.Name, ast.Cascade)
+		}
+
+		// The original BLOCK is kept under a name that can't be
+		// used from templates, and the modified one calls it
+		c.origins[m] = ast
+		merged := node.NewBlockNode(m.Pos(), m.Name)
+		merged.LocalVars = map[string]int{}
+		switch m.Type() {
+		case node.Around:
+			merged.Nodes = m.Nodes
+			merged.LocalVars = m.LocalVars
+			merged.Super = c.hide(orig)
+		case node.Before:
+			merged.Append(processBlock(m.Pos(), c.hide(m)))
+			merged.Append(processBlock(m.Pos(), c.hide(orig)))
+		case node.After:
+			merged.Append(processBlock(m.Pos(), c.hide(orig)))
+			merged.Append(processBlock(m.Pos(), c.hide(m)))
+		}
+		c.blocks[m.Name] = merged
+		c.origins[merged] = ast
+	}
+
+	return c, nil
+}
+
+// hide registers `blk` under a name that is not a valid identifier,
+// and returns that name
+func (c *cascade) hide(blk *node.BlockNode) string {
+	c.hidden++
+	name := fmt.Sprintf("%s#%d", blk.Name, c.hidden)
+	c.blocks[name] = blk
+	return name
+}
+
+func processBlock(pos int, name string) node.Node {
+	return node.NewProcessNode(pos, node.NewFetchSymbolNode(pos, name))
+}
@@ -2,16 +2,24 @@ package compiler
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 
+	"github.com/lestrrat-go/xslate/internal/position"
 	"github.com/lestrrat-go/xslate/node"
 	"github.com/lestrrat-go/xslate/parser"
 	"github.com/lestrrat-go/xslate/vm"
 )
 
-// AppendOp creates and appends a new op to the current set of ByteCode
+// AppendOp creates and appends a new op to the current set of ByteCode.
+// The op is attributed to the location of the node being compiled
 func (ctx *context) AppendOp(o vm.OpType, args ...interface{}) vm.Op {
-	return ctx.ByteCode.AppendOp(o, args...)
+	op := ctx.ByteCode.AppendOp(o, args...)
+	if ctx.Text != "" {
+		line, col := ctx.Lines.Lookup(ctx.Text, ctx.Pos)
+		ctx.ByteCode.SetPosition(ctx.ByteCode.Len()-1, vm.SourcePos{Line: line, Column: col})
+	}
+	return op
 }
 
 // New creates a new BasicCompiler instance
@@ -22,12 +30,29 @@ func New() *BasicCompiler {
 // Compile satisfies the compiler.Compiler interface. It accepts an AST
 // created by parser.Parser, and returns vm.ByteCode or an error
 func (c *BasicCompiler) Compile(ast *parser.AST) (*vm.ByteCode, error) {
+	merged, err := mergeCascade(ast)
+	if err != nil {
+		return nil, err
+	}
+
 	ctx := &context{
 		ByteCode: vm.NewByteCode(),
+		Text:     ast.Text,
+		Lines:    position.NewIndex(ast.Text),
 	}
-	for _, n := range ast.Root.Nodes {
+	compileBlocks(ctx, ast, merged)
+
+	// The root of a cascaded template comes from the base template
+	start := ctx.ByteCode.Len()
+	ctx.setOrigin(merged.base)
+	for _, n := range merged.base.Root.Nodes {
 		compile(ctx, n)
 	}
+	ctx.addSection(ast, merged.base, start)
+
+	for _, call := range ctx.blockCalls {
+		call.op.SetArg(ctx.blockEntries[call.name])
+	}
 
 	// When we're done compiling, always append an END op
 	ctx.ByteCode.AppendOp(vm.TXOPEnd)
@@ -36,12 +61,16 @@ func (c *BasicCompiler) Compile(ast *parser.AST) (*vm.ByteCode, error) {
 	opt.Optimize(ctx.ByteCode)
 
 	ctx.ByteCode.Name = ast.Name
+	ctx.ByteCode.Source = ast.Text
 	return ctx.ByteCode, nil
 }
 
 func compile(ctx *context, n node.Node) {
+	defer func(pos int) { ctx.Pos = pos }(ctx.Pos)
+	ctx.Pos = n.Pos()
+
 	switch n.Type() {
-	case node.Int, node.Text:
+	case node.Int, node.Float, node.Text:
 		compileLiteral(ctx, n)
 	case node.FetchSymbol:
 		compileFetchSymbol(ctx, n.(*node.TextNode))
@@ -61,12 +90,19 @@ func compile(ctx *context, n node.Node) {
 		compileForeach(ctx, n.(*node.ForeachNode))
 	case node.While:
 		compileWhile(ctx, n.(*node.WhileNode))
-	case node.If:
+	case node.If, node.Unless:
 		compileIf(ctx, n.(*node.IfNode))
 	case node.Else:
 		compileElse(ctx, n.(*node.ElseNode))
 	case node.MakeArray:
 		compileMakeArray(ctx, n.(*node.UnaryNode))
+	case node.MakeHash:
+		compileMakeHash(ctx, n.(*node.UnaryNode))
+	case node.NamedArgs:
+		compileNamedArgs(ctx, n.(*node.UnaryNode))
+	case node.Import:
+		compile(ctx, n.(*node.UnaryNode).Child)
+		ctx.AppendOp(vm.TXOPImport)
 	case node.Range:
 		compileRange(ctx, n.(*node.BinaryNode))
 	case node.List:
@@ -75,13 +111,14 @@ func compile(ctx *context, n node.Node) {
 		compileFunCall(ctx, n.(*node.FunCallNode))
 	case node.MethodCall:
 		compileMethodCall(ctx, n.(*node.MethodCallNode))
-	case node.Include:
+	case node.Include, node.Process, node.Super:
 		compileInclude(ctx, n.(*node.IncludeNode))
 	case node.Group:
 		compile(ctx, n.(*node.UnaryNode).Child)
-	case node.Equals, node.NotEquals, node.LT, node.GT:
+	case node.Equals, node.NotEquals, node.LT, node.GT, node.LE, node.GE, node.Cmp,
+		node.StrLT, node.StrGT, node.StrLE, node.StrGE, node.StrCmp, node.StrEquals, node.StrNotEquals:
 		compileComparison(ctx, n.(*node.BinaryNode))
-	case node.Plus, node.Minus, node.Mul, node.Div:
+	case node.Plus, node.Minus, node.Mul, node.Div, node.Mod, node.Concat:
 		compileBinaryArithmetic(ctx, n.(*node.BinaryNode))
 	case node.Filter:
 		compileFilter(ctx, n.(*node.FilterNode))
@@ -89,6 +126,23 @@ func compile(ctx *context, n node.Node) {
 		compileWrapper(ctx, n.(*node.WrapperNode))
 	case node.Macro:
 		compileMacro(ctx, n.(*node.MacroNode))
+	case node.Switch:
+		compileSwitch(ctx, n.(*node.SwitchNode))
+	case node.And, node.Or, node.DefinedOr:
+		compileLogical(ctx, n.(*node.BinaryNode))
+	case node.Not:
+		compile(ctx, n.(*node.UnaryNode).Child)
+		ctx.AppendOp(vm.TXOPNot)
+	case node.UnaryMinus:
+		compile(ctx, n.(*node.UnaryNode).Child)
+		ctx.AppendOp(vm.TXOPUnaryMinus)
+	case node.UnaryPlus:
+		compile(ctx, n.(*node.UnaryNode).Child)
+		ctx.AppendOp(vm.TXOPUnaryPlus)
+	case node.Ternary:
+		compileTernary(ctx, n.(*node.TernaryNode))
+	case node.Last, node.Next:
+		compileLoopControl(ctx, n)
 	default:
 		fmt.Printf("Unknown node: %s\n", n.Type())
 	}
@@ -105,6 +159,26 @@ func compileComparison(ctx *context, n *node.BinaryNode) {
 		ctx.AppendOp(vm.TXOPLessThan)
 	case node.GT:
 		ctx.AppendOp(vm.TXOPGreaterThan)
+	case node.LE:
+		ctx.AppendOp(vm.TXOPLessThanEquals)
+	case node.GE:
+		ctx.AppendOp(vm.TXOPGreaterThanEquals)
+	case node.Cmp:
+		ctx.AppendOp(vm.TXOPCmp)
+	case node.StrLT:
+		ctx.AppendOp(vm.TXOPStrLessThan)
+	case node.StrGT:
+		ctx.AppendOp(vm.TXOPStrGreaterThan)
+	case node.StrLE:
+		ctx.AppendOp(vm.TXOPStrLessThanEquals)
+	case node.StrGE:
+		ctx.AppendOp(vm.TXOPStrGreaterThanEquals)
+	case node.StrCmp:
+		ctx.AppendOp(vm.TXOPStrCmp)
+	case node.StrEquals:
+		ctx.AppendOp(vm.TXOPStrEquals)
+	case node.StrNotEquals:
+		ctx.AppendOp(vm.TXOPStrNotEquals)
 	default:
 		panic("Unknown operator")
 	}
@@ -130,28 +204,73 @@ func compileFetchSymbol(ctx *context, n *node.TextNode) {
 }
 
 func compileFilter(ctx *context, n *node.FilterNode) {
-	compile(ctx, n.Child)
-	ctx.AppendOp(vm.TXOPFilter, n.Name)
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("Begin filter " + n.Name)
+	if x := n.LocalVar; x != nil {
+		// MACROs are called with the filtered value as the first argument
+		compile(ctx, n.Child)
+		ctx.AppendOp(vm.TXOPPush)
+		compileFilterArgs(ctx, n)
+		compileLoadLvar(ctx, x)
+		ctx.AppendOp(vm.TXOPFunCallOmni)
+	} else {
+		// The filtered value goes in sa, the extra arguments on the stack
+		compileFilterArgs(ctx, n)
+		compile(ctx, n.Child)
+		ctx.AppendOp(vm.TXOPFilter, n.Name)
+	}
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("End filter " + n.Name)
+}
+
+func compileFilterArgs(ctx *context, n *node.FilterNode) {
+	if n.Args == nil {
+		return
+	}
+	for _, child := range n.Args.Nodes {
+		compile(ctx, child)
+		ctx.AppendOp(vm.TXOPPush)
+	}
 }
 
 func compileFunCall(ctx *context, n *node.FunCallNode) {
-	if len(n.Args.Nodes) > 0 {
-		ctx.AppendOp(vm.TXOPNoop).SetComment("Setting up function arguments")
-		for _, child := range n.Args.Nodes {
-			compile(ctx, child)
-			ctx.AppendOp(vm.TXOPPush)
-		}
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("Begin function call")
+	for _, child := range n.Args.Nodes {
+		compile(ctx, child)
+		ctx.AppendOp(vm.TXOPPush)
 	}
 
 	if inv := n.Invocant; inv != nil {
 		compile(ctx, inv)
 	}
-	ctx.AppendOp(vm.TXOPFunCallOmni)
+
+	// Calls by name remember the name, so that the builtin filters
+	// can be called as functions when nothing else goes by that name
+	if sym, ok := n.Invocant.(*node.TextNode); ok && sym.Type() == node.FetchSymbol {
+		ctx.AppendOp(vm.TXOPFunCallOmni, string(sym.Text))
+	} else {
+		ctx.AppendOp(vm.TXOPFunCallOmni)
+	}
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("End function call")
 }
 
 func compileMakeArray(ctx *context, n *node.UnaryNode) {
+	ctx.AppendOp(vm.TXOPPushmark)
 	compile(ctx, n.Child)
 	ctx.AppendOp(vm.TXOPMakeArray)
+	ctx.AppendOp(vm.TXOPPopmark)
+}
+
+func compileMakeHash(ctx *context, n *node.UnaryNode) {
+	ctx.AppendOp(vm.TXOPPushmark)
+	compile(ctx, n.Child)
+	ctx.AppendOp(vm.TXOPMakeHash)
+	ctx.AppendOp(vm.TXOPPopmark)
+}
+
+func compileNamedArgs(ctx *context, n *node.UnaryNode) {
+	ctx.AppendOp(vm.TXOPPushmark)
+	compile(ctx, n.Child)
+	ctx.AppendOp(vm.TXOPMakeNamedArgs)
+	ctx.AppendOp(vm.TXOPPopmark)
 }
 
 func compileMethodCall(ctx *context, n *node.MethodCallNode) {
@@ -198,8 +317,15 @@ func compileList(ctx *context, n *node.ListNode) {
 
 func compileIf(ctx *context, n *node.IfNode) {
 	ctx.AppendOp(vm.TXOPPushmark).SetComment("BEGIN IF")
+	ctx.enterBlock(vm.TXOPPopmark)
+	defer ctx.leaveBlock()
 	compile(ctx, n.BooleanExpression)
-	ifop := ctx.AppendOp(vm.TXOPAnd, 0)
+	var ifop vm.Op
+	if n.Type() == node.Unless {
+		ifop = ctx.AppendOp(vm.TXOPOr, 0)
+	} else {
+		ifop = ctx.AppendOp(vm.TXOPAnd, 0)
+	}
 	pos := ctx.ByteCode.Len()
 
 	var elseNode node.Node
@@ -234,23 +360,129 @@ func compileElse(ctx *context, n *node.ElseNode) {
 	gotoOp.SetArg(ctx.ByteCode.Len() - pos + 1)
 }
 
+// compileSwitch first compares the value given to SWITCH against the
+// values of each CASE, jumping to the body of the first one that
+// matches. If none of them match, the default CASE (if any) is executed
+func compileSwitch(ctx *context, n *node.SwitchNode) {
+	ctx.AppendOp(vm.TXOPPushmark).SetComment("BEGIN SWITCH")
+	compile(ctx, n.Expression)
+	ctx.AppendOp(vm.TXOPPush).SetComment("Save SWITCH value")
+	ctx.enterBlock(vm.TXOPPop, vm.TXOPPopmark)
+	defer ctx.leaveBlock()
+
+	type jump struct {
+		op  vm.Op
+		pos int
+	}
+	var cases []*node.CaseNode
+	var defaultCase *node.CaseNode
+	matches := map[*node.CaseNode][]jump{}
+	for _, child := range n.ListNode.Nodes {
+		c, ok := child.(*node.CaseNode)
+		if !ok {
+			// Text before the first CASE is ignored
+			continue
+		}
+		cases = append(cases, c)
+		if c.Expression == nil {
+			defaultCase = c
+			continue
+		}
+
+		// CASE [a, b] matches either a or b. Values match like `==`
+		values := []node.Node{c.Expression}
+		if c.Expression.Type() == node.MakeArray {
+			values = c.Expression.(*node.UnaryNode).Child.(*node.ListNode).Nodes
+		}
+		for _, v := range values {
+			compile(ctx, v)
+			ctx.AppendOp(vm.TXOPMoveToSb)
+			ctx.AppendOp(vm.TXOPPop)
+			ctx.AppendOp(vm.TXOPPush)
+			ctx.AppendOp(vm.TXOPEquals)
+			op := ctx.AppendOp(vm.TXOPOr, 0)
+			matches[c] = append(matches[c], jump{op, ctx.ByteCode.Len() - 1})
+		}
+	}
+	nomatch := jump{ctx.AppendOp(vm.TXOPGoto, 0), ctx.ByteCode.Len() - 1}
+
+	var ends []jump
+	for _, c := range cases {
+		for _, j := range matches[c] {
+			j.op.SetArg(ctx.ByteCode.Len() - j.pos)
+		}
+		if c == defaultCase {
+			nomatch.op.SetArg(ctx.ByteCode.Len() - nomatch.pos)
+		}
+		for _, child := range c.ListNode.Nodes {
+			compile(ctx, child)
+		}
+		ends = append(ends, jump{ctx.AppendOp(vm.TXOPGoto, 0), ctx.ByteCode.Len() - 1})
+	}
+
+	if defaultCase == nil {
+		nomatch.op.SetArg(ctx.ByteCode.Len() - nomatch.pos)
+	}
+	for _, j := range ends {
+		j.op.SetArg(ctx.ByteCode.Len() - j.pos)
+	}
+	ctx.AppendOp(vm.TXOPPop).SetComment("Discard SWITCH value")
+	ctx.AppendOp(vm.TXOPPopmark).SetComment("END SWITCH")
+}
+
+// compileLogical compiles &&, || and //. The right hand side is only
+// evaluated if the left hand side does not decide the result, and the
+// result is the value of the last operand that was evaluated
+func compileLogical(ctx *context, n *node.BinaryNode) {
+	compile(ctx, n.Left)
+	var op vm.Op
+	switch n.Type() {
+	case node.And:
+		op = ctx.AppendOp(vm.TXOPAnd, 0)
+	case node.Or:
+		op = ctx.AppendOp(vm.TXOPOr, 0)
+	case node.DefinedOr:
+		op = ctx.AppendOp(vm.TXOPDefinedOr, 0)
+	}
+	pos := ctx.ByteCode.Len()
+	compile(ctx, n.Right)
+	op.SetArg(ctx.ByteCode.Len() - pos + 1)
+}
+
+func compileTernary(ctx *context, n *node.TernaryNode) {
+	compile(ctx, n.Condition)
+	andOp := ctx.AppendOp(vm.TXOPAnd, 0)
+	pos := ctx.ByteCode.Len()
+	compile(ctx, n.True)
+	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
+	andOp.SetArg(ctx.ByteCode.Len() - pos + 1)
+	pos = ctx.ByteCode.Len()
+	compile(ctx, n.False)
+	gotoOp.SetArg(ctx.ByteCode.Len() - pos + 1)
+}
+
 func compileBinaryOperands(ctx *context, x *node.BinaryNode) {
-	if x.Right.Type() == node.Group {
-		// Grouped node
+	switch x.Right.Type() {
+	case node.Int, node.Float, node.Text, node.FetchSymbol, node.LocalVar:
+		compile(ctx, x.Left)
+		ctx.AppendOp(vm.TXOPMoveToSb)
+		compile(ctx, x.Right)
+	default:
+		// Compiling anything more complex may clobber sb, so the
+		// right hand side is evaluated first, and kept on the stack
 		compile(ctx, x.Right)
 		ctx.AppendOp(vm.TXOPPush)
 		compile(ctx, x.Left)
 		ctx.AppendOp(vm.TXOPMoveToSb)
 		ctx.AppendOp(vm.TXOPPop)
-	} else {
-		compile(ctx, x.Left)
-		ctx.AppendOp(vm.TXOPMoveToSb)
-		compile(ctx, x.Right)
 	}
 }
 
 func compileAssignmentNodes(ctx *context, assignnodes []node.Node) {
 	if len(assignnodes) <= 0 {
+		// Make sure that we don't pass whatever was left in sb
+		ctx.AppendOp(vm.TXOPNil)
+		ctx.AppendOp(vm.TXOPMoveToSb)
 		return
 	}
 	ctx.AppendOp(vm.TXOPPushmark)
@@ -276,12 +508,14 @@ func compileForeach(ctx *context, x *node.ForeachNode) {
 	iter := ctx.AppendOp(vm.TXOPForIter, 0)
 	pos := ctx.ByteCode.Len()
 
+	ctx.pushLoop()
 	children := x.Nodes
 	for _, v := range children {
 		compile(ctx, v)
 	}
 
 	ctx.AppendOp(vm.TXOPGoto, -1*(ctx.ByteCode.Len()-pos+2)).SetComment("Jump back to for_iter at " + strconv.Itoa(pos))
+	ctx.popLoop(pos-2, ctx.ByteCode.Len())
 	ctx.AppendOp(vm.TXOPPopFrame).SetComment("END scope")
 
 	// Tell for iter to jump to this position when
@@ -291,11 +525,71 @@ func compileForeach(ctx *context, x *node.ForeachNode) {
 	ctx.AppendOp(vm.TXOPPopmark).SetComment("END FOREACH")
 }
 
+// pushLoop must be called when starting to compile a loop, so that
+// LAST and NEXT know where to jump to
+func (ctx *context) pushLoop() {
+	ctx.loops = append(ctx.loops, &loopContext{})
+}
+
+// popLoop resolves the LAST and NEXT in the current loop, and makes them
+// jump to lastPos and nextPos, respectively
+func (ctx *context) popLoop(nextPos, lastPos int) {
+	loop := ctx.loops[len(ctx.loops)-1]
+	ctx.loops = ctx.loops[:len(ctx.loops)-1]
+
+	for _, j := range loop.nexts {
+		j.op.SetArg(nextPos - j.pos)
+	}
+	for _, j := range loop.lasts {
+		j.op.SetArg(lastPos - j.pos)
+	}
+}
+
+// enterBlock records the ops that are required to leave a block that
+// pushed something to the stack, should a LAST or NEXT jump out of it
+func (ctx *context) enterBlock(ops ...vm.OpType) {
+	if len(ctx.loops) == 0 {
+		return
+	}
+	loop := ctx.loops[len(ctx.loops)-1]
+	loop.blocks = append(loop.blocks, ops)
+}
+
+// leaveBlock must be called when done compiling a block that was
+// entered with enterBlock
+func (ctx *context) leaveBlock() {
+	if len(ctx.loops) == 0 {
+		return
+	}
+	loop := ctx.loops[len(ctx.loops)-1]
+	loop.blocks = loop.blocks[:len(loop.blocks)-1]
+}
+
+// compileLoopControl compiles LAST and NEXT. The parser makes sure
+// that they only appear within a loop
+func compileLoopControl(ctx *context, n node.Node) {
+	loop := ctx.loops[len(ctx.loops)-1]
+	for i := len(loop.blocks) - 1; i >= 0; i-- {
+		for _, o := range loop.blocks[i] {
+			ctx.AppendOp(o)
+		}
+	}
+
+	j := loopJump{op: ctx.AppendOp(vm.TXOPGoto, 0), pos: ctx.ByteCode.Len() - 1}
+	if n.Type() == node.Last {
+		j.op.SetComment("LAST")
+		loop.lasts = append(loop.lasts, j)
+	} else {
+		j.op.SetComment("NEXT")
+		loop.nexts = append(loop.nexts, j)
+	}
+}
+
 func compileWhile(ctx *context, x *node.WhileNode) {
 	ctx.AppendOp(vm.TXOPPushmark)
 	ctx.AppendOp(vm.TXOPPushFrame)
 	ctx.AppendOp(vm.TXOPLiteral, 0)
-	ctx.AppendOp(vm.TXOPSaveToLvar, 0)
+	ctx.AppendOp(vm.TXOPSaveToLvar, x.LoopVarIdx)
 
 	condPos := ctx.ByteCode.Len() + 1
 
@@ -306,6 +600,10 @@ func compileWhile(ctx *context, x *node.WhileNode) {
 	ifop := ctx.AppendOp(vm.TXOPAnd, 0)
 	ifPos := ctx.ByteCode.Len()
 
+	// count the iterations, so that MaxLoopCount applies
+	ctx.AppendOp(vm.TXOPWhileIter, x.LoopVarIdx)
+
+	ctx.pushLoop()
 	children := x.Nodes
 	for _, v := range children {
 		compile(ctx, v)
@@ -315,6 +613,8 @@ func compileWhile(ctx *context, x *node.WhileNode) {
 	ctx.AppendOp(vm.TXOPGoto, -1*(ctx.ByteCode.Len()-condPos+1)).SetComment("Jump to " + strconv.Itoa(condPos))
 	ifop.SetArg(ctx.ByteCode.Len() - ifPos + 1)
 	ifop.SetComment("Jump to " + strconv.Itoa(ctx.ByteCode.Len()+1))
+	ctx.popLoop(condPos-1, ctx.ByteCode.Len())
+	ctx.AppendOp(vm.TXOPPopFrame)
 	ctx.AppendOp(vm.TXOPPopmark)
 }
 
@@ -326,9 +626,11 @@ func compileWrapper(ctx *context, x *node.WrapperNode) {
 
 	// From this place on, executed opcodes will write to a temporary
 	// new output
+	ctx.enterBlock(vm.TXOPRestoreWriter, vm.TXOPPop)
 	for _, v := range x.ListNode.Nodes {
 		compile(ctx, v)
 	}
+	ctx.leaveBlock()
 
 	// Pop the original writer, and place it back to the output
 	// Also push the output onto the stack
@@ -339,17 +641,22 @@ func compileWrapper(ctx *context, x *node.WrapperNode) {
 	// include context
 	compileAssignmentNodes(ctx, x.AssignmentNodes)
 
-	// Popt the "content"
+	// Pass the "content", followed by the names of the wrappers
 	ctx.AppendOp(vm.TXOPPop)
 	ctx.AppendOp(vm.TXOPPushmark)
-	ctx.AppendOp(vm.TXOPWrapper, x.WrapperName)
+	ctx.AppendOp(vm.TXOPPush)
+	for _, name := range x.WrapperNames {
+		ctx.AppendOp(vm.TXOPLiteral, name)
+		ctx.AppendOp(vm.TXOPPush)
+	}
+	ctx.AppendOp(vm.TXOPWrapper, x.WrapInto)
 	ctx.AppendOp(vm.TXOPPopmark)
 }
 
 func compileMacro(ctx *context, x *node.MacroNode) {
 	// The VM is responsible for passing arguments, which do not need
-	// to be declared as variables in the template. n.Arguments exists,
-	// but it's left untouched
+	// to be declared as variables in the template. They are bound by
+	// name, as template variables
 
 	// This goto effectively forces the VM to "ignore" this block of
 	// MACRO definition.
@@ -367,12 +674,146 @@ func compileMacro(ctx *context, x *node.MacroNode) {
 	ctx.AppendOp(vm.TXOPEnd) // This END forces termination
 	gotoOp.SetArg(ctx.ByteCode.Len() - start + 1)
 
-	// Now remember about this definition
-	ctx.AppendOp(vm.TXOPLiteral, entryPoint)
+	// Now remember about this definition: the name goes in sb, and
+	// the parameter names in sa
+	ctx.AppendOp(vm.TXOPLiteral, x.Name)
+	ctx.AppendOp(vm.TXOPMoveToSb)
+	ctx.AppendOp(vm.TXOPPushmark)
+	for _, arg := range x.Arguments {
+		ctx.AppendOp(vm.TXOPLiteral, arg.Name)
+		ctx.AppendOp(vm.TXOPPush)
+	}
+	ctx.AppendOp(vm.TXOPMakeArray)
+	ctx.AppendOp(vm.TXOPPopmark)
+	ctx.AppendOp(vm.TXOPMakeMacro, entryPoint)
 	ctx.AppendOp(vm.TXOPSaveToLvar, x.LocalVar.Offset)
 }
 
+// compileBlocks compiles the body of each BLOCK, so that they can be
+// called from anywhere in the template, even before their definition
+func compileBlocks(ctx *context, ast *parser.AST, merged *cascade) {
+	blocks := merged.blocks
+	if len(blocks) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(blocks))
+	for name := range blocks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx.blocks = blocks
+	ctx.blockEntries = make(map[string]int)
+
+	// Just like MACROs, the VM should skip over the BLOCKs
+	gotoOp := ctx.AppendOp(vm.TXOPGoto, 0)
+	start := ctx.ByteCode.Len()
+	for _, name := range names {
+		blk := blocks[name]
+		origin := merged.origins[blk]
+		ctx.setOrigin(origin)
+		ctx.Pos = blk.Pos()
+		ctx.block = blk
+		ctx.blockEntries[name] = ctx.ByteCode.Len()
+		ctx.AppendOp(vm.TXOPNoop).SetComment("BEGIN BLOCK " + name)
+		for _, child := range blk.Nodes {
+			compile(ctx, child)
+		}
+		ctx.AppendOp(vm.TXOPEnd)
+		ctx.addSection(ast, origin, ctx.blockEntries[name])
+	}
+	ctx.block = nil
+	ctx.setOrigin(ast)
+	gotoOp.SetArg(ctx.ByteCode.Len() - start + 1)
+	ctx.Pos = 0
+}
+
+// setOrigin makes the ops that are compiled from here on refer to the
+// source of `origin`, which is either the template being compiled or
+// one of the templates that it cascades from
+func (ctx *context) setOrigin(origin *parser.AST) {
+	if ctx.Text != origin.Text {
+		ctx.Text = origin.Text
+		ctx.Lines = position.NewIndex(ctx.Text)
+	}
+}
+
+// addSection records that the ops from `start` onwards were compiled
+// from `origin`, unless that's `ast` itself
+func (ctx *context) addSection(ast, origin *parser.AST, start int) {
+	if origin == ast || start == ctx.ByteCode.Len() {
+		return
+	}
+	ctx.ByteCode.Sections = append(ctx.ByteCode.Sections, vm.Section{
+		Start:  start,
+		End:    ctx.ByteCode.Len(),
+		Name:   origin.Name,
+		Source: origin.Text,
+	})
+}
+
+// compileBlockCall compiles INCLUDE or PROCESS of a BLOCK. The local
+// variables in the caller's scope are passed as variables, and after
+// PROCESS, the variables set at the top level of the BLOCK are copied
+// back to the caller: to its local variable of the same name if there
+// is one, or to its template variables otherwise
+func compileBlockCall(ctx *context, x *node.IncludeNode, name string) {
+	blk := ctx.blocks[name]
+	assignments := make([]node.Node, 0, len(x.LocalVars)+len(x.AssignmentNodes))
+	for _, lv := range x.LocalVars {
+		a := node.NewAssignmentNode(lv.Pos(), lv.Name)
+		a.Expression = lv
+		assignments = append(assignments, a)
+	}
+	assignments = append(assignments, x.AssignmentNodes...)
+	compileAssignmentNodes(ctx, assignments)
+
+	ctx.AppendOp(vm.TXOPPushmark)
+	if x.Type() != node.Include {
+		offsets := make(map[string]int, len(x.LocalVars))
+		for _, lv := range x.LocalVars {
+			offsets[lv.Name] = lv.Offset
+		}
+
+		names := make([]string, 0, len(blk.LocalVars))
+		for name, idx := range blk.LocalVars {
+			if idx >= 0 {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			ctx.AppendOp(vm.TXOPLiteral, blk.LocalVars[name])
+			ctx.AppendOp(vm.TXOPPush)
+			if offset, ok := offsets[name]; ok {
+				ctx.AppendOp(vm.TXOPLiteral, offset)
+			} else {
+				ctx.AppendOp(vm.TXOPLiteral, name)
+			}
+			ctx.AppendOp(vm.TXOPPush)
+		}
+	}
+	ctx.AppendOp(vm.TXOPLiteral, blk.Name)
+	op := ctx.AppendOp(vm.TXOPCallBlock, 0)
+	ctx.blockCalls = append(ctx.blockCalls, blockCall{op: op, name: name})
+	ctx.AppendOp(vm.TXOPPopmark)
+}
+
 func compileInclude(ctx *context, x *node.IncludeNode) {
+	if x.Type() == node.Super {
+		compileBlockCall(ctx, x, ctx.block.Super)
+		return
+	}
+
+	if sym, ok := x.IncludeTarget.(*node.TextNode); ok && sym.Type() == node.FetchSymbol {
+		if _, ok := ctx.blocks[string(sym.Text)]; ok {
+			compileBlockCall(ctx, x, string(sym.Text))
+			return
+		}
+	}
+
 	compile(ctx, x.IncludeTarget)
 	ctx.AppendOp(vm.TXOPPush)
 	// Arguments to include (WITH foo = "bar") need to be evaulated
@@ -396,6 +837,10 @@ func compileBinaryArithmetic(ctx *context, n *node.BinaryNode) {
 		optype = vm.TXOPMul
 	case node.Div:
 		optype = vm.TXOPDiv
+	case node.Mod:
+		optype = vm.TXOPMod
+	case node.Concat:
+		optype = vm.TXOPConcat
 	default:
 		panic("Unknown arithmetic")
 	}
@@ -409,6 +854,8 @@ func compileLiteral(ctx *context, n node.Node) {
 	switch n.Type() {
 	case node.Int:
 		op = ctx.AppendOp(vm.TXOPLiteral, n.(*node.NumberNode).Value.Int())
+	case node.Float:
+		op = ctx.AppendOp(vm.TXOPLiteral, n.(*node.NumberNode).Value.Float())
 	case node.Text:
 		op = ctx.AppendOp(vm.TXOPLiteral, n.(*node.TextNode).Text)
 	default:
@@ -419,8 +866,7 @@ func compileLiteral(ctx *context, n node.Node) {
 
 func compileAssignment(ctx *context, n *node.AssignmentNode) {
 	compile(ctx, n.Expression)
-	// XXX this 0 must be pre-computed
-	ctx.AppendOp(vm.TXOPSaveToLvar, 0).SetComment("Saving to local var 0")
+	ctx.AppendOp(vm.TXOPSaveToLvar, n.Assignee.Offset).SetComment("Saving to local var '" + n.Assignee.Name + "'")
 }
 
 func compileLoadLvar(ctx *context, n *node.LocalVarNode) {
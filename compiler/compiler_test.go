@@ -7,7 +7,7 @@ import (
 	"testing"
 )
 
-func compile(t *testing.T, tmpl string) *vm.ByteCode {
+func compileTemplate(t *testing.T, tmpl string) *vm.ByteCode {
 	p := tterse.New()
 	ast, err := p.ParseString(tmpl, tmpl)
 	if err != nil {
@@ -33,11 +33,11 @@ func TestCompiler(t *testing.T) {
 }
 
 func TestCompile_RawText(t *testing.T) {
-	compile(t, `Hello, World!`)
+	compileTemplate(t, `Hello, World!`)
 }
 
 func TestCompile_LocalVar(t *testing.T) {
-	compile(t, `[% s %]`)
+	compileTemplate(t, `[% s %]`)
 }
 
 func TestCompile_Wrapper(t *testing.T) {
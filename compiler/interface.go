@@ -1,6 +1,8 @@
 package compiler
 
 import (
+	"github.com/lestrrat-go/xslate/internal/position"
+	"github.com/lestrrat-go/xslate/node"
 	"github.com/lestrrat-go/xslate/parser"
 	"github.com/lestrrat-go/xslate/vm"
 )
@@ -13,6 +15,41 @@ type Compiler interface {
 
 type context struct {
 	ByteCode *vm.ByteCode
+
+	// used to record where in the template each op came from
+	Text  string
+	Lines position.Index
+	Pos   int // position of the node currently being compiled
+
+	// loops that enclose the node currently being compiled, innermost last
+	loops []*loopContext
+
+	// BLOCKs defined in the template, and where they start. Calls to
+	// BLOCKs are resolved once all of them have been compiled
+	blocks       map[string]*node.BlockNode
+	blockEntries map[string]int
+	blockCalls   []blockCall
+	block        *node.BlockNode // BLOCK currently being compiled
+}
+
+type blockCall struct {
+	op   vm.Op
+	name string
+}
+
+// loopContext keeps track of the LAST and NEXT within a loop, which
+// can only be resolved once the whole loop has been compiled
+type loopContext struct {
+	// ops required to leave each of the blocks (IF, SWITCH, ...) that
+	// were entered since the start of the loop, innermost last
+	blocks [][]vm.OpType
+	lasts  []loopJump
+	nexts  []loopJump
+}
+
+type loopJump struct {
+	op  vm.Op
+	pos int // index of op
 }
 
 // BasicCompiler is the default compiler used by Xslate
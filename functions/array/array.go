@@ -1,6 +1,9 @@
 package array
 
 import (
+	"bytes"
+	"fmt"
+
 	"github.com/lestrrat-go/xslate/functions"
 )
 
@@ -9,6 +12,7 @@ var depot = functions.NewFuncDepot("array")
 func init() {
 	depot.Set("Item", Item)
 	depot.Set("Size", Size)
+	depot.Set("Join", Join)
 }
 
 // Item returns the `i`-th item in the list
@@ -21,6 +25,18 @@ func Size(l []interface{}) int {
 	return len(l)
 }
 
+// Join returns the items in the list, separated by sep
+func Join(l []interface{}, sep string) string {
+	buf := bytes.Buffer{}
+	for i, v := range l {
+		if i > 0 {
+			buf.WriteString(sep)
+		}
+		fmt.Fprint(&buf, v)
+	}
+	return buf.String()
+}
+
 // First returns the first element
 func First(l []interface{}) interface{} {
 	return l[0]
@@ -8,22 +8,22 @@ import (
 )
 
 // Frame represents a single stack frame. It has a reference to the main
-// stack where the actual data resides. Frame is just a convenient
-// wrapper to remember when the Frame started
+// stack where the actual data resides, which is shared by all frames.
+// Frame is just a convenient wrapper to remember when the Frame started
 type Frame struct {
-	stack stack.Stack
+	stack *stack.Stack
 	mark  int
 }
 
 // New creates a new Frame instance.
-func New(s stack.Stack) *Frame {
+func New(s *stack.Stack) *Frame {
 	return &Frame{
 		mark:  0,
 		stack: s,
 	}
 }
 
-func (f Frame) Stack() stack.Stack {
+func (f Frame) Stack() *stack.Stack {
 	return f.stack
 }
 
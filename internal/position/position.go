@@ -0,0 +1,112 @@
+// Package position maps byte offsets in template sources to lines and
+// columns, and formats source snippets for use in error messages.
+package position
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Index holds the byte offsets where each line in a text starts. Create
+// one with NewIndex when many offsets in the same text must be looked up
+type Index []int
+
+// NewIndex creates a new Index for `text`
+func NewIndex(text string) Index {
+	idx := Index{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			idx = append(idx, i+1)
+		}
+	}
+	return idx
+}
+
+// Lookup returns the line and column of the byte offset `pos` in `text`,
+// which must be the same text that the Index was created from. Both line
+// and column start from 1, and columns are counted in runes
+func (idx Index) Lookup(text string, pos int) (line, col int) {
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > len(text) {
+		pos = len(text)
+	}
+
+	// Find the last line that starts at or before pos
+	i := sort.Search(len(idx), func(i int) bool { return idx[i] > pos }) - 1
+	return i + 1, utf8.RuneCountInString(text[idx[i]:pos]) + 1
+}
+
+// Lookup is a shortcut for NewIndex(text).Lookup(text, pos)
+func Lookup(text string, pos int) (line, col int) {
+	return NewIndex(text).Lookup(text, pos)
+}
+
+// Line returns the `n`-th line of `text` (starting from 1), without the
+// trailing newline. An empty string is returned if there is no such line
+func Line(text string, n int) string {
+	if n < 1 {
+		return ""
+	}
+
+	for i := 1; i < n; i++ {
+		nl := strings.IndexByte(text, '\n')
+		if nl < 0 {
+			return ""
+		}
+		text = text[nl+1:]
+	}
+
+	if nl := strings.IndexByte(text, '\n'); nl >= 0 {
+		text = text[:nl]
+	}
+	return strings.TrimSuffix(text, "\r")
+}
+
+// Snippet returns the `line`-th line of `text`, followed by a line
+// containing a marker pointing at column `col`. An empty string is
+// returned if there is no such line
+func Snippet(text string, line, col int) string {
+	l := Line(text, line)
+	if strings.TrimSpace(l) == "" {
+		return ""
+	}
+
+	buf := make([]byte, 0, 2*len(l)+10)
+	buf = append(buf, "    "...)
+	buf = append(buf, l...)
+	buf = append(buf, "\n    "...)
+
+	// Keep tabs so that the marker lines up with the source line
+	i := 1
+	for _, r := range l {
+		if i >= col {
+			break
+		}
+		if r == '\t' {
+			buf = append(buf, '\t')
+		} else {
+			buf = append(buf, ' ')
+		}
+		i++
+	}
+	buf = append(buf, '^')
+	return string(buf)
+}
+
+// Format creates the "name:line:col: msg" form used by errors that
+// refer to a location in a template. Zero values for line and col
+// mean that they are unknown, and are omitted
+func Format(name string, line, col int, msg string) string {
+	switch {
+	case line <= 0:
+		return name + ": " + msg
+	case col <= 0:
+		return name + ":" + strconv.Itoa(line) + ": " + msg
+	default:
+		return name + ":" + strconv.Itoa(line) + ":" + strconv.Itoa(col) + ": " + msg
+	}
+}
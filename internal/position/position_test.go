@@ -0,0 +1,56 @@
+package position
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLookup(t *testing.T) {
+	text := "Hello\n[% foo %]\n\t日本語 [% bar %]"
+
+	idx := NewIndex(text)
+	for _, c := range []struct {
+		pos  int
+		line int
+		col  int
+	}{
+		{0, 1, 1},
+		{5, 1, 6},
+		{6, 2, 1},
+		{9, 2, 4},
+		{16, 3, 1},
+		{27, 3, 6}, // "[" after "\t日本語 "
+		{len(text), 3, 15},
+		{len(text) + 10, 3, 15},
+	} {
+		line, col := idx.Lookup(text, c.pos)
+		if !assert.Equal(t, c.line, line, "line for offset %d", c.pos) {
+			return
+		}
+		if !assert.Equal(t, c.col, col, "column for offset %d", c.pos) {
+			return
+		}
+	}
+}
+
+func TestLine(t *testing.T) {
+	text := "one\r\ntwo\nthree"
+	assert.Equal(t, "one", Line(text, 1))
+	assert.Equal(t, "two", Line(text, 2))
+	assert.Equal(t, "three", Line(text, 3))
+	assert.Equal(t, "", Line(text, 4))
+	assert.Equal(t, "", Line(text, 0))
+}
+
+func TestSnippet(t *testing.T) {
+	text := "Hello\n\t[% foo %]"
+	assert.Equal(t, "    \t[% foo %]\n    \t   ^", Snippet(text, 2, 5))
+	assert.Equal(t, "", Snippet(text, 3, 1))
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "index.tx:42:7: oops", Format("index.tx", 42, 7, "oops"))
+	assert.Equal(t, "index.tx:42: oops", Format("index.tx", 42, 0, "oops"))
+	assert.Equal(t, "index.tx: oops", Format("index.tx", 0, 0, "oops"))
+}
@@ -0,0 +1,254 @@
+package xslate
+
+import (
+	"github.com/lestrrat-go/xslate/parser"
+	"github.com/lestrrat-go/xslate/test"
+	"testing"
+)
+
+func newKolonCtx(t test.Tester) *testctx {
+	c := newTestCtx(t)
+	pargs := c.XslateArgs["Parser"].(Args)
+	pargs["Syntax"] = "Kolon"
+
+	return c
+}
+
+func TestKolon_SimpleString(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`Hello, World!`, nil, `Hello, World!`)
+	c.renderStringAndCompare(`    <:- "Hello, World!" :>`, nil, `Hello, World!`)
+	c.renderStringAndCompare(`<: "Hello, World!" -:>    `, nil, `Hello, World!`)
+}
+
+func TestKolon_Comments(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`:# This is a comment`, nil, ``)
+	c.renderStringAndCompare("a\n  : # This is a comment\nb", nil, "a\nb")
+	c.renderStringAndCompare(`    <:- "Hello, World!" :>`, nil, `Hello, World!`)
+	c.renderStringAndCompare(`<: "Hello, World!" -:>    `, nil, `Hello, World!`)
+}
+
+func TestKolon_Cascade(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.File("base.tx").WriteString(`<title><: block title -> { :>Default<: } :></title><: block content -> { :>body<: } :>`)
+	c.File("child.tx").WriteString(`<: cascade base :>
+<: override title -> { :>My Page<: } :>
+<: around content -> { :>[<: super :>]<: } :>
+<: after content -> { :>!<: } :>`)
+
+	tx := c.CreateTx()
+	c.renderAndCompare(tx, "base.tx", nil, `<title>Default</title>body`)
+	c.renderAndCompare(tx, "child.tx", nil, `<title>My Page</title>[body]!`)
+}
+
+func TestKolon_Variable(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`Hello, <: $name :>!`, Vars{"name": "Bob"}, `Hello, Bob!`)
+	c.renderStringAndCompare(`<: $user.name :>`, Vars{"user": map[string]interface{}{"name": "Alice"}}, `Alice`)
+	c.renderStringAndCompare(`<: $list[1] :>`, Vars{"list": []int{1, 2, 3}}, `2`)
+	c.renderStringAndCompare(`<: $user.tags[0] :>`, Vars{"user": map[string]interface{}{"tags": []string{"go", "perl"}}}, `go`)
+	c.renderStringAndCompare(`<: $a ~ "-" ~ $b :>`, Vars{"a": 1, "b": 2}, `1-2`)
+	c.renderStringAndCompare(`<: $h["key"] :>`, Vars{"h": map[string]interface{}{"key": "value"}}, `value`)
+	c.renderStringAndCompare(`<: $h[$k] :>`, Vars{"h": map[string]interface{}{"key": "value"}, "k": "key"}, `value`)
+	c.renderStringAndCompare(`<: $h["a"]["b"] :>`, Vars{"h": map[string]interface{}{"a": map[string]interface{}{"b": "c"}}}, `c`)
+}
+
+func TestKolon_Print(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"name": "<Bob>"}
+	c.renderStringAndCompare(`<: print $name :>`, vars, `&lt;Bob&gt;`)
+	c.renderStringAndCompare(`<: print($name) :>`, vars, `&lt;Bob&gt;`)
+	c.renderStringAndCompare(`<: print "a", $name, "b" :>`, vars, `a&lt;Bob&gt;b`)
+	c.renderStringAndCompare(`<: print_raw $name :>`, vars, `<Bob>`)
+	c.renderStringAndCompare(`<: print_raw "a", $name :>`, vars, `a<Bob>`)
+	c.renderStringAndCompare("  : print $name\n", vars, "&lt;Bob&gt;")
+	c.renderStringAndCompare(`<: for [1, 2] -> $i { print $i; print_raw "," } :>`, nil, `1,2,`)
+}
+
+func TestKolon_MethodCall(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: [1, 2, 3].join(",") :>`, nil, `1,2,3`)
+	c.renderStringAndCompare(`<: [1, 2, 3].size() :>`, nil, `3`)
+	c.renderStringAndCompare(`<: $list.join(", ") :>`, Vars{"list": []string{"a", "b"}}, `a, b`)
+	c.renderStringAndCompare(`<: { a => 1 }.keys().join(",") :>`, nil, `a`)
+	c.renderStringAndCompare(`<: { a => 1 }["a"] :>`, nil, `1`)
+}
+
+func TestKolon_AutoEscape(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"html": "<b>"}
+	c.renderStringAndCompare(`<: $html :>`, vars, `&lt;b&gt;`)
+	c.renderStringAndCompare(`<: $html | raw :>`, vars, `<b>`)
+	c.renderStringAndCompare(`<: raw($html) :>`, vars, `<b>`)
+	c.renderStringAndCompare(`<: mark_raw($html) :>`, vars, `<b>`)
+}
+
+func TestKolon_My(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: my $x = 1; $x = $x + 1; $x :>`, nil, `2`)
+	c.renderStringAndCompare(`<: my $x = "a" :><: $x :><: my $x = $x ~ "b" :><: $x :>`, nil, `aab`)
+}
+
+func TestKolon_MultiLineTag(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	template := `<:
+    # compute the total
+    my $total = 0;
+    for $list -> $i {
+        $total += $i;
+    }
+    $total
+:>`
+	c.renderStringAndCompare(template, Vars{"list": []int{1, 2, 3}}, `6`)
+}
+
+func TestKolon_For(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"list": []string{"a", "b", "c"}}
+	c.renderStringAndCompare(`<: for $list -> $item { :><: $item :>,<: } :>`, vars, `a,b,c,`)
+	c.renderStringAndCompare(`<: for $list -> $item { :><: $~item.index :><: $item :>,<: } :>`, vars, `0a,1b,2c,`)
+	c.renderStringAndCompare(`<: for $list -> $item { :><: $~item.count :><: $~item.size :>,<: } :>`, vars, `13,23,33,`)
+	c.renderStringAndCompare(`<: for $list -> $item { :><: $~item.is_first :>/<: $~item.is_last :>,<: } :>`, vars, `true/false,false/false,false/true,`)
+	c.renderStringAndCompare(`<: for [1..3] -> $i { :><: $i :><: } :>`, nil, `123`)
+
+	// last and next
+	c.renderStringAndCompare(`<: for [1..6] -> $i { if $i > 3 { last } $i } :>`, nil, `123`)
+	c.renderStringAndCompare(`<: for [1..6] -> $i { if $i % 2 { next } $i } :>`, nil, `246`)
+}
+
+func TestKolon_While(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: my $i = 0; while $i < 3 { :><: $i :><: $i++; } :>`, nil, `012`)
+}
+
+func TestKolon_If(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	template := `<: if $x == 1 { :>one<: } else if $x == 2 { :>two<: } else { :>other<: } :>`
+	c.renderStringAndCompare(template, Vars{"x": 1}, `one`)
+	c.renderStringAndCompare(template, Vars{"x": 2}, `two`)
+	c.renderStringAndCompare(template, Vars{"x": 3}, `other`)
+
+	c.renderStringAndCompare(`<: if $x { :>yes<: } :>!`, Vars{"x": false}, `!`)
+}
+
+func TestKolon_Given(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	template := `<: given $x { when "a" { :>A<: } when ["b", "c"] { :>B or C<: } default { :>Other<: } } :>`
+	c.renderStringAndCompare(template, Vars{"x": "a"}, `A`)
+	c.renderStringAndCompare(template, Vars{"x": "c"}, `B or C`)
+	c.renderStringAndCompare(template, Vars{"x": "d"}, `Other`)
+}
+
+func TestKolon_Macro(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`<: macro greet -> ($greeting, $name) { :><: $greeting :>, <: $name :>!<: } :><: greet("Hello", "Bob") :>`, nil, `Hello, Bob!`)
+}
+
+func TestKolon_Include(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	c.File("include/index.tx").WriteString(`<: include "include/parts.tx" :>`)
+	c.File("include/hash.tx").WriteString(`<: include "include/parts.tx" { name => "Alice" } :>`)
+	c.File("include/parts.tx").WriteString(`Hello, <: $name :>!`)
+
+	tx := c.CreateTx()
+	c.renderAndCompare(tx, "include/index.tx", Vars{"name": "Bob"}, `Hello, Bob!`)
+	c.renderAndCompare(tx, "include/hash.tx", Vars{"name": "Bob"}, `Hello, Alice!`)
+}
+
+func TestKolon_Error(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	tx := c.CreateTx()
+	for _, template := range []string{
+		`<: $ :>`,
+		`<: $1 :>`,
+		`<: for $list -> $item { :>`,
+		`<: if $x { :>`,
+		`<: $x`,
+	} {
+		if _, err := tx.RenderString(template, nil); err == nil {
+			t.Errorf("Expected '%s' to fail", template)
+		}
+	}
+}
+
+func TestKolon_LineCode(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	template := `<ul>
+: for $list -> $item {
+  <li><: $item :></li>
+: }
+</ul>`
+	c.renderStringAndCompare(template, Vars{"list": []int{1, 2}}, "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>")
+
+	// Line code can be indented, and may contain comments and several
+	// statements
+	template = `    : my $total = 0; # the sum
+    : for $list -> $i { $total += $i }
+Total: <: $total :>
+    :if $total > 2 {
+big
+    :} else {
+small
+    :}
+`
+	c.renderStringAndCompare(template, Vars{"list": []int{1, 2}}, "Total: 3\nbig\n")
+
+	// An expression on its own line is printed, without the newline
+	c.renderStringAndCompare(": $name\n!", Vars{"name": "Bob"}, "Bob!")
+	c.renderStringAndCompare(": $name", Vars{"name": "Bob"}, "Bob")
+
+	// Colons that don't start a line are just text
+	c.renderStringAndCompare("a: <: $name :>\nb:c", Vars{"name": "Bob"}, "a: Bob\nb:c")
+}
+
+func TestKolon_GlobalChomp(t *testing.T) {
+	c := newKolonCtx(t)
+	defer c.Cleanup()
+
+	// Lines of code are not affected by the global chomp modes
+	pargs := c.XslateArgs["Parser"].(Args)
+	pargs["PreChomp"] = parser.ChompGreedy
+	pargs["PostChomp"] = parser.ChompGreedy
+	template := `<ul>
+: for $list -> $i {
+  <li> <: $i :> </li>
+: }
+</ul>`
+	c.renderStringAndCompare(template, Vars{"list": []int{1, 2}}, "<ul>\n  <li>1</li>\n  <li>2</li>\n</ul>")
+	c.renderStringAndCompare(`<: "a" ~ "b" ~:> c`, nil, `ab c`)
+}
@@ -22,13 +22,16 @@ func NewCachedByteCodeLoader(
 	parser parser.Parser,
 	compiler compiler.Compiler,
 ) *CachedByteCodeLoader {
-	return &CachedByteCodeLoader{
-		NewStringByteCodeLoader(parser, compiler),
-		NewReaderByteCodeLoader(parser, compiler),
-		fetcher,
-		[]Cache{MemoryCache{}, cache},
-		cacheLevel,
+	l := &CachedByteCodeLoader{
+		StringByteCodeLoader: NewStringByteCodeLoader(parser, compiler),
+		ReaderByteCodeLoader: NewReaderByteCodeLoader(parser, compiler),
+		Fetcher:              fetcher,
+		Caches:               []Cache{MemoryCache{}, cache},
+		CacheLevel:           cacheLevel,
 	}
+	l.StringByteCodeLoader.Fetcher = fetcher
+	l.ReaderByteCodeLoader.Fetcher = fetcher
+	return l
 }
 
 func (l *CachedByteCodeLoader) DumpAST(v bool) {
@@ -62,33 +65,12 @@ func (l *CachedByteCodeLoader) Load(key string) (bc *vm.ByteCode, err error) {
 		}
 	}()
 
-	var source TemplateSource
-	if l.CacheLevel > CacheNone {
-		var entity *CacheEntity
-		for _, cache := range l.Caches {
-			entity, err = cache.Get(key)
-			if err == nil {
-				break
-			}
-		}
-
-		if err == nil {
-			if l.CacheLevel == CacheNoVerify {
-				return entity.ByteCode, nil
-			}
-
-			t, err := entity.Source.LastModified()
-			if err != nil {
-				return nil, errors.Wrap(err, "failed to get last-modified from source")
-			}
-
-			if t.Before(entity.ByteCode.GeneratedOn) {
-				return entity.ByteCode, nil
-			}
-
-			// ByteCode validation failed, but we can still re-use source
-			source = entity.Source
-		}
+	source, bc, err := l.loadFromCache(key)
+	if err != nil {
+		return nil, err
+	}
+	if bc != nil {
+		return bc, nil
 	}
 
 	if source == nil {
@@ -103,12 +85,16 @@ func (l *CachedByteCodeLoader) Load(key string) (bc *vm.ByteCode, err error) {
 		return nil, errors.Wrap(err, "failed to get the reader")
 	}
 
-	bc, err = l.LoadReader(key, rdr)
+	// Parsing and compiling is done without holding the lock, so that
+	// loading one template does not block others
+	bc, ancestors, err := l.loadReader(key, rdr)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read byte code")
 	}
 
-	entity := &CacheEntity{bc, source}
+	entity := &CacheEntity{bc, source, ancestors}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	for _, cache := range l.Caches {
 		cache.Set(key, entity)
 	}
@@ -116,6 +102,56 @@ func (l *CachedByteCodeLoader) Load(key string) (bc *vm.ByteCode, err error) {
 	return bc, nil
 }
 
+// loadFromCache looks for a valid cached ByteCode for `key`. If the cache
+// entry was found but is stale, the ByteCode is nil but the cached
+// TemplateSource is returned so that it can be reused
+func (l *CachedByteCodeLoader) loadFromCache(key string) (TemplateSource, *vm.ByteCode, error) {
+	if l.CacheLevel <= CacheNone {
+		return nil, nil, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var entity *CacheEntity
+	var err error
+	for _, cache := range l.Caches {
+		entity, err = cache.Get(key)
+		if err == nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, nil, nil
+	}
+
+	// ByteCode from another version may use different op codes
+	if entity.ByteCode == nil || entity.ByteCode.Version != vm.ByteCodeVersion {
+		return entity.Source, nil, nil
+	}
+
+	if l.CacheLevel == CacheNoVerify {
+		return entity.Source, entity.ByteCode, nil
+	}
+
+	// The ByteCode is stale if the template, or any of the templates
+	// that it cascades from, has been modified since it was generated
+	for _, source := range append([]TemplateSource{entity.Source}, entity.Ancestors...) {
+		t, err := source.LastModified()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to get last-modified from source")
+		}
+
+		if !t.Before(entity.ByteCode.GeneratedOn) {
+			// ByteCode validation failed, but we can still re-use source
+			return entity.Source, nil, nil
+		}
+	}
+
+	return entity.Source, entity.ByteCode, nil
+}
+
 // NewFileCache creates a new FileCache which stores caches underneath
 // the directory specified by `dir`
 func NewFileCache(dir string) (*FileCache, error) {
@@ -161,7 +197,7 @@ func (c *FileCache) Set(key string, entity *CacheEntity) error {
 	}
 
 	// Need to avoid race condition
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0666)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return errors.Wrap(err, "failed to open/create a cache file")
 	}
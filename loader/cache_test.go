@@ -0,0 +1,107 @@
+package loader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/lestrrat-go/xslate/compiler"
+	"github.com/lestrrat-go/xslate/parser/tterse"
+	"github.com/lestrrat-go/xslate/vm"
+)
+
+func TestFileCache_Positions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xslate-cache-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	template := "Hello,\n[% name %]!"
+	ast, err := tterse.New().ParseString("index.tx", template)
+	if err != nil {
+		t.Fatalf("Failed to parse template: %s", err)
+	}
+
+	bc, err := compiler.New().Compile(ast)
+	if err != nil {
+		t.Fatalf("Failed to compile template: %s", err)
+	}
+
+	c, _ := NewFileCache(filepath.Join(dir, "cache"))
+	source := NewFileSource(filepath.Join(dir, "index.tx"))
+	if err := c.Set("index.tx", &CacheEntity{bc, source, nil}); err != nil {
+		t.Fatalf("Failed to set cache: %s", err)
+	}
+
+	entity, err := c.Get("index.tx")
+	if err != nil {
+		t.Fatalf("Failed to get cache: %s", err)
+	}
+
+	if fs, ok := entity.Source.(*FileSource); !ok || fs.Path != source.Path {
+		t.Errorf("Expected source to be preserved, got %#v", entity.Source)
+	}
+
+	cached := entity.ByteCode
+	if cached.Len() != bc.Len() {
+		t.Fatalf("Expected %d ops, got %d", bc.Len(), cached.Len())
+	}
+
+	for i := 0; i < bc.Len(); i++ {
+		if cached.Position(i) != bc.Position(i) {
+			t.Errorf("Expected position %v for op %d, got %v", bc.Position(i), i, cached.Position(i))
+		}
+	}
+
+	// "name" is on the second line
+	found := false
+	for i := 0; i < cached.Len(); i++ {
+		if cached.Get(i).ArgString() == "name" {
+			found = true
+			if pos := cached.Position(i); pos.Line != 2 || pos.Column != 4 {
+				t.Errorf("Expected 'name' at 2:4, got %d:%d", pos.Line, pos.Column)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Could not find op fetching 'name'")
+	}
+}
+
+func TestCachedByteCodeLoader_Version(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xslate-cache-")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, _ := NewFileCache(filepath.Join(dir, "cache"))
+	l := &CachedByteCodeLoader{
+		Caches:     []Cache{c},
+		CacheLevel: CacheNoVerify,
+	}
+
+	source := NewFileSource(filepath.Join(dir, "index.tx"))
+	bc := vm.NewByteCode()
+	if err := c.Set("index.tx", &CacheEntity{bc, source, nil}); err != nil {
+		t.Fatalf("Failed to set cache: %s", err)
+	}
+	if _, cached, err := l.loadFromCache("index.tx"); err != nil || cached == nil {
+		t.Errorf("Expected ByteCode of the current version to be loaded from cache (err = %v)", err)
+	}
+
+	// ByteCode cached by an older version must be compiled again
+	bc.Version = 1.0
+	if err := c.Set("index.tx", &CacheEntity{bc, source, nil}); err != nil {
+		t.Fatalf("Failed to set cache: %s", err)
+	}
+	cachedSource, cached, err := l.loadFromCache("index.tx")
+	if err != nil || cached != nil {
+		t.Errorf("Expected ByteCode of an older version to be ignored (err = %v)", err)
+	}
+	if cachedSource == nil {
+		t.Errorf("Expected the cached source to be reused")
+	}
+}
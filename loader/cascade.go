@@ -0,0 +1,42 @@
+package loader
+
+import (
+	"github.com/lestrrat-go/xslate/parser"
+	"github.com/pkg/errors"
+)
+
+// resolveCascade loads the templates that `ast` cascades from, and links
+// them via AST.Parent so that the compiler can merge them. The sources of
+// all of the ancestors are returned, so that the cached ByteCode can be
+// invalidated when any of them changes
+func resolveCascade(ast *parser.AST, p parser.Parser, f TemplateFetcher) ([]TemplateSource, error) {
+	var sources []TemplateSource
+	seen := map[string]struct{}{ast.Name: {}}
+	for cur := ast; cur.Cascade != ""; cur = cur.Parent {
+		name := cur.Cascade
+		if f == nil {
+			return nil, errors.Errorf("failed to cascade from %s: no template fetcher available", name)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, errors.Errorf("failed to cascade from %s: circular cascade", name)
+		}
+		seen[name] = struct{}{}
+
+		source, err := f.FetchTemplate(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch template %s to cascade from", name)
+		}
+		rdr, err := source.Reader()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get the reader")
+		}
+		parent, err := p.ParseReader(name, rdr)
+		if err != nil {
+			return nil, err
+		}
+
+		cur.Parent = parent
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
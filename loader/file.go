@@ -1,6 +1,7 @@
 package loader
 
 import (
+	"encoding/gob"
 	"errors"
 	"io"
 	"io/ioutil"
@@ -50,6 +51,25 @@ func (l *FileTemplateFetcher) FetchTemplate(path string) (TemplateSource, error)
 	return nil, ErrTemplateNotFound
 }
 
+func init() {
+	// CacheEntity.Source is an interface, so the concrete type must be
+	// registered for FileCache to be able to store it
+	gob.Register(&FileSource{})
+}
+
+// GobEncode encodes the FileSource for FileCache. Only the path is
+// stored, as the results of os.Stat() can't be encoded, and are only
+// meaningful for a short while anyway
+func (s *FileSource) GobEncode() ([]byte, error) {
+	return []byte(s.Path), nil
+}
+
+// GobDecode decodes the FileSource encoded by GobEncode
+func (s *FileSource) GobDecode(b []byte) error {
+	*s = *NewFileSource(string(b))
+	return nil
+}
+
 // LastModified returns time when the target template file was last modified
 func (s *FileSource) LastModified() (time.Time, error) {
 	// Calling os.Stat() for *every* Render of the same source is a waste
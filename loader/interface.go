@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/xslate/compiler"
@@ -31,8 +32,9 @@ const (
 // CacheEntity contains all the othings required to perform calculations
 // necessary to validate a template
 type CacheEntity struct {
-	ByteCode *vm.ByteCode
-	Source   TemplateSource
+	ByteCode  *vm.ByteCode
+	Source    TemplateSource
+	Ancestors []TemplateSource // templates that Source cascades from
 }
 
 // Cache defines the interface for things that can cache generated ByteCode
@@ -43,13 +45,15 @@ type Cache interface {
 }
 
 // CachedByteCodeLoader is the default ByteCodeLoader that loads templates
-// from the file system and caches in the file system, too
+// from the file system and caches in the file system, too.
+// It is safe to call Load from multiple goroutines
 type CachedByteCodeLoader struct {
 	*StringByteCodeLoader // gives us LoadString
 	*ReaderByteCodeLoader // gives us LoadReader
 	Fetcher               TemplateFetcher
 	Caches                []Cache
 	CacheLevel            CacheStrategy
+	mutex                 sync.Mutex // protects Caches and the cached sources
 }
 
 // FileCache is Cache implementation that stores caches in the file system
@@ -103,6 +107,7 @@ type ReaderByteCodeLoader struct {
 	*Flags
 	Parser   parser.Parser
 	Compiler compiler.Compiler
+	Fetcher  TemplateFetcher // used to load templates for CASCADE
 }
 
 // Mask... set of constants are used as flags to denote Debug modes.
@@ -162,4 +167,5 @@ type StringByteCodeLoader struct {
 	*Flags
 	Parser   parser.Parser
 	Compiler compiler.Compiler
+	Fetcher  TemplateFetcher // used to load templates for CASCADE
 }
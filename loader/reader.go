@@ -12,14 +12,26 @@ import (
 
 // NewReaderByteCodeLoader creates a new object
 func NewReaderByteCodeLoader(p parser.Parser, c compiler.Compiler) *ReaderByteCodeLoader {
-	return &ReaderByteCodeLoader{NewFlags(), p, c}
+	return &ReaderByteCodeLoader{NewFlags(), p, c, nil}
 }
 
 // LoadReader takes a io.Reader and compiles it into vm.ByteCode
 func (l *ReaderByteCodeLoader) LoadReader(name string, rdr io.Reader) (*vm.ByteCode, error) {
+	bc, _, err := l.loadReader(name, rdr)
+	return bc, err
+}
+
+// loadReader is the same as LoadReader, but also returns the sources of
+// the templates that the template cascades from
+func (l *ReaderByteCodeLoader) loadReader(name string, rdr io.Reader) (*vm.ByteCode, []TemplateSource, error) {
 	ast, err := l.Parser.ParseReader(name, rdr)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	ancestors, err := resolveCascade(ast, l.Parser, l.Fetcher)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	if l.ShouldDumpAST() {
@@ -28,8 +40,8 @@ func (l *ReaderByteCodeLoader) LoadReader(name string, rdr io.Reader) (*vm.ByteC
 
 	bc, err := l.Compiler.Compile(ast)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return bc, nil
+	return bc, ancestors, nil
 }
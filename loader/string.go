@@ -10,7 +10,7 @@ import (
 
 // NewStringByteCodeLoader creates a new object
 func NewStringByteCodeLoader(p parser.Parser, c compiler.Compiler) *StringByteCodeLoader {
-	return &StringByteCodeLoader{NewFlags(), p, c}
+	return &StringByteCodeLoader{NewFlags(), p, c, nil}
 }
 
 // LoadString takes a template string and compiles it into vm.ByteCode
@@ -20,6 +20,10 @@ func (l *StringByteCodeLoader) LoadString(name string, template string) (*vm.Byt
 		return nil, err
 	}
 
+	if _, err := resolveCascade(ast, l.Parser, l.Fetcher); err != nil {
+		return nil, err
+	}
+
 	if l.ShouldDumpAST() {
 		fmt.Fprintf(os.Stderr, "AST:\n%s\n", ast)
 	}
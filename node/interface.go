@@ -56,6 +56,39 @@ const (
 	Group
 	Filter
 	Macro
+	Unless
+	Switch
+	Case
+	And
+	Or
+	DefinedOr
+	Not
+	LE
+	GE
+	Cmp
+	StrLT
+	StrGT
+	StrLE
+	StrGE
+	StrCmp
+	StrEquals
+	StrNotEquals
+	Mod
+	Concat
+	UnaryMinus
+	UnaryPlus
+	Ternary
+	MakeHash
+	Last
+	Next
+	NamedArgs
+	Import
+	Block
+	Process
+	Before
+	After
+	Around
+	Super
 	Max
 )
 
@@ -82,9 +115,8 @@ type TextNode struct {
 
 type WrapperNode struct {
 	*ListNode
-	WrapperName string
-	// XXX need to make this configurable. currently it's only "content"
-	// WrapInto string
+	WrapperNames    []string // templates to wrap the content with, outermost first
+	WrapInto        string   // name of the variable that receives the content
 	AssignmentNodes []Node
 }
 
@@ -115,6 +147,7 @@ type ForeachNode struct {
 
 type WhileNode struct {
 	*LoopNode
+	LoopVarIdx int
 }
 
 type MethodCallNode struct {
@@ -139,6 +172,7 @@ type FetchFieldNode struct {
 type IfNode struct {
 	*ListNode
 	BooleanExpression Node
+	ElseIf            bool // true if this node was created by ELSIF
 }
 
 type ElseNode struct {
@@ -146,6 +180,23 @@ type ElseNode struct {
 	IfNode Node
 }
 
+type SwitchNode struct {
+	*ListNode
+	Expression Node
+}
+
+type CaseNode struct {
+	*ListNode
+	Expression Node // nil for the default case
+}
+
+type TernaryNode struct {
+	BaseNode
+	Condition Node
+	True      Node
+	False     Node
+}
+
 type UnaryNode struct {
 	BaseNode
 	Child Node
@@ -159,7 +210,22 @@ type BinaryNode struct {
 
 type FilterNode struct {
 	*UnaryNode
+	Name     string
+	Args     *ListNode     // extra arguments, as in `x | truncate(30)`
+	LocalVar *LocalVarNode // set if the filter refers to a MACRO
+}
+
+// BlockNode is a named BLOCK, which is rendered by PROCESS or INCLUDE.
+// BEFORE, AFTER and AROUND, which modify the BLOCK of the same name in
+// a cascaded template, are BlockNodes as well
+type BlockNode struct {
+	*ListNode
 	Name string
+	// local variables declared at the top level of the block, mapped
+	// to their location in the block's framestack
+	LocalVars map[string]int
+	// name of the BLOCK that SUPER renders, set for AROUND
+	Super string
 }
 
 type MacroNode struct {
@@ -31,6 +31,17 @@ func NewNoopNode() *BaseNode {
 	return noop
 }
 
+// NewLastNode creates a node for LAST, which leaves the enclosing loop
+func NewLastNode(pos int) *BaseNode {
+	return &BaseNode{Last, pos}
+}
+
+// NewNextNode creates a node for NEXT, which skips to the next
+// iteration of the enclosing loop
+func NewNextNode(pos int) *BaseNode {
+	return &BaseNode{Next, pos}
+}
+
 func (l *ListNode) Visit(c chan Node) {
 	c <- l
 	for _, child := range l.Nodes {
@@ -77,10 +88,13 @@ func (n *TextNode) Visit(c chan Node) {
 	c <- n
 }
 
-func NewWrapperNode(pos int, template string) *WrapperNode {
+// NewWrapperNode creates a WRAPPER node. The content is wrapped with
+// each of the templates in turn, and the last one is the innermost
+func NewWrapperNode(pos int, templates ...string) *WrapperNode {
 	n := &WrapperNode{
 		NewListNode(pos),
-		template,
+		templates,
+		"content",
 		[]Node{},
 	}
 	n.NodeType = Wrapper
@@ -98,7 +112,8 @@ func (n *WrapperNode) Copy() Node {
 	}
 	return &WrapperNode{
 		n.ListNode.Copy().(*ListNode),
-		n.WrapperName,
+		n.WrapperNames,
+		n.WrapInto,
 		anodes,
 	}
 }
@@ -209,7 +224,8 @@ func NewWhileNode(pos int, n Node) *WhileNode {
 
 func (n *WhileNode) Copy() Node {
 	return &WhileNode{
-		LoopNode: n.LoopNode.Copy().(*LoopNode),
+		LoopNode:   n.LoopNode.Copy().(*LoopNode),
+		LoopVarIdx: n.LoopVarIdx,
 	}
 }
 
@@ -336,21 +352,31 @@ func NewIfNode(pos int, exp Node) *IfNode {
 	n := &IfNode{
 		NewListNode(pos),
 		exp,
+		false,
 	}
 	n.NodeType = If
 	return n
 }
 
+// NewUnlessNode creates an IfNode whose body is executed when the
+// expression is false
+func NewUnlessNode(pos int, exp Node) *IfNode {
+	n := NewIfNode(pos, exp)
+	n.NodeType = Unless
+	return n
+}
+
 func (n *IfNode) Copy() Node {
 	x := &IfNode{
 		n.ListNode.Copy().(*ListNode),
 		nil,
+		n.ElseIf,
 	}
 	if e := n.BooleanExpression; e != nil {
 		x.BooleanExpression = e.Copy()
 	}
 
-	x.ListNode = n.ListNode.Copy().(*ListNode)
+	x.NodeType = n.NodeType
 
 	return x
 }
@@ -372,6 +398,61 @@ func NewElseNode(pos int) *ElseNode {
 	return n
 }
 
+func NewSwitchNode(pos int, exp Node) *SwitchNode {
+	n := &SwitchNode{
+		NewListNode(pos),
+		exp,
+	}
+	n.NodeType = Switch
+	return n
+}
+
+func (n *SwitchNode) Copy() Node {
+	x := NewSwitchNode(n.pos, n.Expression.Copy())
+	x.ListNode = n.ListNode.Copy().(*ListNode)
+	x.NodeType = Switch
+	return x
+}
+
+func (n *SwitchNode) Visit(c chan Node) {
+	c <- n
+	c <- n.Expression
+	for _, child := range n.ListNode.Nodes {
+		c <- child
+	}
+}
+
+func NewCaseNode(pos int, exp Node) *CaseNode {
+	n := &CaseNode{
+		NewListNode(pos),
+		exp,
+	}
+	n.NodeType = Case
+	return n
+}
+
+func (n *CaseNode) Copy() Node {
+	x := &CaseNode{
+		n.ListNode.Copy().(*ListNode),
+		nil,
+	}
+	if e := n.Expression; e != nil {
+		x.Expression = e.Copy()
+	}
+	x.NodeType = Case
+	return x
+}
+
+func (n *CaseNode) Visit(c chan Node) {
+	c <- n
+	if n.Expression != nil {
+		c <- n.Expression
+	}
+	for _, child := range n.ListNode.Nodes {
+		c <- child
+	}
+}
+
 func NewRangeNode(pos int, start, end Node) *BinaryNode {
 	return &BinaryNode{
 		BaseNode{Range, pos},
@@ -392,6 +473,39 @@ func (n *UnaryNode) Copy() Node {
 	}
 }
 
+func NewMakeHashNode(pos int, child Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{MakeHash, pos},
+		child,
+	}
+}
+
+// NewNamedArgsNode creates a node for the named arguments in a function
+// call, as in `foo(bar => 1)`. `child` is a list of names and values
+func NewNamedArgsNode(pos int, child Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{NamedArgs, pos},
+		child,
+	}
+}
+
+// NewImportNode creates a node for IMPORT, which makes the macros
+// defined in `target` available to the current template
+func NewImportNode(pos int, target Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{Import, pos},
+		target,
+	}
+}
+
+// NewProcessNode creates a node for PROCESS, which is the same as
+// INCLUDE except that a BLOCK may change the caller's variables
+func NewProcessNode(pos int, include Node) *IncludeNode {
+	n := NewIncludeNode(pos, include)
+	n.NodeType = Process
+	return n
+}
+
 func NewMakeArrayNode(pos int, child Node) *UnaryNode {
 	return &UnaryNode{
 		BaseNode{MakeArray, pos},
@@ -403,6 +517,7 @@ type IncludeNode struct {
 	BaseNode
 	IncludeTarget   Node
 	AssignmentNodes []Node
+	LocalVars       []*LocalVarNode // passed on if the target is a BLOCK
 }
 
 func NewIncludeNode(pos int, include Node) *IncludeNode {
@@ -410,6 +525,7 @@ func NewIncludeNode(pos int, include Node) *IncludeNode {
 		BaseNode{Include, pos},
 		include,
 		[]Node{},
+		nil,
 	}
 }
 
@@ -423,7 +539,9 @@ func (n *IncludeNode) Copy() Node {
 
 func (n *IncludeNode) Visit(c chan Node) {
 	c <- n
-	c <- n.IncludeTarget
+	if n.IncludeTarget != nil {
+		c <- n.IncludeTarget
+	}
 }
 
 func NewPlusNode(pos int) *BinaryNode {
@@ -490,6 +608,136 @@ func NewGTNode(pos int) *BinaryNode {
 	}
 }
 
+func NewLENode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{LE, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewGENode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{GE, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewCmpNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{Cmp, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrLTNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrLT, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrGTNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrGT, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrLENode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrLE, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrGENode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrGE, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrCmpNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrCmp, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrEqualsNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrEquals, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewStrNotEqualsNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{StrNotEquals, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewModNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{Mod, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewConcatNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{Concat, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewUnaryMinusNode(pos int, child Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{UnaryMinus, pos},
+		child,
+	}
+}
+
+func NewUnaryPlusNode(pos int, child Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{UnaryPlus, pos},
+		child,
+	}
+}
+
+func NewTernaryNode(pos int, cond, t, f Node) *TernaryNode {
+	return &TernaryNode{
+		BaseNode{Ternary, pos},
+		cond,
+		t,
+		f,
+	}
+}
+
+func (n *TernaryNode) Copy() Node {
+	return NewTernaryNode(n.pos, n.Condition.Copy(), n.True.Copy(), n.False.Copy())
+}
+
+func (n *TernaryNode) Visit(c chan Node) {
+	c <- n
+	n.Condition.Visit(c)
+	n.True.Visit(c)
+	n.False.Visit(c)
+}
+
 func (n *BinaryNode) Copy() Node {
 	return &BinaryNode{
 		BaseNode{n.NodeType, n.pos},
@@ -504,6 +752,37 @@ func (n *BinaryNode) Visit(c chan Node) {
 	n.Right.Visit(c)
 }
 
+func NewAndNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{And, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewOrNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{Or, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewDefinedOrNode(pos int) *BinaryNode {
+	return &BinaryNode{
+		BaseNode{DefinedOr, pos},
+		nil,
+		nil,
+	}
+}
+
+func NewNotNode(pos int, child Node) *UnaryNode {
+	return &UnaryNode{
+		BaseNode{Not, pos},
+		child,
+	}
+}
+
 func NewGroupNode(pos int) *UnaryNode {
 	return &UnaryNode{
 		BaseNode{Group, pos},
@@ -518,22 +797,28 @@ func NewFilterNode(pos int, name string, child Node) *FilterNode {
 			child,
 		},
 		name,
+		nil,
+		nil,
 	}
 }
 
 func (n *FilterNode) Copy() Node {
-	return &FilterNode{
-		&UnaryNode{
-			BaseNode{Filter, n.pos},
-			n.Child.Copy(),
-		},
-		n.Name,
+	x := NewFilterNode(n.pos, n.Name, n.Child.Copy())
+	if n.Args != nil {
+		x.Args = n.Args.Copy().(*ListNode)
+	}
+	if n.LocalVar != nil {
+		x.LocalVar = n.LocalVar.Copy().(*LocalVarNode)
 	}
+	return x
 }
 
 func (n *FilterNode) Visit(c chan Node) {
 	c <- n
 	n.UnaryNode.Visit(c)
+	if n.Args != nil {
+		n.Args.Visit(c)
+	}
 }
 
 func NewFetchArrayElementNode(pos int) *BinaryNode {
@@ -544,6 +829,33 @@ func NewFetchArrayElementNode(pos int) *BinaryNode {
 	}
 }
 
+func NewBlockNode(pos int, name string) *BlockNode {
+	n := &BlockNode{
+		NewListNode(pos),
+		name,
+		nil,
+		"",
+	}
+	n.NodeType = Block
+	return n
+}
+
+// NewBlockModifierNode creates a BEFORE, AFTER or AROUND node, depending
+// on `typ`
+func NewBlockModifierNode(pos int, typ NodeType, name string) *BlockNode {
+	n := NewBlockNode(pos, name)
+	n.NodeType = typ
+	return n
+}
+
+// NewSuperNode creates a node for SUPER, which renders the BLOCK that
+// is being modified by AROUND
+func NewSuperNode(pos int) *IncludeNode {
+	n := NewIncludeNode(pos, nil)
+	n.NodeType = Super
+	return n
+}
+
 func NewMacroNode(pos int, name string) *MacroNode {
 	n := &MacroNode{
 		NewListNode(pos),
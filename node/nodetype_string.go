@@ -4,9 +4,9 @@ package node
 
 import "fmt"
 
-const _NodeType_name = "NoopRootTextNumberIntFloatIfElseListForeachWhileWrapperIncludeAssignmentLocalVarFetchFieldFetchArrayElementMethodCallFunCallPrintPrintRawFetchSymbolRangePlusMinusMulDivEqualsNotEqualsLTGTMakeArrayGroupFilterMacroMax"
+const _NodeType_name = "NoopRootTextNumberIntFloatIfElseListForeachWhileWrapperIncludeAssignmentLocalVarFetchFieldFetchArrayElementMethodCallFunCallPrintPrintRawFetchSymbolRangePlusMinusMulDivEqualsNotEqualsLTGTMakeArrayGroupFilterMacroUnlessSwitchCaseAndOrDefinedOrNotLEGECmpStrLTStrGTStrLEStrGEStrCmpStrEqualsStrNotEqualsModConcatUnaryMinusUnaryPlusTernaryMakeHashLastNextNamedArgsImportBlockProcessBeforeAfterAroundSuperMax"
 
-var _NodeType_index = [...]uint8{0, 4, 8, 12, 18, 21, 26, 28, 32, 36, 43, 48, 55, 62, 72, 80, 90, 107, 117, 124, 129, 137, 148, 153, 157, 162, 165, 168, 174, 183, 185, 187, 196, 201, 207, 212, 215}
+var _NodeType_index = [...]uint16{0, 4, 8, 12, 18, 21, 26, 28, 32, 36, 43, 48, 55, 62, 72, 80, 90, 107, 117, 124, 129, 137, 148, 153, 157, 162, 165, 168, 174, 183, 185, 187, 196, 201, 207, 212, 218, 224, 228, 231, 233, 242, 245, 247, 249, 252, 257, 262, 267, 272, 278, 287, 299, 302, 308, 318, 327, 334, 342, 346, 350, 359, 365, 370, 377, 383, 388, 394, 399, 402}
 
 func (i NodeType) String() string {
 	if i < 0 || i >= NodeType(len(_NodeType_index)-1) {
@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 
+	"github.com/lestrrat-go/xslate/internal/position"
 	"github.com/lestrrat-go/xslate/internal/rbpool"
 	"github.com/lestrrat-go/xslate/node"
 )
@@ -31,3 +32,13 @@ func (ast *AST) String() string {
 	}
 	return buf.String()
 }
+
+// Error returns the textual representation of the error, which looks
+// like "index.tx:42:7: message", followed by the snippet
+func (e *ParseError) Error() string {
+	msg := position.Format(e.Name, e.Line, e.Column, e.Message)
+	if e.Snippet != "" {
+		msg += "\n" + e.Snippet
+	}
+	return msg
+}
@@ -1,18 +1,20 @@
 package parser
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/lestrrat-go/lex"
 	"github.com/lestrrat-go/xslate/internal/frame"
+	"github.com/lestrrat-go/xslate/internal/position"
 	"github.com/lestrrat-go/xslate/internal/stack"
 	"github.com/lestrrat-go/xslate/node"
-	"github.com/pkg/errors"
 )
 
-func NewFrame(s stack.Stack) *Frame {
+func NewFrame(s *stack.Stack) *Frame {
 	f := &Frame{
 		frame.New(s),
 		nil,
@@ -25,29 +27,43 @@ type builderCtx struct {
 	ParseName       string
 	Text            string
 	Line            int
+	Pos             int
 	Lexer           lex.Lexer
 	Root            *node.ListNode
 	PeekCount       int
 	Tokens          [3]lex.LexItem
 	CurrentStackTop int
-	PostChomp       bool
+	PostChomp       ChompMode // how to chomp the raw text after the last tag
 	FrameStack      stack.Stack
 	Frames          stack.Stack
 	Error           error
+
+	// BLOCKs defined so far, and the framestacks that were in use
+	// outside of the BLOCKs currently being parsed
+	Blocks      map[string]*node.BlockNode
+	OuterStacks []stack.Stack
+
+	Modifiers []*node.BlockNode
+	Cascade   string
 }
 
 func NewBuilder() *Builder {
 	return &Builder{}
 }
 
-func (b *Builder) Parse(name string, l lex.Lexer) (ast *AST, err error) {
+// Parse builds the AST from the tokens emitted by `l`. `text` should be
+// the template source that `l` is lexing, which is used to report
+// the location of errors
+func (b *Builder) Parse(name, text string, l lex.Lexer) (ast *AST, err error) {
 	ctx := &builderCtx{
 		ParseName:  name,
+		Text:       text,
 		Lexer:      l,
 		Root:       node.NewRootNode(),
 		Tokens:     [3]lex.LexItem{},
 		FrameStack: stack.New(5),
 		Frames:     stack.New(5),
+		Blocks:     make(map[string]*node.BlockNode),
 	}
 
 	defer func() {
@@ -62,8 +78,12 @@ func (b *Builder) Parse(name string, l lex.Lexer) (ast *AST, err error) {
 	b.Start(ctx)
 	b.ParseStatements(ctx)
 	return &AST{
-		Name: name,
-		Root: ctx.Root,
+		Name:      name,
+		Root:      ctx.Root,
+		Text:      text,
+		Blocks:    ctx.Blocks,
+		Modifiers: ctx.Modifiers,
+		Cascade:   ctx.Cascade,
 	}, nil
 }
 
@@ -102,7 +122,9 @@ func (b *Builder) Next(ctx *builderCtx) lex.LexItem {
 	} else {
 		ctx.Tokens[0] = ctx.Lexer.NextItem()
 	}
-	return ctx.Tokens[ctx.PeekCount]
+	token := ctx.Tokens[ctx.PeekCount]
+	ctx.Pos = token.Pos()
+	return token
 }
 
 func (b *Builder) NextNonSpace(ctx *builderCtx) lex.LexItem {
@@ -127,12 +149,56 @@ func (ctx *builderCtx) HasLocalVar(symbol string) (pos int, ok bool) {
 		f, _ := ctx.Frames.Get(i)
 		pos, ok = f.(*Frame).LvarNames[symbol]
 		if ok {
+			if pos < 0 {
+				// shadowed by a template variable
+				return 0, false
+			}
 			return
 		}
+		if isBlockFrame(f.(*Frame)) {
+			// Local variables outside of a BLOCK are not visible
+			break
+		}
 	}
 	return 0, false
 }
 
+func isBlockFrame(f *Frame) bool {
+	if f.Node == nil {
+		return false
+	}
+	switch f.Node.Type() {
+	case node.Block, node.Before, node.After, node.Around:
+		return true
+	}
+	return false
+}
+
+// VisibleLocalVars returns the local variables that can be seen from
+// the current scope, sorted by name
+func (ctx *builderCtx) VisibleLocalVars() []*node.LocalVarNode {
+	seen := make(map[string]struct{})
+	list := []*node.LocalVarNode{}
+	for i := ctx.Frames.Size() - 1; i >= 0; i-- {
+		x, _ := ctx.Frames.Get(i)
+		f := x.(*Frame)
+		for name, pos := range f.LvarNames {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			if pos >= 0 {
+				list = append(list, node.NewLocalVarNode(ctx.Pos, name, pos))
+			}
+		}
+		if isBlockFrame(f) {
+			break
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
 func (ctx *builderCtx) DeclareLocalVar(symbol string) int {
 	f := ctx.CurrentFrame()
 	i := f.DeclareVar(symbol)
@@ -141,9 +207,9 @@ func (ctx *builderCtx) DeclareLocalVar(symbol string) int {
 }
 
 func (ctx *builderCtx) PushFrame() *Frame {
-	f := NewFrame(ctx.FrameStack)
+	f := NewFrame(&ctx.FrameStack)
 	ctx.Frames.Push(f)
-	f.SetMark(ctx.Frames.Size())
+	f.SetMark(ctx.FrameStack.Size())
 	return f
 }
 
@@ -154,7 +220,7 @@ func (ctx *builderCtx) PopFrame() *Frame {
 	}
 
 	f := x.(*Frame)
-	for i := ctx.FrameStack.Size() - 1; i > f.Mark(); i-- {
+	for ctx.FrameStack.Size() > f.Mark() {
 		ctx.FrameStack.Pop()
 	}
 	return f
@@ -197,6 +263,13 @@ func (b *Builder) ParseStatements(ctx *builderCtx) node.Node {
 			ctx.CurrentParentNode().Append(n)
 		}
 	}
+
+	if parent := ctx.CurrentParentNode(); parent != ctx.Root {
+		b.raise(ctx, fmt.Sprintf("Unexpected end of template: %s is not closed", parent.Type()))
+	}
+	if b.Whitespace.Trim {
+		trimText(ctx.Root)
+	}
 	return nil
 }
 
@@ -208,33 +281,30 @@ func (b *Builder) ParseTemplateOrText(ctx *builderCtx) node.Node {
 	case ItemTagStart:
 		return b.ParseTemplate(ctx)
 	default:
-		panic(fmt.Sprintf("Unexpected token: %s", token))
+		b.Unexpected(ctx, "%s", token)
 	}
+	return nil
 }
 
 func (b *Builder) ParseRawString(ctx *builderCtx) node.Node {
-	const whiteSpace = " \t\r\n"
 	token := b.NextNonSpace(ctx)
 	if token.Type() != ItemRawString {
 		b.Unexpected(ctx, "Expected raw string, got %s", token)
 	}
 
-	value := token.Value()
-
-	if ctx.PostChomp {
-		value = strings.TrimLeft(value, whiteSpace)
-		ctx.PostChomp = false
-	}
+	value := chompLeft(token.Value(), ctx.PostChomp)
+	ctx.PostChomp = ChompNone
 
 	// Look for signs of pre-chomp
 	if b.PeekNonSpace(ctx).Type() == ItemTagStart {
 		start := b.NextNonSpace(ctx)
 		next := b.PeekNonSpace(ctx)
 		b.Backup2(ctx, start)
-		if next.Type() == ItemMinus {
-			// prechomp!
-			value = strings.TrimRight(value, whiteSpace)
+		mode, ok := chompMarker(start, next)
+		if !ok && !ctx.isLineCode(start) {
+			mode = b.Whitespace.PreChomp
 		}
+		value = chompRight(value, mode)
 	}
 
 	n := node.NewPrintRawNode(token.Pos())
@@ -243,15 +313,26 @@ func (b *Builder) ParseRawString(ctx *builderCtx) node.Node {
 	return n
 }
 
+// Unexpected records a *ParseError pointing at the last token read, and
+// aborts parsing
 func (b *Builder) Unexpected(ctx *builderCtx, format string, args ...interface{}) {
-	msg := fmt.Sprintf(
-		"Unexpected token found: %s in %s at line %d",
-		fmt.Sprintf(format, args...),
-		ctx.ParseName,
-		ctx.Line,
-	)
-	ctx.Error = errors.New(msg)
-	panic(msg)
+	b.raise(ctx, "Unexpected token found: "+fmt.Sprintf(format, args...))
+}
+
+// raise aborts parsing with a ParseError reported at the current
+// position
+func (b *Builder) raise(ctx *builderCtx, message string) {
+	perr := &ParseError{
+		Name:    ctx.ParseName,
+		Line:    ctx.Line,
+		Message: message,
+	}
+	if ctx.Text != "" {
+		perr.Line, perr.Column = position.Lookup(ctx.Text, ctx.Pos)
+		perr.Snippet = position.Snippet(ctx.Text, perr.Line, perr.Column)
+	}
+	ctx.Error = perr
+	panic(perr.Error())
 }
 
 func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
@@ -260,16 +341,80 @@ func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 	if start.Type() != ItemTagStart {
 		b.Unexpected(ctx, "Expected TagStart, got %s", start)
 	}
-	ctx.PostChomp = false
+	ctx.PostChomp = ChompNone
 
-	if b.PeekNonSpace(ctx).Type() == ItemMinus {
+	if _, ok := chompMarker(start, b.PeekNonSpace(ctx)); ok {
 		b.NextNonSpace(ctx)
 	}
 
+	// Several statements may be written in one tag, separated by ';'.
+	// The separator may be omitted after a statement that opens or
+	// closes a block, and before a '}'. All but the last statement are
+	// appended to the tree here
 	var tmpl node.Node
-	switch b.PeekNonSpace(ctx).Type() {
-	case ItemEnd:
+	for more := true; more; {
+		for b.PeekNonSpace(ctx).Type() == ItemComment {
+			b.NextNonSpace(ctx)
+		}
+		if b.atTagEnd(ctx) {
+			break
+		}
+
+		parent := ctx.CurrentParentNode()
+		tmpl = b.ParseStatement(ctx)
+
+		for b.PeekNonSpace(ctx).Type() == ItemComment {
+			b.NextNonSpace(ctx)
+		}
+		switch {
+		case b.PeekNonSpace(ctx).Type() == ItemSemicolon:
+			b.NextNonSpace(ctx)
+		case b.PeekNonSpace(ctx).Type() == ItemCloseCurlyBracket, parent != ctx.CurrentParentNode():
+		default:
+			// Whatever comes next must be the end of the tag
+			more = false
+		}
+		if more && tmpl != nil {
+			ctx.CurrentParentNode().Append(tmpl)
+			tmpl = nil
+		}
+	}
+
+	for b.PeekNonSpace(ctx).Type() == ItemComment {
+		b.NextNonSpace(ctx)
+	}
+
+	// Lines of code already end with the newline, so the global mode
+	// doesn't apply to them
+	postChomp := b.Whitespace.PostChomp
+	if ctx.isLineCode(start) {
+		postChomp = ChompNone
+	}
+	if mode, ok := chompMarkers[b.PeekNonSpace(ctx).Type()]; ok {
 		b.NextNonSpace(ctx)
+		postChomp = mode
+	}
+
+	// Consume tag end
+	end := b.NextNonSpace(ctx)
+	if end.Type() != ItemTagEnd {
+		b.Unexpected(ctx, "Expected TagEnd, got %s", end)
+	}
+	ctx.PostChomp = postChomp
+	return tmpl
+}
+
+// ParseStatement parses a single statement within a tag
+func (b *Builder) ParseStatement(ctx *builderCtx) node.Node {
+	var tmpl node.Node
+	switch b.PeekNonSpace(ctx).Type() {
+	case ItemEnd, ItemCloseCurlyBracket:
+		end := b.NextNonSpace(ctx)
+		if end.Type() == ItemCloseCurlyBracket && b.PeekNonSpace(ctx).Type() == ItemElse {
+			// `} else {` in Kolon goes on with the same IF
+			tmpl = b.ParseElse(ctx)
+			break
+		}
 		for keepPopping := true; keepPopping; {
 			parent := ctx.PopParentNode()
 			switch parent.Type() {
@@ -277,6 +422,27 @@ func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 				b.Unexpected(ctx, "Unexpected END")
 			case node.Else:
 				// no op
+			case node.Case:
+				// In Kolon, each `when` has its own closing brace
+				keepPopping = end.Type() == ItemEnd
+			case node.Block, node.Before, node.After, node.Around:
+				// Back to the local variables outside of the BLOCK
+				last := len(ctx.OuterStacks) - 1
+				ctx.FrameStack = ctx.OuterStacks[last]
+				ctx.OuterStacks = ctx.OuterStacks[:last]
+				if b.Whitespace.Trim {
+					trimText(parent.(*node.BlockNode).ListNode)
+				}
+				keepPopping = false
+			case node.Macro:
+				if b.Whitespace.Trim {
+					trimText(parent.(*node.MacroNode).ListNode)
+				}
+				keepPopping = false
+			case node.If:
+				// ELSIF creates an IF nested in an ELSE. Keep popping
+				// until we get to the IF that started the chain
+				keepPopping = parent.(*node.IfNode).ElseIf
 			default:
 				keepPopping = false
 			}
@@ -298,36 +464,98 @@ func (b *Builder) ParseTemplate(ctx *builderCtx) node.Node {
 		tmpl = b.ParseForeach(ctx)
 	case ItemWhile:
 		tmpl = b.ParseWhile(ctx)
-	case ItemInclude:
+	case ItemInclude, ItemProcess:
 		tmpl = b.ParseInclude(ctx)
-	case ItemTagEnd: // Silly, but possible
-		b.NextNonSpace(ctx)
-		tmpl = node.NewNoopNode()
-	case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString, ItemOpenParen:
+	case ItemBlock:
+		tmpl = b.ParseBlock(ctx)
+	case ItemBefore, ItemAfter, ItemAround:
+		tmpl = b.ParseBlockModifier(ctx)
+	case ItemSuper:
+		tmpl = b.ParseSuper(ctx)
+	case ItemCascade:
+		tmpl = b.ParseCascade(ctx)
+	case ItemImport:
+		tmpl = b.ParseImport(ctx)
+	case ItemIncr, ItemDecr:
+		tmpl = b.ParseIncrDecr(ctx)
+	case ItemLast, ItemNext:
+		tmpl = b.ParseLoopControl(ctx)
+	case ItemMy:
+		tmpl = b.ParseMy(ctx)
+	case ItemPrint, ItemPrintRaw:
+		tmpl = b.ParsePrint(ctx)
+	case ItemIdentifier, ItemVariable, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString,
+		ItemOpenParen, ItemOpenSquareBracket, ItemOpenCurlyBracket, ItemMinus, ItemPlus, ItemNot, ItemLowNot:
 		tmpl = b.ParseExpressionOrAssignment(ctx, true)
-	case ItemIf:
+	case ItemIf, ItemUnless:
 		tmpl = b.ParseIf(ctx)
+	case ItemElseIf:
+		tmpl = b.ParseElseIf(ctx)
 	case ItemElse:
 		tmpl = b.ParseElse(ctx)
+	case ItemSwitch:
+		tmpl = b.ParseSwitch(ctx)
+	case ItemCase, ItemDefault:
+		tmpl = b.ParseCase(ctx)
 	default:
 		b.Unexpected(ctx, "%s", b.PeekNonSpace(ctx))
 	}
 
-	for b.PeekNonSpace(ctx).Type() == ItemComment {
-		b.NextNonSpace(ctx)
+	return tmpl
+}
+
+// atTagEnd returns true if the next token ends the tag, either with or
+// without a chomp marker
+func (b *Builder) atTagEnd(ctx *builderCtx) bool {
+	t := b.PeekNonSpace(ctx).Type()
+	if t == ItemTagEnd {
+		return true
+	}
+	if _, ok := chompMarkers[t]; !ok {
+		return false
 	}
+	cur := b.NextNonSpace(ctx)
+	next := b.PeekNonSpace(ctx)
+	b.Backup2(ctx, cur)
+	return next.Type() == ItemTagEnd
+}
 
-	if b.PeekNonSpace(ctx).Type() == ItemMinus {
-		b.NextNonSpace(ctx)
-		ctx.PostChomp = true
+// chompMarkers are the markers that can be placed right inside of a tag
+// to chomp the whitespace on that side, as in "[%- ... ~%]". '+' keeps
+// the whitespace regardless of the global modes
+var chompMarkers = map[lex.ItemType]ChompMode{
+	ItemMinus: ChompGreedy,
+	ItemTilde: ChompCollapse,
+	ItemPlus:  ChompNone,
+}
+
+// chompMarker returns the chomp mode of next, if it is a marker placed
+// right after the tag start, as in "[%-". A '-' separated by spaces is
+// a unary minus
+func chompMarker(start, next lex.LexItem) (ChompMode, bool) {
+	mode, ok := chompMarkers[next.Type()]
+	if !ok || next.Pos() != start.Pos()+len(start.Value()) {
+		return ChompNone, false
 	}
+	return mode, true
+}
 
-	// Consume tag end
-	end := b.NextNonSpace(ctx)
-	if end.Type() != ItemTagEnd {
-		b.Unexpected(ctx, "Expected TagEnd, got %s", end)
+// isLineCode returns true if start begins a line of code rather than
+// a tag
+func (ctx *builderCtx) isLineCode(start lex.LexItem) bool {
+	l, ok := ctx.Lexer.(*Lexer)
+	return ok && l.lineStart != "" && l.lineStart != l.tagStart && start.Value() == l.lineStart
+}
+
+// isFieldName returns true if t can be used as a field or method name.
+// Keywords are allowed, so that things like `loop.next` work even
+// when `next` is a keyword
+func isFieldName(t lex.LexItem) bool {
+	if t.Type() == ItemIdentifier {
+		return true
 	}
-	return tmpl
+	v := t.Value()
+	return t.Type() > ItemKeyword && v != "" && isAlphaNumeric(rune(v[0]))
 }
 
 func (b *Builder) ParseExpressionOrAssignment(ctx *builderCtx, canPrint bool) node.Node {
@@ -338,11 +566,13 @@ func (b *Builder) ParseExpressionOrAssignment(ctx *builderCtx, canPrint bool) no
 	b.Backup2(ctx, next)
 
 	var n node.Node
-	if next.Type() == ItemIdentifier {
+	if isVariable(next) {
 		switch following.Type() {
-		case ItemAssign, ItemAssignAdd, ItemAssignSub, ItemAssignMul, ItemAssignDiv:
+		case ItemAssign, ItemAssignAdd, ItemAssignSub, ItemAssignMul, ItemAssignDiv, ItemAssignMod:
 			// This is a simple assignment!
 			n = b.ParseAssignment(ctx)
+		case ItemIncr, ItemDecr:
+			n = b.ParseIncrDecr(ctx)
 		default:
 			n = b.ParseExpression(ctx, canPrint)
 		}
@@ -359,20 +589,37 @@ func (b *Builder) ParseWrapper(ctx *builderCtx) node.Node {
 		panic("fuck")
 	}
 
-	tmpl := b.NextNonSpace(ctx)
-	var template string
-	switch tmpl.Type() {
-	case ItemDoubleQuotedString, ItemSingleQuotedString:
-		template = tmpl.Value()
-		template = template[1 : len(template)-1]
-	default:
-		b.Unexpected(ctx, "Expected identifier, got %s", tmpl)
+	// Either a single template name, or a list of them
+	var templates []string
+	if b.PeekNonSpace(ctx).Type() == ItemOpenSquareBracket {
+		b.NextNonSpace(ctx)
+		for {
+			templates = append(templates, b.ParseWrapperName(ctx))
+			if b.PeekNonSpace(ctx).Type() != ItemComma {
+				break
+			}
+			b.NextNonSpace(ctx)
+		}
+		if closeB := b.NextNonSpace(ctx); closeB.Type() != ItemCloseSquareBracket {
+			b.Unexpected(ctx, "Expected ']', got %s", closeB)
+		}
+	} else {
+		templates = append(templates, b.ParseWrapperName(ctx))
 	}
 
-	n := node.NewWrapperNode(wrapper.Pos(), template)
+	n := node.NewWrapperNode(wrapper.Pos(), templates...)
 	ctx.CurrentParentNode().Append(n)
 	ctx.PushParentNode(n)
 
+	if b.PeekNonSpace(ctx).Type() == ItemInto {
+		b.NextNonSpace(ctx)
+		into := b.NextNonSpace(ctx)
+		if into.Type() != ItemIdentifier {
+			b.Unexpected(ctx, "Expected identifier, got %s", into)
+		}
+		n.WrapInto = into.Value()
+	}
+
 	ctx.PushFrame()
 
 	// If we have parameters, we have WITH. otherwise we want TagEnd
@@ -385,17 +632,8 @@ LOOP:
 	for {
 		a := b.ParseAssignment(ctx)
 		n.AppendAssignment(a)
-		next := b.PeekNonSpace(ctx)
-		switch next.Type() {
-		case ItemComma, ItemTagEnd:
+		if b.atTagEnd(ctx) {
 			break LOOP
-		case ItemMinus:
-			cur := b.NextNonSpace(ctx)
-			next := b.PeekNonSpace(ctx)
-			b.Backup2(ctx, cur)
-			if next.Type() == ItemTagEnd {
-				break LOOP
-			}
 		}
 		b.NextNonSpace(ctx)
 	}
@@ -404,64 +642,212 @@ LOOP:
 	return nil
 }
 
+// ParseMy parses `my $x = ...` in Kolon, which declares a new local
+// variable, even if one of the same name is visible from outer scopes
+func (b *Builder) ParseMy(ctx *builderCtx) node.Node {
+	my := b.NextNonSpace(ctx)
+	if my.Type() != ItemMy {
+		b.Unexpected(ctx, "Expected my, got %s", my)
+	}
+
+	symbol := b.NextNonSpace(ctx)
+	if symbol.Type() != ItemVariable {
+		b.Unexpected(ctx, "Expected variable, got %s", symbol)
+	}
+	if eq := b.NextNonSpace(ctx); eq.Type() != ItemAssign {
+		b.Unexpected(ctx, "Expected '=', got %s", eq)
+	}
+
+	// As with other assignments, the expression can't see the new variable
+	expr := b.ParseExpression(ctx, false)
+	n := node.NewAssignmentNode(symbol.Pos(), symbolName(symbol))
+	n.Assignee.Offset = ctx.DeclareLocalVar(symbolName(symbol))
+	n.Expression = expr
+	return n
+}
+
+// ParsePrint parses `print` and `print_raw` in Kolon. Each of the comma
+// separated expressions is printed, and only print escapes them
+func (b *Builder) ParsePrint(ctx *builderCtx) node.Node {
+	token := b.NextNonSpace(ctx)
+	if token.Type() != ItemPrint && token.Type() != ItemPrintRaw {
+		b.Unexpected(ctx, "Expected print, got %s", token)
+	}
+
+	// All but the last expression are appended to the tree here, just
+	// like statements separated by ';'
+	var n node.Node
+	for {
+		if n != nil {
+			ctx.CurrentParentNode().Append(n)
+		}
+
+		expr := b.ParseExpression(ctx, false)
+		if token.Type() == ItemPrintRaw {
+			raw := node.NewPrintRawNode(expr.Pos())
+			raw.Append(expr)
+			n = raw
+		} else {
+			n = node.NewPrintNode(expr.Pos(), expr)
+		}
+
+		if b.PeekNonSpace(ctx).Type() != ItemComma {
+			return n
+		}
+		b.NextNonSpace(ctx)
+	}
+}
+
+// ParseOpenBrace consumes the `{` that starts the body of a statement
+// in Kolon, if any
+func (b *Builder) ParseOpenBrace(ctx *builderCtx) {
+	if b.PeekNonSpace(ctx).Type() == ItemOpenCurlyBracket {
+		b.NextNonSpace(ctx)
+	}
+}
+
+// ParseWrapperName parses the quoted name of a template for WRAPPER
+func (b *Builder) ParseWrapperName(ctx *builderCtx) string {
+	tmpl := b.NextNonSpace(ctx)
+	switch tmpl.Type() {
+	case ItemDoubleQuotedString, ItemSingleQuotedString:
+		v := tmpl.Value()
+		return v[1 : len(v)-1]
+	default:
+		b.Unexpected(ctx, "Expected template name, got %s", tmpl)
+	}
+	return ""
+}
+
 func (b *Builder) ParseAssignment(ctx *builderCtx) node.Node {
 	symbol := b.NextNonSpace(ctx)
-	if symbol.Type() != ItemIdentifier {
+	if !isVariable(symbol) {
 		b.Unexpected(ctx, "Expected identifier, got %s", symbol)
 	}
 
-	b.DeclareLocalVarIfNew(ctx, symbol)
-	n := node.NewAssignmentNode(symbol.Pos(), symbol.Value())
+	// The current value must be looked up before the variable is
+	// declared, so that `x += 1` and `x = x + 1` on a template
+	// variable start from the template variable
+	current := b.LocalVarOrFetchSymbol(ctx, symbol)
 
+	var op *node.BinaryNode
 	eq := b.NextNonSpace(ctx)
 	switch eq.Type() {
 	case ItemAssign:
-		n.Expression = b.ParseExpression(ctx, false)
 	case ItemAssignAdd:
-		add := node.NewPlusNode(symbol.Pos())
-		add.Left = b.LocalVarOrFetchSymbol(ctx, symbol)
-		add.Right = b.ParseExpression(ctx, false)
-		n.Expression = add
+		op = node.NewPlusNode(symbol.Pos())
 	case ItemAssignSub:
-		sub := node.NewMinusNode(symbol.Pos())
-		sub.Left = b.LocalVarOrFetchSymbol(ctx, symbol)
-		sub.Right = b.ParseExpression(ctx, false)
-		n.Expression = sub
+		op = node.NewMinusNode(symbol.Pos())
 	case ItemAssignMul:
-		mul := node.NewMulNode(symbol.Pos())
-		mul.Left = b.LocalVarOrFetchSymbol(ctx, symbol)
-		mul.Right = b.ParseExpression(ctx, false)
-		n.Expression = mul
+		op = node.NewMulNode(symbol.Pos())
 	case ItemAssignDiv:
-		div := node.NewDivNode(symbol.Pos())
-		div.Left = b.LocalVarOrFetchSymbol(ctx, symbol)
-		div.Right = b.ParseExpression(ctx, false)
-		n.Expression = div
+		op = node.NewDivNode(symbol.Pos())
+	case ItemAssignMod:
+		op = node.NewModNode(symbol.Pos())
 	default:
 		b.Unexpected(ctx, "Expected assign, got %s", eq)
 	}
 
+	var expr node.Node
+	if op == nil {
+		expr = b.ParseExpression(ctx, false)
+	} else {
+		op.Left = current
+		op.Right = b.ParseExpression(ctx, false)
+		expr = op
+	}
+
+	n := b.NewAssignment(ctx, symbol)
+	n.Expression = expr
+	return n
+}
+
+// ParseIncrDecr parses `x++`, `x--`, `++x` and `--x`. These are
+// statements that are equivalent to `x += 1` and `x -= 1`
+func (b *Builder) ParseIncrDecr(ctx *builderCtx) node.Node {
+	symbol := b.NextNonSpace(ctx)
+	var op lex.LexItem
+	if t := symbol.Type(); t == ItemIncr || t == ItemDecr {
+		op, symbol = symbol, b.NextNonSpace(ctx)
+	} else {
+		op = b.NextNonSpace(ctx)
+	}
+
+	if !isVariable(symbol) {
+		b.Unexpected(ctx, "Expected identifier, got %s", symbol)
+	}
+
+	var expr *node.BinaryNode
+	switch op.Type() {
+	case ItemIncr:
+		expr = node.NewPlusNode(op.Pos())
+	case ItemDecr:
+		expr = node.NewMinusNode(op.Pos())
+	default:
+		b.Unexpected(ctx, "Expected '++' or '--', got %s", op)
+	}
+	expr.Left = b.LocalVarOrFetchSymbol(ctx, symbol)
+	expr.Right = node.NewIntNode(op.Pos(), 1)
+
+	n := b.NewAssignment(ctx, symbol)
+	n.Expression = expr
+	return n
+}
+
+// NewAssignment declares `symbol` as a local variable if it hasn't
+// been declared yet, and creates an AssignmentNode that stores into it
+func (b *Builder) NewAssignment(ctx *builderCtx, symbol lex.LexItem) *node.AssignmentNode {
+	return newAssignment(ctx, symbol.Pos(), symbolName(symbol))
+}
+
+func newAssignment(ctx *builderCtx, pos int, name string) *node.AssignmentNode {
+	idx, ok := ctx.HasLocalVar(name)
+	if !ok {
+		idx = ctx.DeclareLocalVar(name)
+	}
+
+	n := node.NewAssignmentNode(pos, name)
+	n.Assignee.Offset = idx
 	return n
 }
 
 func (b *Builder) DeclareLocalVarIfNew(ctx *builderCtx, symbol lex.LexItem) {
-	_, ok := ctx.HasLocalVar(symbol.Value())
+	_, ok := ctx.HasLocalVar(symbolName(symbol))
 	if !ok {
-		ctx.DeclareLocalVar(symbol.Value())
+		ctx.DeclareLocalVar(symbolName(symbol))
 	}
 }
 
 func (b *Builder) LocalVarOrFetchSymbol(ctx *builderCtx, token lex.LexItem) node.Node {
-	if idx, ok := ctx.HasLocalVar(token.Value()); ok {
-		return node.NewLocalVarNode(token.Pos(), token.Value(), idx)
+	return localVarOrFetchSymbol(ctx, token.Pos(), symbolName(token))
+}
+
+// symbolName returns the name of the variable that `t` refers to. The
+// sigil of Kolon variables is not part of the name, so `$foo` in Kolon
+// is the same variable as `foo` in TTerse
+func symbolName(t lex.LexItem) string {
+	if t.Type() == ItemVariable {
+		return t.Value()[1:]
+	}
+	return t.Value()
+}
+
+// isVariable returns true if `t` names a variable
+func isVariable(t lex.LexItem) bool {
+	return t.Type() == ItemIdentifier || t.Type() == ItemVariable
+}
+
+func localVarOrFetchSymbol(ctx *builderCtx, pos int, name string) node.Node {
+	if idx, ok := ctx.HasLocalVar(name); ok {
+		return node.NewLocalVarNode(pos, name, idx)
 	}
-	return node.NewFetchSymbolNode(token.Pos(), token.Value())
+	return node.NewFetchSymbolNode(pos, name)
 }
 
 func (b *Builder) ParseTerm(ctx *builderCtx) node.Node {
 	token := b.NextNonSpace(ctx)
 	switch token.Type() {
-	case ItemIdentifier:
+	case ItemIdentifier, ItemVariable:
 		return b.LocalVarOrFetchSymbol(ctx, token)
 	case ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString:
 		b.Backup(ctx)
@@ -478,19 +864,60 @@ func (b *Builder) ParseFunCall(ctx *builderCtx, invocant node.Node) node.Node {
 		b.Unexpected(ctx, "Expected '(', got %s", next.Type())
 	}
 
-	args := b.ParseList(ctx)
+	args := b.ParseArgs(ctx)
 	closeParen := b.NextNonSpace(ctx)
 	if closeParen.Type() != ItemCloseParen {
 		b.Unexpected(ctx, "Expected ')', got %s", closeParen.Type())
 	}
 
-	return node.NewFunCallNode(invocant.Pos(), invocant, args.(*node.ListNode))
+	return node.NewFunCallNode(invocant.Pos(), invocant, args)
+}
+
+// ParseArgs parses the arguments to a function, method or filter, up
+// to (but not including) the closing paren. Named arguments, as in
+// `foo(1, bar => 2)`, must come after positional arguments, and are
+// passed as a single node.NamedArgs node at the end of the list
+func (b *Builder) ParseArgs(ctx *builderCtx) *node.ListNode {
+	n := node.NewListNode(b.PeekNonSpace(ctx).Pos())
+	var named *node.ListNode
+	seen := map[string]struct{}{}
+	for b.PeekNonSpace(ctx).Type() != ItemCloseParen {
+		name := b.NextNonSpace(ctx)
+		following := b.PeekNonSpace(ctx)
+		b.Backup2(ctx, name)
+
+		if name.Type() == ItemIdentifier && following.Type() == ItemFatComma {
+			b.NextNonSpace(ctx) // name
+			b.NextNonSpace(ctx) // =>
+			if _, ok := seen[name.Value()]; ok {
+				b.Unexpected(ctx, "parameter '%s' given twice", name.Value())
+			}
+			seen[name.Value()] = struct{}{}
+			if named == nil {
+				named = node.NewListNode(name.Pos())
+				n.Append(node.NewNamedArgsNode(name.Pos(), named))
+			}
+			named.Append(node.NewTextNode(name.Pos(), name.Value()))
+			named.Append(b.ParseExpression(ctx, false))
+		} else {
+			if named != nil {
+				b.Unexpected(ctx, "positional argument after named arguments")
+			}
+			n.Append(b.ParseExpression(ctx, false))
+		}
+
+		if b.PeekNonSpace(ctx).Type() != ItemComma {
+			break
+		}
+		b.NextNonSpace(ctx)
+	}
+	return n
 }
 
 func (b *Builder) ParseMethodCallOrMapLookup(ctx *builderCtx, invocant node.Node) node.Node {
 	// We have already seen identifier followed by a period
 	symbol := b.NextNonSpace(ctx)
-	if symbol.Type() != ItemIdentifier {
+	if !isFieldName(symbol) {
 		b.Unexpected(ctx, "Expected identifier for method call or map lookup, got %s", symbol.Type())
 	}
 
@@ -502,12 +929,12 @@ func (b *Builder) ParseMethodCallOrMapLookup(ctx *builderCtx, invocant node.Node
 		n = node.NewFetchFieldNode(invocant.Pos(), invocant, symbol.Value())
 	} else {
 		// It's a method call! Parse the list
-		args := b.ParseList(ctx)
+		args := b.ParseArgs(ctx)
 		closeParen := b.NextNonSpace(ctx)
 		if closeParen.Type() != ItemCloseParen {
 			b.Unexpected(ctx, "Expected ')', got %s", closeParen.Type())
 		}
-		n = node.NewMethodCallNode(invocant.Pos(), invocant, symbol.Value(), args.(*node.ListNode))
+		n = node.NewMethodCallNode(invocant.Pos(), invocant, symbol.Value(), args)
 	}
 
 	// If we are followed by another period, we are going to have to
@@ -539,6 +966,24 @@ func (b *Builder) ParseArrayElementFetch(ctx *builderCtx, invocant node.Node) no
 	return n
 }
 
+// ParseExpression parses an expression. If `canPrint` is true, the
+// expression is wrapped in a PrintNode.
+//
+// Operators are parsed with the following precedence, from the
+// loosest to the tightest:
+//
+//	or
+//	and
+//	not
+//	?: (ternary)
+//	|| //
+//	&&
+//	| (filter)
+//	== != <=> eq ne cmp
+//	< > <= >= lt gt le ge
+//	+ - ~
+//	* / %
+//	! - + (unary)
 func (b *Builder) ParseExpression(ctx *builderCtx, canPrint bool) (n node.Node) {
 	defer func() {
 		if n != nil && canPrint {
@@ -546,6 +991,186 @@ func (b *Builder) ParseExpression(ctx *builderCtx, canPrint bool) (n node.Node)
 		}
 	}()
 
+	n = b.ParseLowOrExpression(ctx)
+	return
+}
+
+// ParseLowOrExpression parses expressions joined by "or"
+func (b *Builder) ParseLowOrExpression(ctx *builderCtx) node.Node {
+	n := b.ParseLowAndExpression(ctx)
+	for b.PeekNonSpace(ctx).Type() == ItemLowOr {
+		op := b.NextNonSpace(ctx)
+		tmp := node.NewOrNode(op.Pos())
+		tmp.Left = n
+		tmp.Right = b.ParseLowAndExpression(ctx)
+		n = tmp
+	}
+	return n
+}
+
+// ParseLowAndExpression parses expressions joined by "and"
+func (b *Builder) ParseLowAndExpression(ctx *builderCtx) node.Node {
+	n := b.ParseLowNotExpression(ctx)
+	for b.PeekNonSpace(ctx).Type() == ItemLowAnd {
+		op := b.NextNonSpace(ctx)
+		tmp := node.NewAndNode(op.Pos())
+		tmp.Left = n
+		tmp.Right = b.ParseLowNotExpression(ctx)
+		n = tmp
+	}
+	return n
+}
+
+// ParseLowNotExpression parses expressions negated with "not"
+func (b *Builder) ParseLowNotExpression(ctx *builderCtx) node.Node {
+	if b.PeekNonSpace(ctx).Type() == ItemLowNot {
+		op := b.NextNonSpace(ctx)
+		return node.NewNotNode(op.Pos(), b.ParseLowNotExpression(ctx))
+	}
+	return b.ParseTernaryExpression(ctx)
+}
+
+// ParseTernaryExpression parses `cond ? a : b`. Ternary operators are
+// right associative, so `a ? b : c ? d : e` is `a ? b : (c ? d : e)`
+func (b *Builder) ParseTernaryExpression(ctx *builderCtx) node.Node {
+	n := b.ParseBinaryExpression(ctx, 0)
+	if b.PeekNonSpace(ctx).Type() != ItemQuestion {
+		return n
+	}
+
+	question := b.NextNonSpace(ctx)
+	t := b.ParseTernaryExpression(ctx)
+	if colon := b.NextNonSpace(ctx); colon.Type() != ItemColon {
+		b.Unexpected(ctx, "Expected ':', got %s", colon.Type())
+	}
+	f := b.ParseTernaryExpression(ctx)
+	return node.NewTernaryNode(question.Pos(), n, t, f)
+}
+
+// binaryPrecedence lists the binary operators, and how tight they
+// bind. Operators with higher numbers bind tighter
+var binaryPrecedence = map[lex.ItemType]int{
+	ItemOr:            1,
+	ItemDefinedOr:     1,
+	ItemAnd:           2,
+	ItemVerticalSlash: 3,
+	ItemEquals:        4,
+	ItemNotEquals:     4,
+	ItemCmp:           4,
+	ItemStrCmp:        4,
+	ItemStrEquals:     4,
+	ItemStrNotEquals:  4,
+	ItemLT:            5,
+	ItemGT:            5,
+	ItemLE:            5,
+	ItemGE:            5,
+	ItemStrLT:         5,
+	ItemStrGT:         5,
+	ItemStrLE:         5,
+	ItemStrGE:         5,
+	ItemPlus:          6,
+	ItemMinus:         6,
+	ItemTilde:         6,
+	ItemAsterisk:      7,
+	ItemSlash:         7,
+	ItemMod:           7,
+}
+
+// ParseBinaryExpression parses binary operators whose precedence is
+// at least `minPrec`. All binary operators are left associative
+func (b *Builder) ParseBinaryExpression(ctx *builderCtx, minPrec int) node.Node {
+	n := b.ParseUnaryExpression(ctx)
+	for {
+		// A chomp marker, as in "-%]", is not an operator
+		if b.atTagEnd(ctx) {
+			return n
+		}
+		prec, ok := binaryPrecedence[b.PeekNonSpace(ctx).Type()]
+		if !ok || prec < minPrec {
+			return n
+		}
+
+		next := b.NextNonSpace(ctx)
+		var tmp *node.BinaryNode
+		switch next.Type() {
+		case ItemVerticalSlash:
+			b.Backup(ctx)
+			n = b.ParseFilter(ctx, n)
+			continue
+		case ItemMinus:
+			tmp = node.NewMinusNode(next.Pos())
+		case ItemOr:
+			tmp = node.NewOrNode(next.Pos())
+		case ItemDefinedOr:
+			tmp = node.NewDefinedOrNode(next.Pos())
+		case ItemAnd:
+			tmp = node.NewAndNode(next.Pos())
+		case ItemEquals:
+			tmp = node.NewEqualsNode(next.Pos())
+		case ItemNotEquals:
+			tmp = node.NewNotEqualsNode(next.Pos())
+		case ItemLT:
+			tmp = node.NewLTNode(next.Pos())
+		case ItemGT:
+			tmp = node.NewGTNode(next.Pos())
+		case ItemLE:
+			tmp = node.NewLENode(next.Pos())
+		case ItemGE:
+			tmp = node.NewGENode(next.Pos())
+		case ItemCmp:
+			tmp = node.NewCmpNode(next.Pos())
+		case ItemStrLT:
+			tmp = node.NewStrLTNode(next.Pos())
+		case ItemStrGT:
+			tmp = node.NewStrGTNode(next.Pos())
+		case ItemStrLE:
+			tmp = node.NewStrLENode(next.Pos())
+		case ItemStrGE:
+			tmp = node.NewStrGENode(next.Pos())
+		case ItemStrCmp:
+			tmp = node.NewStrCmpNode(next.Pos())
+		case ItemStrEquals:
+			tmp = node.NewStrEqualsNode(next.Pos())
+		case ItemStrNotEquals:
+			tmp = node.NewStrNotEqualsNode(next.Pos())
+		case ItemPlus:
+			tmp = node.NewPlusNode(next.Pos())
+		case ItemAsterisk:
+			tmp = node.NewMulNode(next.Pos())
+		case ItemSlash:
+			tmp = node.NewDivNode(next.Pos())
+		case ItemMod:
+			tmp = node.NewModNode(next.Pos())
+		case ItemTilde:
+			tmp = node.NewConcatNode(next.Pos())
+		}
+		tmp.Left = n
+		tmp.Right = b.ParseBinaryExpression(ctx, prec+1)
+		n = tmp
+	}
+}
+
+// ParseUnaryExpression parses a term, optionally preceded by a unary
+// operator
+func (b *Builder) ParseUnaryExpression(ctx *builderCtx) node.Node {
+	switch b.PeekNonSpace(ctx).Type() {
+	case ItemNot:
+		op := b.NextNonSpace(ctx)
+		return node.NewNotNode(op.Pos(), b.ParseUnaryExpression(ctx))
+	case ItemMinus:
+		op := b.NextNonSpace(ctx)
+		return node.NewUnaryMinusNode(op.Pos(), b.ParseUnaryExpression(ctx))
+	case ItemPlus:
+		op := b.NextNonSpace(ctx)
+		return node.NewUnaryPlusNode(op.Pos(), b.ParseUnaryExpression(ctx))
+	}
+	return b.ParsePrimaryExpression(ctx)
+}
+
+// ParsePrimaryExpression parses terms, groups, and inline lists, along
+// with method calls, function calls and element lookups on them
+func (b *Builder) ParsePrimaryExpression(ctx *builderCtx) node.Node {
+	var n node.Node
 	switch b.PeekNonSpace(ctx).Type() {
 	case ItemOpenParen:
 		// Looks like a group of something
@@ -553,94 +1178,44 @@ func (b *Builder) ParseExpression(ctx *builderCtx, canPrint bool) (n node.Node)
 	case ItemOpenSquareBracket:
 		// Looks like an inline list def
 		n = b.ParseMakeArray(ctx)
+	case ItemOpenCurlyBracket:
+		// Looks like an inline hash def
+		n = b.ParseMakeHash(ctx)
 	default:
 		// Otherwise it's a straight forward ... something
 		n = b.ParseTerm(ctx)
 		if n == nil {
-			panic(fmt.Sprintf("Expected term but could not parse. Next is %s\n", b.PeekNonSpace(ctx)))
+			b.Unexpected(ctx, "Expected term, got %s", b.PeekNonSpace(ctx))
 		}
 	}
 
-	next := b.PeekNonSpace(ctx)
-
 	switch n.Type() {
 	case node.LocalVar, node.FetchSymbol:
-		switch next.Type() {
+		if b.PeekNonSpace(ctx).Type() == ItemOpenParen {
+			// A variable followed by an open paren is a function call
+			n = b.ParseFunCall(ctx, n)
+		}
+	case node.MakeArray, node.MakeHash:
+		// Inline lists and hashes may be followed by lookups, as in
+		// `{ a => 1 }.a` or `[1, 2, 3].size()`
+	default:
+		return n
+	}
+
+	// Lookups may be chained, as in `foo.bar[0].baz`
+	for {
+		switch b.PeekNonSpace(ctx).Type() {
 		case ItemPeriod:
 			// It's either a method call, or a map lookup
 			b.NextNonSpace(ctx)
 			n = b.ParseMethodCallOrMapLookup(ctx, n)
 		case ItemOpenSquareBracket:
 			n = b.ParseArrayElementFetch(ctx, n)
-		case ItemOpenParen:
-			// A variable followed by an open paren is a function call
-			n = b.ParseFunCall(ctx, n)
+		default:
+			return n
 		}
 	}
-
-	next = b.NextNonSpace(ctx)
-	switch next.Type() {
-	case ItemPlus:
-		tmp := node.NewPlusNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemMinus:
-		// This is special...
-		following := b.PeekNonSpace(ctx)
-		if following.Type() == ItemTagEnd {
-			b.Backup2(ctx, next)
-			// Postchomp! not arithmetic!
-			return
-		}
-		tmp := node.NewMinusNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemAsterisk:
-		tmp := node.NewMulNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemSlash:
-		tmp := node.NewDivNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemEquals:
-		tmp := node.NewEqualsNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-	case ItemNotEquals:
-		tmp := node.NewNotEqualsNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-	case ItemLT:
-		tmp := node.NewLTNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-		return
-	case ItemGT:
-		tmp := node.NewGTNode(next.Pos())
-		tmp.Left = n
-		tmp.Right = b.ParseExpression(ctx, false)
-		n = tmp
-	case ItemVerticalSlash:
-		b.Backup(ctx)
-		n = b.ParseFilter(ctx, n)
-	default:
-		b.Backup(ctx)
-	}
-
-	return
-}
+}
 
 func (b *Builder) ParseFilter(ctx *builderCtx, n node.Node) node.Node {
 	vslash := b.NextNonSpace(ctx)
@@ -655,8 +1230,18 @@ func (b *Builder) ParseFilter(ctx *builderCtx, n node.Node) node.Node {
 
 	filter := node.NewFilterNode(id.Pos(), id.Value(), n)
 
-	if b.PeekNonSpace(ctx).Type() == ItemVerticalSlash {
-		filter = b.ParseFilter(ctx, filter).(*node.FilterNode)
+	// Filters defined as MACROs are called just like functions
+	if idx, ok := ctx.HasLocalVar(id.Value()); ok {
+		filter.LocalVar = node.NewLocalVarNode(id.Pos(), id.Value(), idx)
+	}
+
+	// Extra arguments, as in `x | truncate(30, "...")`
+	if b.PeekNonSpace(ctx).Type() == ItemOpenParen {
+		b.NextNonSpace(ctx) // discard open paren
+		filter.Args = b.ParseArgs(ctx)
+		if closeParen := b.NextNonSpace(ctx); closeParen.Type() != ItemCloseParen {
+			b.Unexpected(ctx, "Expected ')', got %s", closeParen.Type())
+		}
 	}
 
 	return filter
@@ -665,20 +1250,27 @@ func (b *Builder) ParseFilter(ctx *builderCtx, n node.Node) node.Node {
 func (b *Builder) ParseLiteral(ctx *builderCtx) node.Node {
 	t := b.NextNonSpace(ctx)
 	switch t.Type() {
-	case ItemDoubleQuotedString, ItemSingleQuotedString:
+	case ItemDoubleQuotedString:
+		return b.ParseInterpolatedString(ctx, t)
+	case ItemSingleQuotedString:
 		v := t.Value()
 		return node.NewTextNode(t.Pos(), v[1:len(v)-1])
 	case ItemNumber:
-		v := t.Value()
-		// XXX TODO: parse hex/oct/bin
-		if strings.Contains(v, ".") {
-			f, err := strconv.ParseFloat(v, 64)
-			if err != nil { // shouldn't happen, as we were able to lex it
+		// The lexer accepts anything that looks like a number, so
+		// misplaced underscores or digits that are out of range
+		// are only caught here
+		digits, base, err := numberDigits(t.Value())
+		if err != nil {
+			b.Unexpected(ctx, "Could not parse number: %s", err)
+		}
+		if base == 10 && strings.ContainsAny(digits, ".eE") {
+			f, err := strconv.ParseFloat(digits, 64)
+			if err != nil {
 				b.Unexpected(ctx, "Could not parse number: %s", err)
 			}
 			return node.NewFloatNode(t.Pos(), f)
 		}
-		i, err := strconv.ParseInt(v, 10, 64)
+		i, err := strconv.ParseInt(digits, base, 64)
 		if err != nil {
 			b.Unexpected(ctx, "Could not parse number: %s", err)
 		}
@@ -689,32 +1281,256 @@ func (b *Builder) ParseLiteral(ctx *builderCtx) node.Node {
 	return nil
 }
 
+// numberDigits strips the base prefix and the underscores from the
+// number literal `v`, and returns the remaining digits along with their
+// base. This is done by hand, as strconv only accepts underscores and
+// the 0b and 0o prefixes since Go 1.13
+func numberDigits(v string) (string, int, error) {
+	base := 10
+	digits := v
+	if len(v) > 1 && v[0] == '0' {
+		switch v[1] {
+		case 'x', 'X':
+			base, digits = 16, v[2:]
+		case 'o', 'O':
+			base, digits = 8, v[2:]
+		case 'b', 'B':
+			base, digits = 2, v[2:]
+		default:
+			if !strings.ContainsAny(v, ".eE") {
+				base, digits = 8, v[1:]
+			}
+		}
+	}
+
+	isDigit := func(c byte) bool {
+		if base == 16 {
+			return isNumeric(rune(c)) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+		}
+		return isNumeric(rune(c))
+	}
+
+	// Underscores may only separate digits
+	buf := make([]byte, 0, len(digits))
+	for i := 0; i < len(digits); i++ {
+		if digits[i] != '_' {
+			buf = append(buf, digits[i])
+			continue
+		}
+		if i == 0 || i == len(digits)-1 || !isDigit(digits[i-1]) || !isDigit(digits[i+1]) {
+			return "", 0, fmt.Errorf("misplaced '_' in %s", v)
+		}
+	}
+	return string(buf), base, nil
+}
+
+// ParseInterpolatedString expands the escape sequences, `$name` and
+// `${expr}` in the double quoted string `t`. A string without any
+// variables becomes a Text node, otherwise its parts are joined by
+// Concat nodes
+func (b *Builder) ParseInterpolatedString(ctx *builderCtx, t lex.LexItem) node.Node {
+	v := t.Value()
+	v = v[1 : len(v)-1]
+	offset := t.Pos() + 1 // position of v[0] in the template
+
+	var parts []node.Node
+	var buf bytes.Buffer
+	flush := func(i int) {
+		if buf.Len() > 0 {
+			parts = append(parts, node.NewTextNode(offset+i-buf.Len(), buf.String()))
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case c == '\\' && i+1 < len(v):
+			i++
+			switch e := v[i]; e {
+			case 'n':
+				buf.WriteByte('\n')
+			case 't':
+				buf.WriteByte('\t')
+			case 'r':
+				buf.WriteByte('\r')
+			case '\\', '"', '$':
+				buf.WriteByte(e)
+			default:
+				buf.WriteByte(c)
+				buf.WriteByte(e)
+			}
+		case c == '$' && strings.HasPrefix(v[i+1:], "{"):
+			end := interpolationEnd(v[i+2:])
+			if end < 0 {
+				ctx.Pos = offset + i
+				b.raise(ctx, "Unterminated '${' in string "+t.Value())
+			}
+			flush(i)
+			parts = append(parts, b.parseInterpolatedExpression(ctx, offset+i, v[i+2:i+2+end]))
+			i += end + 2
+		case c == '$' && i+1 < len(v) && isIdentifierStart(v[i+1]):
+			// $name, optionally followed by fields, as in $user.name.
+			// A '.' that isn't followed by a field name is left as text,
+			// and so are method calls, which need ${...}
+			j := identifierEnd(v, i+1)
+			var n node.Node = localVarOrFetchSymbol(ctx, offset+i, v[i+1:j])
+			for j+1 < len(v) && v[j] == '.' && isIdentifierStart(v[j+1]) {
+				k := identifierEnd(v, j+1)
+				if k < len(v) && v[k] == '(' {
+					break
+				}
+				n = node.NewFetchFieldNode(offset+i, n, v[j+1:k])
+				j = k
+			}
+			flush(i)
+			parts = append(parts, n)
+			i = j - 1
+		default:
+			buf.WriteByte(c)
+		}
+	}
+
+	if len(parts) == 0 {
+		return node.NewTextNode(t.Pos(), buf.String())
+	}
+	flush(len(v))
+
+	// Always start with a string, so that "$foo" stringifies foo
+	var n node.Node = node.NewTextNode(t.Pos(), "")
+	if parts[0].Type() == node.Text {
+		n, parts = parts[0], parts[1:]
+	}
+	for _, p := range parts {
+		concat := node.NewConcatNode(p.Pos())
+		concat.Left = n
+		concat.Right = p
+		n = concat
+	}
+	return n
+}
+
+// identifierEnd returns the position right after the identifier that
+// starts at v[i]
+func identifierEnd(v string, i int) int {
+	j := i + 1
+	for j < len(v) && (isIdentifierStart(v[j]) || isNumeric(rune(v[j]))) {
+		j++
+	}
+	return j
+}
+
+// interpolationEnd returns the position of the '}' that ends the `${`
+// expression at the start of v, skipping over nested braces and quoted
+// strings, or -1 if there is none
+func interpolationEnd(v string) int {
+	depth := 1
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '"', '\'':
+			for i++; i < len(v) && v[i] != c; i++ {
+				if c == '"' && v[i] == '\\' {
+					i++
+				}
+			}
+		}
+	}
+	return -1
+}
+
+// parseInterpolatedExpression parses the contents of `${...}` in a double
+// quoted string by running them through a lexer of the same syntax as
+// the template. `pos` is the position of the `$` in the template
+func (b *Builder) parseInterpolatedExpression(ctx *builderCtx, pos int, expr string) node.Node {
+	l, ok := ctx.Lexer.(*Lexer)
+	if !ok {
+		ctx.Pos = pos
+		b.raise(ctx, fmt.Sprintf("Cannot interpolate ${%s} with lexer %T", expr, ctx.Lexer))
+	}
+
+	// The expression is padded so that the positions of its tokens
+	// match their positions in the template. It is delimited with NULs,
+	// as the tags of the template may be anything, or even be too long
+	// to fit before the expression
+	const delim = "\x00"
+	padding := strings.Repeat(" ", pos+2-len(delim))
+	sub := NewStringLexer(padding+delim+expr+delim, l.symbols)
+	sub.SetDelimiters(Delimiters{TagStart: delim, TagEnd: delim})
+	subctx := &builderCtx{
+		ParseName:  ctx.ParseName,
+		Text:       ctx.Text,
+		Lexer:      sub,
+		Tokens:     [3]lex.LexItem{},
+		FrameStack: ctx.FrameStack,
+		Frames:     ctx.Frames,
+		Blocks:     ctx.Blocks,
+	}
+	defer func() {
+		if subctx.Error != nil {
+			ctx.Error = subctx.Error
+		}
+	}()
+
+	b.Start(subctx)
+	if t := b.Next(subctx); t.Type() == ItemRawString {
+		b.Next(subctx)
+	}
+	n := b.ParseExpression(subctx, false)
+	if t := b.NextNonSpace(subctx); t.Type() != ItemTagEnd {
+		b.Unexpected(subctx, "Expected '}', got %s", t)
+	}
+	b.Next(subctx) // EOF, so that the lexer can finish
+	return n
+}
+
 func (b *Builder) ParseForeach(ctx *builderCtx) node.Node {
 	foreach := b.NextNonSpace(ctx)
 	if foreach.Type() != ItemForeach {
 		b.Unexpected(ctx, "Expected FOREACH, got %s", foreach)
 	}
 
-	localsym := b.NextNonSpace(ctx)
-	if localsym.Type() != ItemIdentifier {
-		b.Unexpected(ctx, "Expected identifier, got %s", localsym)
-	}
-
-	forNode := node.NewForeachNode(foreach.Pos(), localsym.Value())
-	// use current frame mark
-	forNode.IndexVarIdx = ctx.CurrentFrame().Mark()
-
-	in := b.NextNonSpace(ctx)
-	if in.Type() != ItemIn {
-		b.Unexpected(ctx, "Expected IN, got %s", in)
+	// FOREACH item IN list, or `for $list -> $item {` in Kolon, where
+	// the loop variable of $item is $~item
+	first := b.NextNonSpace(ctx)
+	following := b.PeekNonSpace(ctx)
+	b.Backup2(ctx, first)
+
+	var localsym lex.LexItem
+	var list node.Node
+	var loopName string
+	if first.Type() == ItemIdentifier && following.Type() == ItemIn {
+		localsym = b.NextNonSpace(ctx)
+		b.NextNonSpace(ctx) // IN
+		list = b.ParseListVariableOrMakeArray(ctx)
+		loopName = "loop"
+	} else {
+		list = b.ParseExpression(ctx, false)
+		if arrow := b.NextNonSpace(ctx); arrow.Type() != ItemArrow {
+			b.Unexpected(ctx, "Expected '->', got %s", arrow)
+		}
+		localsym = b.NextNonSpace(ctx)
+		if localsym.Type() != ItemVariable {
+			b.Unexpected(ctx, "Expected variable, got %s", localsym)
+		}
+		loopName = "~" + symbolName(localsym)
+		b.ParseOpenBrace(ctx)
 	}
 
-	forNode.List = b.ParseListVariableOrMakeArray(ctx)
+	forNode := node.NewForeachNode(foreach.Pos(), symbolName(localsym))
+	forNode.List = list
 
 	ctx.CurrentParentNode().Append(forNode)
 	ctx.PushParentNode(forNode)
-	ctx.DeclareLocalVar(localsym.Value())
-	ctx.DeclareLocalVar("loop")
+	// The loop variable always sits right after the item
+	forNode.IndexVarIdx = ctx.DeclareLocalVar(symbolName(localsym))
+	ctx.DeclareLocalVar(loopName)
 
 	return nil
 }
@@ -727,14 +1543,46 @@ func (b *Builder) ParseWhile(ctx *builderCtx) node.Node {
 
 	condition := b.ParseExpression(ctx, false)
 	whileNode := node.NewWhileNode(while.Pos(), condition)
+	b.ParseOpenBrace(ctx)
 
 	ctx.CurrentParentNode().Append(whileNode)
 	ctx.PushParentNode(whileNode)
-	ctx.DeclareLocalVar("loop")
+	whileNode.LoopVarIdx = ctx.DeclareLocalVar("loop")
 
 	return nil
 }
 
+// ParseLoopControl parses LAST and NEXT, which must appear within a
+// FOREACH or WHILE loop
+func (b *Builder) ParseLoopControl(ctx *builderCtx) node.Node {
+	token := b.NextNonSpace(ctx)
+
+	inLoop := false
+LOOP:
+	for i := ctx.Frames.Size() - 1; i >= 0; i-- {
+		f, _ := ctx.Frames.Get(i)
+		if f.(*Frame).Node == nil {
+			continue
+		}
+		switch f.(*Frame).Node.Type() {
+		case node.Foreach, node.While:
+			inLoop = true
+			break LOOP
+		case node.Macro, node.Block, node.Before, node.After, node.Around:
+			// Macros and BLOCKs are run separately from where they're defined
+			break LOOP
+		}
+	}
+	if !inLoop {
+		b.Unexpected(ctx, "%s outside of a loop", token.Value())
+	}
+
+	if token.Type() == ItemLast {
+		return node.NewLastNode(token.Pos())
+	}
+	return node.NewNextNode(token.Pos())
+}
+
 func (b *Builder) ParseRange(ctx *builderCtx) node.Node {
 	start := b.ParseTerm(ctx)
 	if start == nil {
@@ -772,6 +1620,8 @@ func (b *Builder) ParseListVariableOrMakeArray(ctx *builderCtx) node.Node {
 		}
 	case ItemOpenSquareBracket:
 		n = b.ParseMakeArray(ctx)
+	case ItemOpenCurlyBracket:
+		n = b.ParseMakeHash(ctx)
 	default:
 		panic("fuck")
 	}
@@ -794,6 +1644,48 @@ func (b *Builder) ParseMakeArray(ctx *builderCtx) node.Node {
 	return node.NewMakeArrayNode(openB.Pos(), child)
 }
 
+// ParseMakeHash parses `{ key => value, ... }`. Keys may be bare words,
+// which are taken as strings, or literals
+func (b *Builder) ParseMakeHash(ctx *builderCtx) node.Node {
+	openB := b.NextNonSpace(ctx)
+	if openB.Type() != ItemOpenCurlyBracket {
+		b.Unexpected(ctx, "Expected '{', got %s", openB.Value())
+	}
+
+	child := node.NewListNode(openB.Pos())
+	for b.PeekNonSpace(ctx).Type() != ItemCloseCurlyBracket {
+		var key node.Node
+		switch item := b.PeekNonSpace(ctx); item.Type() {
+		case ItemIdentifier:
+			b.NextNonSpace(ctx)
+			key = node.NewTextNode(item.Pos(), item.Value())
+		case ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString:
+			key = b.ParseLiteral(ctx)
+		default:
+			b.Unexpected(ctx, "Expected hash key, got %s", item)
+		}
+
+		if fatComma := b.NextNonSpace(ctx); fatComma.Type() != ItemFatComma {
+			b.Unexpected(ctx, "Expected '=>', got %s", fatComma)
+		}
+
+		child.Append(key)
+		child.Append(b.ParseExpression(ctx, false))
+
+		if b.PeekNonSpace(ctx).Type() != ItemComma {
+			break
+		}
+		b.NextNonSpace(ctx)
+	}
+
+	closeB := b.NextNonSpace(ctx)
+	if closeB.Type() != ItemCloseCurlyBracket {
+		b.Unexpected(ctx, "Expected '}', got %s", closeB.Value())
+	}
+
+	return node.NewMakeHashNode(openB.Pos(), child)
+}
+
 func (b *Builder) ParseList(ctx *builderCtx) node.Node {
 	n := node.NewListNode(b.PeekNonSpace(ctx).Pos())
 OUTER:
@@ -801,7 +1693,8 @@ OUTER:
 		// At the beginning of this loop, we must see an
 		// identifier or a literal
 		switch item := b.PeekNonSpace(ctx); item.Type() {
-		case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString:
+		case ItemIdentifier, ItemNumber, ItemDoubleQuotedString, ItemSingleQuotedString,
+			ItemOpenSquareBracket, ItemOpenCurlyBracket:
 			// okay, proceed
 		default:
 			break OUTER
@@ -832,11 +1725,26 @@ OUTER:
 
 func (b *Builder) ParseIf(ctx *builderCtx) node.Node {
 	ifToken := b.NextNonSpace(ctx)
-	if ifToken.Type() != ItemIf {
+	var ifNode *node.IfNode
+	switch ifToken.Type() {
+	case ItemIf:
+		ifNode = node.NewIfNode(ifToken.Pos(), b.ParseCondition(ctx))
+	case ItemUnless:
+		ifNode = node.NewUnlessNode(ifToken.Pos(), b.ParseCondition(ctx))
+	default:
 		b.Unexpected(ctx, "Expected if, got %s", ifToken)
 	}
+	b.ParseOpenBrace(ctx)
+
+	ctx.CurrentParentNode().Append(ifNode)
+	ctx.PushParentNode(ifNode)
 
-	// parenthesis are optional
+	return nil
+}
+
+// ParseCondition parses the expression given to IF, ELSIF and UNLESS.
+// The parenthesis around it are optional
+func (b *Builder) ParseCondition(ctx *builderCtx) node.Node {
 	expectCloseParen := false
 	if b.PeekNonSpace(ctx).Type() == ItemOpenParen {
 		b.NextNonSpace(ctx)
@@ -844,7 +1752,6 @@ func (b *Builder) ParseIf(ctx *builderCtx) node.Node {
 	}
 
 	exp := b.ParseExpression(ctx, false)
-	ifNode := node.NewIfNode(ifToken.Pos(), exp)
 
 	if expectCloseParen {
 		closeParenToken := b.NextNonSpace(ctx)
@@ -852,8 +1759,36 @@ func (b *Builder) ParseIf(ctx *builderCtx) node.Node {
 			b.Unexpected(ctx, "Expected close parenthesis, got %s", closeParenToken)
 		}
 	}
+	return exp
+}
 
-	ctx.CurrentParentNode().Append(ifNode)
+func (b *Builder) ParseElseIf(ctx *builderCtx) node.Node {
+	elsifToken := b.NextNonSpace(ctx)
+	if elsifToken.Type() != ItemElseIf {
+		b.Unexpected(ctx, "Expected elsif, got %s", elsifToken)
+	}
+	return b.parseElseIf(ctx, elsifToken)
+}
+
+func (b *Builder) parseElseIf(ctx *builderCtx, elsifToken lex.LexItem) node.Node {
+	// CurrentParentNode must be "If" in order for "elsif" to work
+	switch ctx.CurrentParentNode().Type() {
+	case node.If, node.Unless:
+	default:
+		b.Unexpected(ctx, "Found elsif without if")
+	}
+
+	// IF a ... ELSIF b ... END is the same as
+	// IF a ... ELSE; IF b ... END; END
+	elseNode := node.NewElseNode(elsifToken.Pos())
+	elseNode.IfNode = ctx.CurrentParentNode()
+	ctx.CurrentParentNode().Append(elseNode)
+	ctx.PushParentNode(elseNode)
+
+	ifNode := node.NewIfNode(elsifToken.Pos(), b.ParseCondition(ctx))
+	ifNode.ElseIf = true
+	b.ParseOpenBrace(ctx)
+	elseNode.Append(ifNode)
 	ctx.PushParentNode(ifNode)
 
 	return nil
@@ -865,8 +1800,17 @@ func (b *Builder) ParseElse(ctx *builderCtx) node.Node {
 		b.Unexpected(ctx, "Expected else, got %s", elseToken)
 	}
 
+	// `else if` in Kolon is the same as ELSIF
+	if b.PeekNonSpace(ctx).Type() == ItemIf {
+		b.NextNonSpace(ctx)
+		return b.parseElseIf(ctx, elseToken)
+	}
+	b.ParseOpenBrace(ctx)
+
 	// CurrentParentNode must be "If" in order for "else" to work
-	if ctx.CurrentParentNode().Type() != node.If {
+	switch ctx.CurrentParentNode().Type() {
+	case node.If, node.Unless:
+	default:
 		b.Unexpected(ctx, "Found else without if")
 	}
 
@@ -878,17 +1822,82 @@ func (b *Builder) ParseElse(ctx *builderCtx) node.Node {
 	return nil
 }
 
+func (b *Builder) ParseSwitch(ctx *builderCtx) node.Node {
+	switchToken := b.NextNonSpace(ctx)
+	if switchToken.Type() != ItemSwitch {
+		b.Unexpected(ctx, "Expected switch, got %s", switchToken)
+	}
+
+	switchNode := node.NewSwitchNode(switchToken.Pos(), b.ParseExpression(ctx, false))
+	b.ParseOpenBrace(ctx)
+	ctx.CurrentParentNode().Append(switchNode)
+	ctx.PushParentNode(switchNode)
+
+	return nil
+}
+
+func (b *Builder) ParseCase(ctx *builderCtx) node.Node {
+	caseToken := b.NextNonSpace(ctx)
+	if t := caseToken.Type(); t != ItemCase && t != ItemDefault {
+		b.Unexpected(ctx, "Expected case, got %s", caseToken)
+	}
+
+	// A CASE ends the previous one
+	if ctx.CurrentParentNode().Type() == node.Case {
+		ctx.PopParentNode()
+	}
+	if ctx.CurrentParentNode().Type() != node.Switch {
+		b.Unexpected(ctx, "Found case without switch")
+	}
+
+	// CASE without a value (or CASE DEFAULT, or `default` in Kolon)
+	// matches anything
+	var exp node.Node
+	switch {
+	case b.PeekNonSpace(ctx).Type() == ItemDefault:
+		b.NextNonSpace(ctx)
+	case b.atTagEnd(ctx), b.PeekNonSpace(ctx).Type() == ItemOpenCurlyBracket:
+	default:
+		if caseToken.Type() != ItemDefault {
+			exp = b.ParseExpression(ctx, false)
+		}
+	}
+	b.ParseOpenBrace(ctx)
+
+	caseNode := node.NewCaseNode(caseToken.Pos(), exp)
+	ctx.CurrentParentNode().Append(caseNode)
+	ctx.PushParentNode(caseNode)
+
+	return nil
+}
+
+// ParseInclude parses INCLUDE and PROCESS. The target may be the name
+// of a BLOCK, in which case the local variables in the current scope
+// are passed to it as well
 func (b *Builder) ParseInclude(ctx *builderCtx) node.Node {
 	incToken := b.NextNonSpace(ctx)
-	if incToken.Type() != ItemInclude {
-		b.Unexpected(ctx, "Expected include, got %s", incToken)
-	}
 
 	// Next thing must be the name of the included template
 	n := b.ParseExpression(ctx, false)
-	x := node.NewIncludeNode(incToken.Pos(), n)
+	var x *node.IncludeNode
+	switch incToken.Type() {
+	case ItemInclude:
+		x = node.NewIncludeNode(incToken.Pos(), n)
+	case ItemProcess:
+		x = node.NewProcessNode(incToken.Pos(), n)
+	default:
+		b.Unexpected(ctx, "Expected include, got %s", incToken)
+	}
+	x.LocalVars = ctx.VisibleLocalVars()
 	ctx.PushFrame()
 
+	// In Kolon, the variables are given as a hash
+	if b.PeekNonSpace(ctx).Type() == ItemOpenCurlyBracket {
+		b.ParseIncludeVars(ctx, x)
+		ctx.PopFrame()
+		return x
+	}
+
 	if b.PeekNonSpace(ctx).Type() != ItemWith {
 		ctx.PopFrame()
 		return x
@@ -911,6 +1920,184 @@ func (b *Builder) ParseInclude(ctx *builderCtx) node.Node {
 	return x
 }
 
+// ParseIncludeVars parses the variables given to `include` in Kolon,
+// as in `include "foo.tx" { title => $title }`
+func (b *Builder) ParseIncludeVars(ctx *builderCtx, x *node.IncludeNode) {
+	b.NextNonSpace(ctx) // '{'
+	for b.PeekNonSpace(ctx).Type() != ItemCloseCurlyBracket {
+		key := b.NextNonSpace(ctx)
+		var name string
+		switch key.Type() {
+		case ItemIdentifier:
+			name = key.Value()
+		case ItemDoubleQuotedString, ItemSingleQuotedString:
+			name = key.Value()[1 : len(key.Value())-1]
+		default:
+			b.Unexpected(ctx, "Expected variable name, got %s", key)
+		}
+
+		if fatComma := b.NextNonSpace(ctx); fatComma.Type() != ItemFatComma {
+			b.Unexpected(ctx, "Expected '=>', got %s", fatComma)
+		}
+
+		expr := b.ParseExpression(ctx, false)
+		a := newAssignment(ctx, key.Pos(), name)
+		a.Expression = expr
+		x.AppendAssignment(a)
+
+		if b.PeekNonSpace(ctx).Type() != ItemComma {
+			break
+		}
+		b.NextNonSpace(ctx)
+	}
+
+	if closeB := b.NextNonSpace(ctx); closeB.Type() != ItemCloseCurlyBracket {
+		b.Unexpected(ctx, "Expected '}', got %s", closeB)
+	}
+}
+
+// ParseBlock parses the definition of a named BLOCK. The BLOCK is not
+// rendered where it is defined, so nothing is appended to the tree,
+// unless it's written as `block name -> { ... }` (Kolon), which is
+// rendered in place.
+func (b *Builder) ParseBlock(ctx *builderCtx) node.Node {
+	blockToken := b.NextNonSpace(ctx)
+	if blockToken.Type() != ItemBlock {
+		b.Unexpected(ctx, "Expected BLOCK, got %s", blockToken)
+	}
+
+	nameToken := b.NextNonSpace(ctx)
+	if nameToken.Type() != ItemIdentifier {
+		b.Unexpected(ctx, "Expected identifier, got %s", nameToken)
+	}
+	if _, ok := ctx.Blocks[nameToken.Value()]; ok {
+		b.Unexpected(ctx, "BLOCK %s is already defined", nameToken.Value())
+	}
+
+	blk := node.NewBlockNode(nameToken.Pos(), nameToken.Value())
+	ctx.Blocks[blk.Name] = blk
+
+	if b.ParseArrowBrace(ctx) {
+		x := node.NewProcessNode(blockToken.Pos(), node.NewFetchSymbolNode(nameToken.Pos(), blk.Name))
+		x.LocalVars = ctx.VisibleLocalVars()
+		ctx.CurrentParentNode().Append(x)
+	}
+	b.enterBlock(ctx, blk)
+
+	return nil
+}
+
+// ParseBlockModifier parses BEFORE, AFTER and AROUND, which modify
+// the BLOCK of the same name in the template that is being cascaded
+func (b *Builder) ParseBlockModifier(ctx *builderCtx) node.Node {
+	token := b.NextNonSpace(ctx)
+	var typ node.NodeType
+	switch token.Type() {
+	case ItemBefore:
+		typ = node.Before
+	case ItemAfter:
+		typ = node.After
+	case ItemAround:
+		typ = node.Around
+	default:
+		b.Unexpected(ctx, "Expected BEFORE, AFTER or AROUND, got %s", token)
+	}
+
+	nameToken := b.NextNonSpace(ctx)
+	if nameToken.Type() != ItemIdentifier {
+		b.Unexpected(ctx, "Expected identifier, got %s", nameToken)
+	}
+
+	m := node.NewBlockModifierNode(nameToken.Pos(), typ, nameToken.Value())
+	ctx.Modifiers = append(ctx.Modifiers, m)
+	b.ParseArrowBrace(ctx)
+	b.enterBlock(ctx, m)
+
+	return nil
+}
+
+// ParseArrowBrace consumes the `-> {` that follows the name of a block
+// in Kolon, if any
+func (b *Builder) ParseArrowBrace(ctx *builderCtx) bool {
+	if b.PeekNonSpace(ctx).Type() != ItemArrow {
+		return false
+	}
+	b.NextNonSpace(ctx)
+	if brace := b.NextNonSpace(ctx); brace.Type() != ItemOpenCurlyBracket {
+		b.Unexpected(ctx, "Expected '{', got %s", brace)
+	}
+	return true
+}
+
+// enterBlock starts parsing the body of `blk`, which gets its own set
+// of local variables, as it is executed in a separate frame
+func (b *Builder) enterBlock(ctx *builderCtx, blk *node.BlockNode) {
+	ctx.OuterStacks = append(ctx.OuterStacks, ctx.FrameStack)
+	ctx.FrameStack = stack.New(5)
+	ctx.PushParentNode(blk)
+	blk.LocalVars = ctx.CurrentFrame().LvarNames
+}
+
+// ParseSuper parses SUPER, which renders the original BLOCK from
+// within AROUND
+func (b *Builder) ParseSuper(ctx *builderCtx) node.Node {
+	token := b.NextNonSpace(ctx)
+	if token.Type() != ItemSuper {
+		b.Unexpected(ctx, "Expected SUPER, got %s", token)
+	}
+
+	inAround := false
+	for i := ctx.Frames.Size() - 1; i >= 0; i-- {
+		f, _ := ctx.Frames.Get(i)
+		if isBlockFrame(f.(*Frame)) {
+			inAround = f.(*Frame).Node.Type() == node.Around
+			break
+		}
+	}
+	if !inAround {
+		b.Unexpected(ctx, "%s outside of AROUND", token.Value())
+	}
+
+	x := node.NewSuperNode(token.Pos())
+	x.LocalVars = ctx.VisibleLocalVars()
+	return x
+}
+
+// ParseCascade parses CASCADE, which names the template that this one
+// cascades from. The name is either a string, or a bare word to which
+// ".tx" is appended
+func (b *Builder) ParseCascade(ctx *builderCtx) node.Node {
+	token := b.NextNonSpace(ctx)
+	if token.Type() != ItemCascade {
+		b.Unexpected(ctx, "Expected CASCADE, got %s", token)
+	}
+	if ctx.Cascade != "" {
+		b.Unexpected(ctx, "%s may only appear once", token.Value())
+	}
+
+	name := b.NextNonSpace(ctx)
+	switch name.Type() {
+	case ItemIdentifier:
+		ctx.Cascade = name.Value() + ".tx"
+	case ItemDoubleQuotedString, ItemSingleQuotedString:
+		v := name.Value()
+		ctx.Cascade = v[1 : len(v)-1]
+	default:
+		b.Unexpected(ctx, "Expected template name, got %s", name)
+	}
+
+	return nil
+}
+
+func (b *Builder) ParseImport(ctx *builderCtx) node.Node {
+	importToken := b.NextNonSpace(ctx)
+	if importToken.Type() != ItemImport {
+		b.Unexpected(ctx, "Expected IMPORT, got %s", importToken)
+	}
+
+	return node.NewImportNode(importToken.Pos(), b.ParseExpression(ctx, false))
+}
+
 func (b *Builder) ParseGroup(ctx *builderCtx) node.Node {
 	openParenToken := b.NextNonSpace(ctx)
 	if openParenToken.Type() != ItemOpenParen {
@@ -947,19 +2134,34 @@ func (b *Builder) ParseMacro(ctx *builderCtx) node.Node {
 	ctx.CurrentParentNode().Append(macro)
 	ctx.PushParentNode(macro)
 
+	// Kolon macros are written as `macro name -> ($a, $b) { ... }`
+	kolon := b.PeekNonSpace(ctx).Type() == ItemArrow
+	if kolon {
+		b.NextNonSpace(ctx)
+	}
+
 	// either a '(' followed by argument list, or BLOCK
 	if b.PeekNonSpace(ctx).Type() == ItemOpenParen {
 		b.NextNonSpace(ctx) // discard open paren
 		// Can't use ParseList() here, because we want a list of only identifiers
+		seen := map[string]struct{}{}
 		for {
 			next := b.NextNonSpace(ctx)
-			if next.Type() != ItemIdentifier {
+			if !isVariable(next) {
 				b.Backup(ctx)
 				break
 			}
 
-			//      idx := ctx.DeclareLocalVar(next.Value())
-			//      macro.AppendArg(node.NewLocalVarNode(next.Pos(), next.Value(), idx))
+			// Arguments are passed to the macro as template variables,
+			// so the offset is only the position in the argument list.
+			// They hide local variables with the same name
+			name := symbolName(next)
+			if _, ok := seen[name]; ok {
+				b.Unexpected(ctx, "parameter '%s' declared twice", name)
+			}
+			seen[name] = struct{}{}
+			macro.AppendArg(node.NewLocalVarNode(next.Pos(), name, len(macro.Arguments)))
+			ctx.CurrentFrame().LvarNames[name] = -1
 
 			next = b.NextNonSpace(ctx)
 			if next.Type() != ItemComma {
@@ -973,7 +2175,11 @@ func (b *Builder) ParseMacro(ctx *builderCtx) node.Node {
 	}
 
 	// Then we need a BLOCK
-	if block := b.NextNonSpace(ctx); block.Type() != ItemBlock {
+	if kolon {
+		if brace := b.NextNonSpace(ctx); brace.Type() != ItemOpenCurlyBracket {
+			b.Unexpected(ctx, "Expected '{', got %s", brace)
+		}
+	} else if block := b.NextNonSpace(ctx); block.Type() != ItemBlock {
 		b.Unexpected(ctx, "Expected BLOCK, got %s", block)
 	}
 
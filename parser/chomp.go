@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/lestrrat-go/xslate/node"
+)
+
+const whiteSpace = " \t\r\n"
+
+// chompLeft removes the whitespace at the start of s, which comes
+// right after a tag
+func chompLeft(s string, mode ChompMode) string {
+	switch mode {
+	case ChompOne:
+		t := strings.TrimLeft(s, " \t")
+		switch {
+		case strings.HasPrefix(t, "\r\n"):
+			return t[2:]
+		case strings.HasPrefix(t, "\n"):
+			return t[1:]
+		}
+	case ChompCollapse:
+		if t := strings.TrimLeft(s, whiteSpace); len(t) < len(s) {
+			return " " + t
+		}
+	case ChompGreedy:
+		return strings.TrimLeft(s, whiteSpace)
+	}
+	return s
+}
+
+// chompRight removes the whitespace at the end of s, which comes right
+// before a tag
+func chompRight(s string, mode ChompMode) string {
+	switch mode {
+	case ChompOne:
+		// The spaces are only removed if the tag is the first thing in
+		// its line, as in Template-Toolkit
+		t := strings.TrimRight(s, " \t")
+		switch {
+		case t == "":
+			return t
+		case strings.HasSuffix(t, "\r\n"):
+			return t[:len(t)-2]
+		case strings.HasSuffix(t, "\n"):
+			return t[:len(t)-1]
+		}
+	case ChompCollapse:
+		if t := strings.TrimRight(s, whiteSpace); len(t) < len(s) {
+			return t + " "
+		}
+	case ChompGreedy:
+		return strings.TrimRight(s, whiteSpace)
+	}
+	return s
+}
+
+// trimText removes the whitespace at the start of the first node of n,
+// and at the end of its last node, if they are raw text
+func trimText(n *node.ListNode) {
+	if len(n.Nodes) == 0 {
+		return
+	}
+	if t := rawText(n.Nodes[0]); t != nil {
+		t.Text = bytes.TrimLeft(t.Text, whiteSpace)
+	}
+	if t := rawText(n.Nodes[len(n.Nodes)-1]); t != nil {
+		t.Text = bytes.TrimRight(t.Text, whiteSpace)
+	}
+}
+
+// rawText returns the text of n, if it prints raw text
+func rawText(n node.Node) *node.TextNode {
+	l, ok := n.(*node.ListNode)
+	if !ok || l.Type() != node.PrintRaw || len(l.Nodes) != 1 {
+		return nil
+	}
+	t, _ := l.Nodes[0].(*node.TextNode)
+	return t
+}
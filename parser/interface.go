@@ -2,6 +2,7 @@ package parser
 
 import (
 	"io"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/lex"
@@ -79,21 +80,95 @@ const (
 	ItemSlash
 	ItemVerticalSlash
 	ItemMod
-	ItemAssign // =
+	ItemAssign            // =
+	ItemNot               // !
+	ItemDefinedOr         // //
+	ItemLowAnd            // and
+	ItemLowOr             // or
+	ItemLowNot            // not
+	ItemStrLT             // lt
+	ItemStrGT             // gt
+	ItemStrLE             // le
+	ItemStrGE             // ge
+	ItemStrCmp            // cmp
+	ItemStrEquals         // eq
+	ItemStrNotEquals      // ne
+	ItemTilde             // ~
+	ItemQuestion          // ?
+	ItemColon             // :
+	ItemOpenCurlyBracket  // '{'
+	ItemCloseCurlyBracket // '}'
+	ItemLast              // LAST
+	ItemNext              // NEXT
+	ItemImport            // IMPORT
+	ItemProcess           // PROCESS
+	ItemCascade           // CASCADE
+	ItemBefore            // BEFORE
+	ItemAfter             // AFTER
+	ItemAround            // AROUND
+	ItemSuper             // SUPER
+	ItemArrow             // ->
+	ItemInto              // INTO
+	ItemVariable          // $foo (Kolon)
+	ItemSemicolon         // ;
+	ItemMy                // my (Kolon)
+	ItemPrint             // print (Kolon)
+	ItemPrintRaw          // print_raw (Kolon)
 
 	DefaultItemTypeMax
 )
 
 // AST is represents the syntax tree for an Xslate template
 type AST struct {
-	Name      string         // name of the template
-	ParseName string         // name of the top-level template during parsing
-	Root      *node.ListNode // root of the tree
-	Timestamp time.Time      // last-modified date of this template
-	text      string
+	Name      string                     // name of the template
+	ParseName string                     // name of the top-level template during parsing
+	Root      *node.ListNode             // root of the tree
+	Timestamp time.Time                  // last-modified date of this template
+	Text      string                     // template source, used to map nodes to lines
+	Blocks    map[string]*node.BlockNode // BLOCKs defined in the template
+	Modifiers []*node.BlockNode          // BEFORE, AFTER and AROUND, in order
+	Cascade   string                     // name of the template this one cascades from
+	Parent    *AST                       // the template named by Cascade, once loaded
+}
+
+// ParseError is the error returned when a template could not be parsed.
+// Line and Column start from 1, and Snippet contains the offending line
+// from the template source, if available
+type ParseError struct {
+	Name    string
+	Line    int
+	Column  int
+	Message string
+	Snippet string
 }
 
 type Builder struct {
+	Whitespace Whitespace
+}
+
+// ChompMode specifies how the whitespace next to a tag is removed. The
+// values are the same as Template-Toolkit's CHOMP_* constants
+type ChompMode int
+
+const (
+	// ChompNone keeps the whitespace
+	ChompNone ChompMode = iota
+	// ChompOne removes spaces and tabs up to and including one newline
+	ChompOne
+	// ChompCollapse replaces the whitespace with a single space
+	ChompCollapse
+	// ChompGreedy removes all whitespace, including newlines
+	ChompGreedy
+)
+
+// Whitespace controls how the whitespace around tags is removed from
+// templates, unless the tags have chomp markers of their own
+type Whitespace struct {
+	PreChomp  ChompMode // whitespace before each tag
+	PostChomp ChompMode // whitespace after each tag
+	// Trim removes the leading and trailing whitespace of templates,
+	// BLOCKs and MACROs
+	Trim bool
 }
 
 // Frame is the frame struct used during parsing, which has a bit of
@@ -109,9 +184,19 @@ type Frame struct {
 
 type Lexer struct {
 	lex.Lexer
-	tagStart string
-	tagEnd   string
-	symbols  *LexSymbolSet
+	tagStart  string
+	tagEnd    string
+	lineStart string // starts a line of code, if the syntax has one
+	inLine    bool   // true while lexing a line of code
+	bol       bool   // true if the next raw text begins a line
+	symbols   *LexSymbolSet
+}
+
+// Delimiters are the strings that separate template code from raw text
+type Delimiters struct {
+	TagStart  string
+	TagEnd    string
+	LineStart string // lines of code are disabled if empty
 }
 
 // LexSymbol holds the pre-defined symbols to be lexed
@@ -134,6 +219,7 @@ type LexSymbolSorter struct {
 type LexSymbolSet struct {
 	Map        map[string]LexSymbol
 	SortedList LexSymbolList
+	mutex      sync.Mutex // protects SortedList, which is lazily built
 }
 
 // Parser defines the interface for Xslate parsers
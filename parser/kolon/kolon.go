@@ -0,0 +1,88 @@
+// Package kolon implements the Kolon syntax of Text::Xslate, where
+// variables are written as `$foo` and statements use braces. A line
+// that starts with ':' is code:
+//
+//	: for $items -> $item {
+//	  <: $~item.count :>. <: $item.name :>
+//	: }
+package kolon
+
+import (
+	"io"
+
+	"github.com/lestrrat-go/xslate/parser"
+)
+
+// SymbolSet contains Kolon specific symbols
+var SymbolSet = parser.DefaultSymbolSet.Copy()
+
+func init() {
+	SymbolSet.Set("$", parser.ItemVariable)
+	SymbolSet.Set(";", parser.ItemSemicolon)
+	SymbolSet.Set("->", parser.ItemArrow, 1.0)
+	SymbolSet.Set("my", parser.ItemMy)
+	SymbolSet.Set("print", parser.ItemPrint)
+	SymbolSet.Set("print_raw", parser.ItemPrintRaw)
+	SymbolSet.Set("if", parser.ItemIf)
+	SymbolSet.Set("else", parser.ItemElse)
+	SymbolSet.Set("for", parser.ItemForeach)
+	SymbolSet.Set("while", parser.ItemWhile)
+	SymbolSet.Set("given", parser.ItemSwitch)
+	SymbolSet.Set("when", parser.ItemCase)
+	SymbolSet.Set("default", parser.ItemDefault)
+	SymbolSet.Set("last", parser.ItemLast)
+	SymbolSet.Set("next", parser.ItemNext)
+	SymbolSet.Set("include", parser.ItemInclude)
+	SymbolSet.Set("macro", parser.ItemMacro)
+	SymbolSet.Set("cascade", parser.ItemCascade)
+	SymbolSet.Set("block", parser.ItemBlock)
+	SymbolSet.Set("before", parser.ItemBefore)
+	SymbolSet.Set("after", parser.ItemAfter)
+	SymbolSet.Set("around", parser.ItemAround)
+	SymbolSet.Set("override", parser.ItemAround)
+	SymbolSet.Set("super", parser.ItemSuper)
+
+	parser.Register("Kolon", newParser)
+	// The name of the former TTerse based Kolon parser
+	parser.Register("Kolonish", newParser)
+}
+
+// Kolon is the main parser for Kolon. Its Delimiters may be changed
+// before parsing, for templates that use other tags, and Whitespace
+// for templates whose whitespace matters
+type Kolon struct {
+	parser.Syntax
+}
+
+// NewStringLexer creates a new lexer with the default delimiters
+func NewStringLexer(template string) *parser.Lexer {
+	return New().NewStringLexer(template)
+}
+
+// NewReaderLexer creates a new lexer with the default delimiters
+func NewReaderLexer(rdr io.Reader) *parser.Lexer {
+	return New().NewReaderLexer(rdr)
+}
+
+// New creates a new Kolon parser
+func New() *Kolon {
+	return &Kolon{
+		parser.Syntax{
+			Symbols: SymbolSet,
+			Delimiters: parser.Delimiters{
+				TagStart:  "<:",
+				TagEnd:    ":>",
+				LineStart: ":",
+			},
+		},
+	}
+}
+
+// newParser creates a Kolon parser configured with opts, for the registry
+func newParser(opts parser.Options) (parser.Parser, error) {
+	p := New()
+	if err := p.Configure(opts); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,157 @@
+package kolon
+
+import (
+	"github.com/lestrrat-go/lex"
+	"github.com/lestrrat-go/xslate/parser"
+	"testing"
+)
+
+func makeItem(t lex.ItemType, p, line int, v string) lex.LexItem {
+	return lex.NewItem(t, p, line, v)
+}
+
+func makeLexer(input string) *parser.Lexer {
+	l := NewStringLexer(input)
+	return l
+}
+
+func lexit(input string) *parser.Lexer {
+	l := makeLexer(input)
+	go l.Run()
+	return l
+}
+
+func compareLex(t *testing.T, expected []lex.LexItem, l *parser.Lexer) {
+	for n := 0; n < len(expected); n++ {
+		i := l.NextItem()
+
+		e := expected[n]
+		if e.Type() != i.Type() {
+			t.Errorf("Expected type %s, got %s", e.Type(), i.Type())
+			t.Logf("   -> expected %s got %s", e, i)
+		}
+		if e.Type() == parser.ItemIdentifier || e.Type() == parser.ItemRawString {
+			if e.Value() != i.Value() {
+				t.Errorf("Expected.Value()ue %s, got %s", e.Value(), i.Value())
+				t.Logf("   -> expected %s got %s", e, i)
+			}
+		}
+	}
+
+	i := l.NextItem()
+	if i.Type() != parser.ItemEOF {
+		t.Errorf("Expected EOF, got %s", i)
+	}
+
+}
+
+func TestGetImplicit(t *testing.T) {
+	tmpl := `<: $foo :>`
+	l := lexit(tmpl)
+	expected := []lex.LexItem{
+		makeItem(parser.ItemTagStart, 0, 1, "<:"),
+		makeItem(parser.ItemSpace, 2, 1, " "),
+		makeItem(parser.ItemVariable, 3, 1, "$foo"),
+		makeItem(parser.ItemSpace, 7, 1, " "),
+		makeItem(parser.ItemTagEnd, 8, 1, ":>"),
+	}
+	compareLex(t, expected, l)
+}
+
+func TestLinewiseCode(t *testing.T) {
+	tmpl := `
+: "foo\n"
+: for list -> i {
+:    i
+: }
+`
+	l := lexit(tmpl)
+	expected := []lex.LexItem{
+		makeItem(parser.ItemRawString, 0, 1, "\n"),
+		makeItem(parser.ItemTagStart, 1, 2, ":"),
+		makeItem(parser.ItemSpace, 2, 2, " "),
+		makeItem(parser.ItemDoubleQuotedString, 3, 2, `"foo\n"`),
+		makeItem(parser.ItemTagEnd, 10, 2, "\n"),
+		makeItem(parser.ItemTagStart, 11, 3, ":"),
+		makeItem(parser.ItemSpace, 12, 3, " "),
+		makeItem(parser.ItemForeach, 13, 3, "for"),
+		makeItem(parser.ItemSpace, 16, 3, " "),
+		makeItem(parser.ItemIdentifier, 17, 3, "list"),
+		makeItem(parser.ItemSpace, 21, 3, " "),
+		makeItem(parser.ItemArrow, 22, 3, "->"),
+		makeItem(parser.ItemSpace, 24, 3, " "),
+		makeItem(parser.ItemIdentifier, 25, 3, "i"),
+		makeItem(parser.ItemSpace, 26, 3, " "),
+		makeItem(parser.ItemOpenCurlyBracket, 27, 3, "{"),
+		makeItem(parser.ItemTagEnd, 28, 3, "\n"),
+		makeItem(parser.ItemTagStart, 29, 4, ":"),
+		makeItem(parser.ItemSpace, 30, 4, "    "),
+		makeItem(parser.ItemIdentifier, 34, 4, "i"),
+		makeItem(parser.ItemTagEnd, 35, 4, "\n"),
+		makeItem(parser.ItemTagStart, 36, 5, ":"),
+		makeItem(parser.ItemSpace, 37, 5, " "),
+		makeItem(parser.ItemCloseCurlyBracket, 38, 5, "}"),
+		makeItem(parser.ItemTagEnd, 39, 5, "\n"),
+	}
+	compareLex(t, expected, l)
+}
+
+func TestLinewiseCodeIndented(t *testing.T) {
+	tmpl := "<ul>\n  : for $list -> $i {\n  <li><: $i :></li>\n  : }\n</ul>"
+	l := lexit(tmpl)
+	expected := []lex.LexItem{
+		makeItem(parser.ItemRawString, 0, 1, "<ul>\n"),
+		makeItem(parser.ItemSpace, 5, 2, "  "),
+		makeItem(parser.ItemTagStart, 7, 2, ":"),
+		makeItem(parser.ItemSpace, 8, 2, " "),
+		makeItem(parser.ItemForeach, 9, 2, "for"),
+		makeItem(parser.ItemSpace, 12, 2, " "),
+		makeItem(parser.ItemVariable, 13, 2, "$list"),
+		makeItem(parser.ItemSpace, 18, 2, " "),
+		makeItem(parser.ItemArrow, 19, 2, "->"),
+		makeItem(parser.ItemSpace, 21, 2, " "),
+		makeItem(parser.ItemVariable, 22, 2, "$i"),
+		makeItem(parser.ItemSpace, 24, 2, " "),
+		makeItem(parser.ItemOpenCurlyBracket, 25, 2, "{"),
+		makeItem(parser.ItemTagEnd, 26, 2, "\n"),
+		makeItem(parser.ItemRawString, 27, 3, "  <li>"),
+		makeItem(parser.ItemTagStart, 33, 3, "<:"),
+		makeItem(parser.ItemSpace, 35, 3, " "),
+		makeItem(parser.ItemVariable, 36, 3, "$i"),
+		makeItem(parser.ItemSpace, 38, 3, " "),
+		makeItem(parser.ItemTagEnd, 39, 3, ":>"),
+		makeItem(parser.ItemRawString, 41, 3, "</li>\n"),
+		makeItem(parser.ItemSpace, 47, 4, "  "),
+		makeItem(parser.ItemTagStart, 49, 4, ":"),
+		makeItem(parser.ItemSpace, 50, 4, " "),
+		makeItem(parser.ItemCloseCurlyBracket, 51, 4, "}"),
+		makeItem(parser.ItemTagEnd, 52, 4, "\n"),
+		makeItem(parser.ItemRawString, 53, 5, "</ul>"),
+	}
+	compareLex(t, expected, l)
+}
+
+func TestLexLoopControl(t *testing.T) {
+	tmpl := `<: last :><: next :><: loop.next :>`
+	l := lexit(tmpl)
+	expected := []lex.LexItem{
+		makeItem(parser.ItemTagStart, 0, 1, "<:"),
+		makeItem(parser.ItemSpace, 2, 1, " "),
+		makeItem(parser.ItemLast, 3, 1, "last"),
+		makeItem(parser.ItemSpace, 7, 1, " "),
+		makeItem(parser.ItemTagEnd, 8, 1, ":>"),
+		makeItem(parser.ItemTagStart, 10, 1, "<:"),
+		makeItem(parser.ItemSpace, 12, 1, " "),
+		makeItem(parser.ItemNext, 13, 1, "next"),
+		makeItem(parser.ItemSpace, 17, 1, " "),
+		makeItem(parser.ItemTagEnd, 18, 1, ":>"),
+		makeItem(parser.ItemTagStart, 20, 1, "<:"),
+		makeItem(parser.ItemSpace, 22, 1, " "),
+		makeItem(parser.ItemIdentifier, 23, 1, "loop"),
+		makeItem(parser.ItemPeriod, 27, 1, "."),
+		makeItem(parser.ItemNext, 28, 1, "next"),
+		makeItem(parser.ItemSpace, 32, 1, " "),
+		makeItem(parser.ItemTagEnd, 33, 1, ":>"),
+	}
+	compareLex(t, expected, l)
+}
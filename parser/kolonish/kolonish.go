@@ -1,70 +1,42 @@
+// Package kolonish is the former home of the Kolon parser, which only
+// approximated Kolon by reusing TTerse with different tags. It is kept
+// so that existing code continues to build.
+//
+// Deprecated: use github.com/lestrrat-go/xslate/parser/kolon instead.
 package kolonish
 
 import (
-	"github.com/lestrrat-go/lex"
-	"github.com/lestrrat-go/xslate/parser"
 	"io"
-)
 
-const (
-	ItemDollar lex.ItemType = parser.DefaultItemTypeMax + 1
+	"github.com/lestrrat-go/xslate/parser"
+	"github.com/lestrrat-go/xslate/parser/kolon"
 )
 
-var SymbolSet = parser.DefaultSymbolSet.Copy()
+// ItemDollar is the type of Kolon variables, such as `$foo`
+const ItemDollar = parser.ItemVariable
 
-func init() {
-	SymbolSet.Set("$", ItemDollar)
-}
+// SymbolSet contains Kolon specific symbols
+var SymbolSet = kolon.SymbolSet
 
-// Kolonish is the main parser for Kolonish
-type Kolonish struct{}
+// Kolonish is the Kolon parser
+type Kolonish = kolon.Kolon
 
 // NewStringLexer creates a new lexer
 func NewStringLexer(template string) *parser.Lexer {
-	l := parser.NewStringLexer(template, SymbolSet)
-	l.SetTagStart("<:")
-	l.SetTagEnd(":>")
-
-	return l
+	return kolon.NewStringLexer(template)
 }
 
 // NewReaderLexer creates a new lexer
 func NewReaderLexer(rdr io.Reader) *parser.Lexer {
-	l := parser.NewReaderLexer(rdr, SymbolSet)
-	l.SetTagStart("<:")
-	l.SetTagEnd(":>")
-
-	return l
-}
-
-// New creates a new Kolonish parser
-func New() *Kolonish {
-	return &Kolonish{}
+	return kolon.NewReaderLexer(rdr)
 }
 
+// NewLexer is the same as NewStringLexer
 func NewLexer(template string) *parser.Lexer {
-	l := parser.NewStringLexer(template, SymbolSet)
-	l.SetTagStart("<:")
-	l.SetTagEnd(":>")
-
-	return l
-}
-
-// Parse parses the given template and creates an AST
-func (p *Kolonish) Parse(name string, template []byte) (*parser.AST, error) {
-	return p.ParseString(name, string(template))
+	return kolon.NewStringLexer(template)
 }
 
-// ParseString is the same as Parse, but receives a string instead of []byte
-func (p *Kolonish) ParseString(name, template string) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewStringLexer(template)
-	return b.Parse(name, lex)
-}
-
-// ParseReader gets the template content from an io.Reader type
-func (p *Kolonish) ParseReader(name string, rdr io.Reader) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewReaderLexer(rdr)
-	return b.Parse(name, lex)
+// New creates a new Kolon parser
+func New() *Kolonish {
+	return kolon.New()
 }
@@ -89,6 +89,39 @@ func init() {
 	lex.TypeNames[ItemIncr] = "Incr"
 	lex.TypeNames[ItemDecr] = "Decr"
 	lex.TypeNames[ItemMod] = "Mod"
+	lex.TypeNames[ItemNot] = "Not"
+	lex.TypeNames[ItemDefinedOr] = "DefinedOr"
+	lex.TypeNames[ItemLowAnd] = "LowAnd"
+	lex.TypeNames[ItemLowOr] = "LowOr"
+	lex.TypeNames[ItemLowNot] = "LowNot"
+	lex.TypeNames[ItemStrLT] = "StrLessThan"
+	lex.TypeNames[ItemStrGT] = "StrGreaterThan"
+	lex.TypeNames[ItemStrLE] = "StrLessThanEquals"
+	lex.TypeNames[ItemStrGE] = "StrGreaterThanEquals"
+	lex.TypeNames[ItemStrCmp] = "StrCmp"
+	lex.TypeNames[ItemStrEquals] = "StrEquals"
+	lex.TypeNames[ItemStrNotEquals] = "StrNotEquals"
+	lex.TypeNames[ItemTilde] = "Tilde"
+	lex.TypeNames[ItemQuestion] = "Question"
+	lex.TypeNames[ItemColon] = "Colon"
+	lex.TypeNames[ItemOpenCurlyBracket] = "OpenCurlyBracket"
+	lex.TypeNames[ItemCloseCurlyBracket] = "CloseCurlyBracket"
+	lex.TypeNames[ItemLast] = "Last"
+	lex.TypeNames[ItemNext] = "Next"
+	lex.TypeNames[ItemImport] = "Import"
+	lex.TypeNames[ItemProcess] = "Process"
+	lex.TypeNames[ItemCascade] = "Cascade"
+	lex.TypeNames[ItemBefore] = "Before"
+	lex.TypeNames[ItemAfter] = "After"
+	lex.TypeNames[ItemAround] = "Around"
+	lex.TypeNames[ItemSuper] = "Super"
+	lex.TypeNames[ItemArrow] = "Arrow"
+	lex.TypeNames[ItemInto] = "Into"
+	lex.TypeNames[ItemVariable] = "Variable"
+	lex.TypeNames[ItemSemicolon] = "Semicolon"
+	lex.TypeNames[ItemMy] = "My"
+	lex.TypeNames[ItemPrint] = "Print"
+	lex.TypeNames[ItemPrintRaw] = "PrintRaw"
 	lex.TypeNames[ItemEnd] = "End"
 }
 
@@ -100,6 +133,19 @@ func (l *Lexer) SetTagEnd(s string) {
 	l.tagEnd = s
 }
 
+// SetLineStart enables lines of code: a line that begins with s, after
+// optional indentation, is lexed as a tag that ends with the line
+func (l *Lexer) SetLineStart(s string) {
+	l.lineStart = s
+}
+
+// SetDelimiters sets the tag start, tag end, and line start at once
+func (l *Lexer) SetDelimiters(d Delimiters) {
+	l.SetTagStart(d.TagStart)
+	l.SetTagEnd(d.TagEnd)
+	l.SetLineStart(d.LineStart)
+}
+
 func isSpace(r rune) bool {
 	return r == ' ' || r == '\t'
 }
@@ -116,16 +162,20 @@ func isChar(r rune) bool {
 	return r <= unicode.MaxASCII && unicode.IsPrint(r)
 }
 
+// isIdentifierStart reports whether c may start a variable name that
+// is interpolated into a double quoted string
+func isIdentifierStart(c byte) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
 func isNumeric(r rune) bool {
 	return '0' <= r && r <= '9'
 }
 
 func NewStringLexer(template string, ss *LexSymbolSet) *Lexer {
 	l := &Lexer{
-		nil,
-		"",
-		"",
-		ss,
+		bol:     true,
+		symbols: ss,
 	}
 	l.Lexer = lex.NewStringLexer(template, l.lexRawString)
 	return l
@@ -133,26 +183,31 @@ func NewStringLexer(template string, ss *LexSymbolSet) *Lexer {
 
 func NewReaderLexer(rdr io.Reader, ss *LexSymbolSet) *Lexer {
 	l := &Lexer{
-		nil,
-		"",
-		"",
-		ss,
+		bol:     true,
+		symbols: ss,
 	}
 	l.Lexer = lex.NewReaderLexer(rdr, l.lexRawString)
 	return l
 }
 
 func (sl *Lexer) lexRawString(l lex.Lexer) lex.LexFn {
+	bol := sl.bol
+	sl.bol = false
 	for {
+		if bol && sl.lineStart != "" && sl.scanLineStart() {
+			return sl.lexLineStart
+		}
 		if sl.PeekString(sl.tagStart) {
 			if len(l.BufferString()) > 0 {
 				sl.Emit(ItemRawString)
 			}
 			return sl.lexTagStart
 		}
-		if sl.Next() == lex.EOF {
+		r := sl.Next()
+		if r == lex.EOF {
 			break
 		}
+		bol = r == '\n'
 	}
 
 	if len(sl.BufferString()) > 0 {
@@ -169,7 +224,7 @@ func (sl *Lexer) lexSpace(l lex.Lexer) lex.LexFn {
 	count := 0
 	for {
 		r := l.Peek()
-		if !isSpace(r) {
+		if !isSpace(r) && (!isEndOfLine(r) || sl.inLine) {
 			break
 		}
 		count++
@@ -190,7 +245,66 @@ func (sl *Lexer) lexTagStart(l lex.Lexer) lex.LexFn {
 	return sl.lexInsideTag
 }
 
+// scanLineStart is called at the beginning of each line of raw text,
+// and returns true if the line is code. The raw text before the line
+// is emitted, and so is the indentation of the line of code, as space
+func (sl *Lexer) scanLineStart() bool {
+	if !isSpace(sl.Peek()) && !sl.atLineStart() {
+		return false
+	}
+
+	if len(sl.BufferString()) > 0 {
+		sl.Emit(ItemRawString)
+	}
+	sl.AcceptRun(" \t")
+	if !sl.atLineStart() {
+		// Just an indented line. The indentation is part of the raw text
+		return false
+	}
+	if len(sl.BufferString()) > 0 {
+		sl.Emit(ItemSpace)
+	}
+	return true
+}
+
+// atLineStart returns true if a line of code starts here. When the tag
+// start also matches, the longer of the two wins
+func (sl *Lexer) atLineStart() bool {
+	if !sl.PeekString(sl.lineStart) {
+		return false
+	}
+	return len(sl.tagStart) <= len(sl.lineStart) || !sl.PeekString(sl.tagStart)
+}
+
+func (sl *Lexer) lexLineStart(l lex.Lexer) lex.LexFn {
+	sl.AcceptString(sl.lineStart)
+	sl.Emit(ItemTagStart)
+	sl.inLine = true
+	return sl.lexInsideTag
+}
+
+// atTagEnd returns true if the current tag ends here. Lines of code
+// end with the line, or the template
+func (sl *Lexer) atTagEnd() bool {
+	if sl.inLine {
+		r := sl.Peek()
+		return r == lex.EOF || isEndOfLine(r)
+	}
+	return sl.PeekString(sl.tagEnd)
+}
+
 func (sl *Lexer) lexTagEnd(l lex.Lexer) lex.LexFn {
+	if sl.inLine {
+		// The newline belongs to the code, and is not printed
+		if !sl.AcceptString("\r\n") && !sl.AcceptString("\n") {
+			sl.AcceptString("\r")
+		}
+		sl.Emit(ItemTagEnd)
+		sl.inLine = false
+		sl.bol = true
+		return sl.lexRawString
+	}
+
 	if !sl.AcceptString(sl.tagEnd) {
 		sl.EmitErrorf("Expected tag end (%s)", sl.tagEnd)
 	}
@@ -228,13 +342,33 @@ Loop:
 	return sl.lexInsideTag
 }
 
+// lexVariable lexes the name of a variable, after its sigil (`$` in
+// Kolon). The loop variable of `$item` is `$~item`
+func (sl *Lexer) lexVariable(l lex.Lexer) lex.LexFn {
+	sl.AcceptAny("~")
+	if r := sl.Peek(); !isAlphaNumeric(r) || isNumeric(r) {
+		return sl.EmitErrorf("bad variable name: %q", sl.BufferString())
+	}
+	for isAlphaNumeric(sl.Peek()) {
+		sl.Next()
+	}
+	if !sl.atTerminator() {
+		return sl.EmitErrorf("bad character %#U", sl.Peek())
+	}
+	sl.Emit(ItemVariable)
+	return sl.lexInsideTag
+}
+
 func (l *Lexer) atTerminator() bool {
 	r := l.Peek()
 	if isSpace(r) || isEndOfLine(r) {
 		return true
 	}
 	switch r {
-	case lex.EOF, '.', ',', '|', ':', ')', '(', '[', ']':
+	case lex.EOF, '.', ',', '|', ':', ';', ')', '(', '[', ']', '{', '}':
+		return true
+	case '+', '-', '*', '/', '%', '=', '!', '<', '>', '~', '?', '&':
+		// operators, as in "i++" or "x+1"
 		return true
 	}
 	// Does r start the delimiter? This can be ambiguous (with delim=="//", $x/2 will
@@ -275,15 +409,6 @@ func (sl *Lexer) lexNumber(l lex.Lexer) lex.LexFn {
 		return sl.EmitErrorf("bad number syntax: %q", sl.BufferString())
 	}
 
-	/* XXX Remove complex number support
-	   if sign := sl.Peek(); sign == '+' || sign == '-' {
-	     // Complex: 1+2i. No spaces, must end in 'i'.
-	     if !sl.scanNumber() || sl.PrevByte() != 'i' {
-	       return sl.EmitErrorf("bad number syntax: %q", sl.BufferString())
-	     }
-	     sl.Emit(ItemComplex)
-	   } else
-	*/
 	if dot := sl.Peek(); dot == '.' {
 		sl.Emit(ItemNumber)
 		return sl.lexRange
@@ -300,63 +425,139 @@ func (l *Lexer) scanInteger() bool {
 	return ret
 }
 
+// scanNumber scans a decimal, hex (0x), octal (0o or a leading 0) or
+// binary (0b) integer, or a decimal float with an optional exponent.
+// Digits may be separated by underscores, which are checked by the parser
 func (l *Lexer) scanNumber() bool {
 	// Optional leading sign.
 	l.AcceptAny("+-")
-	// Is it hex?
-	digits := "0123456789"
-	if l.AcceptAny("0") && l.AcceptAny("xX") {
-		digits = "0123456789abcdefABCDEF"
+
+	if l.AcceptAny("0") {
+		digits := ""
+		switch {
+		case l.AcceptAny("xX"):
+			digits = "0123456789abcdefABCDEF_"
+		case l.AcceptAny("oO"):
+			digits = "01234567_"
+		case l.AcceptAny("bB"):
+			digits = "01_"
+		}
+		if digits != "" {
+			if !l.AcceptRun(digits) {
+				return false
+			}
+			return !l.rejectAlphaNumeric()
+		}
 	}
+
+	digits := "0123456789_"
 	l.AcceptRun(digits)
 	if l.AcceptString(".") {
 		if !l.AcceptRun(digits) {
+			// Not a fraction, but the start of a range (1..5)
 			l.Backup()
+			return true
 		}
-		return true
 	}
 	if l.AcceptAny("eE") {
 		l.AcceptAny("+-")
-		l.AcceptRun("0123456789")
+		if !l.AcceptRun(digits) {
+			return false
+		}
 	}
-	// Is it imaginary?
-	l.AcceptString("i")
-	// Next thing mustn't be alphanumeric.
+	return !l.rejectAlphaNumeric()
+}
+
+// rejectAlphaNumeric consumes the next rune and returns true if it is
+// alphanumeric, which means that the number that was just scanned is
+// not followed by a proper delimiter
+func (l *Lexer) rejectAlphaNumeric() bool {
 	if isAlphaNumeric(l.Peek()) {
 		l.Next()
-		return false
+		return true
 	}
-	return true
+	return false
 }
 
 func (sl *Lexer) lexComment(l lex.Lexer) lex.LexFn {
 	for {
-		if sl.PeekString(sl.tagEnd) {
+		if sl.atTagEnd() {
 			sl.Emit(ItemComment)
 			return sl.lexTagEnd
 		}
-		if isEndOfLine(sl.Next()) {
+		switch r := sl.Next(); {
+		case r == lex.EOF:
+			return sl.EmitErrorf("unclosed tag")
+		case isEndOfLine(r):
+			// The tag may go on in the next line
 			sl.Emit(ItemComment)
-			return sl.lexTagEnd
+			return sl.lexInsideTag
 		}
 	}
 }
 
 func (sl *Lexer) lexQuotedString(l lex.Lexer, quote rune, t lex.ItemType) lex.LexFn {
+	if !sl.skipQuoted(quote) {
+		return sl.EmitErrorf("unexpected end of quoted string")
+	}
+	sl.Emit(t)
+	return sl.lexInsideTag
+}
+
+// skipQuoted consumes a string up to and including the closing quote.
+// In double quoted strings, the `${...}` expressions are skipped as a
+// whole, so that they may contain quotes and braces of their own
+func (sl *Lexer) skipQuoted(quote rune) bool {
 	for {
-		if sl.PeekString(sl.tagEnd) {
-			return sl.EmitErrorf("unexpected end of quoted string")
+		if sl.atTagEnd() {
+			return false
 		}
 
-		r := sl.Next()
-		switch r {
+		switch sl.Next() {
 		case quote:
-			sl.Emit(t)
-			return sl.lexInsideTag
+			return true
+		case '\\':
+			// Escape sequences are expanded by the parser. Here we only
+			// need to make sure that an escaped quote does not end the
+			// string
+			if quote == '"' && sl.Peek() != lex.EOF {
+				sl.Next()
+			}
+		case '$':
+			if quote == '"' && sl.Peek() == '{' {
+				sl.Next()
+				if !sl.skipInterpolation() {
+					return false
+				}
+			}
+		case lex.EOF:
+			return false
+		}
+	}
+}
+
+// skipInterpolation consumes the expression of a `${...}`, up to and
+// including the matching '}'
+func (sl *Lexer) skipInterpolation() bool {
+	for depth := 1; depth > 0; {
+		if sl.atTagEnd() {
+			return false
+		}
+
+		switch r := sl.Next(); r {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '"', '\'':
+			if !sl.skipQuoted(r) {
+				return false
+			}
 		case lex.EOF:
-			return sl.EmitErrorf("unexpected end of quoted string")
+			return false
 		}
 	}
+	return true
 }
 
 func (sl *Lexer) lexDoubleQuotedString(l lex.Lexer) lex.LexFn {
@@ -375,13 +576,21 @@ func (sl *Lexer) lexInsideTag(l lex.Lexer) lex.LexFn {
 	guard := lex.Mark("lexInsideTag")
 	defer guard()
 
-	if sl.PeekString(sl.tagEnd) {
+	if sl.atTagEnd() {
 		return sl.lexTagEnd
 	}
 
-	// Find registered symbols
+	// Find registered symbols. Symbols that are words (e.g. "eq", "IN")
+	// are only recognized as whole words by lexIdentifier, so that
+	// identifiers such as "equal" or "index" are not split up
 	for _, sym := range sl.getSortedSymbols() {
+		if isAlphaNumeric(rune(sym.Name[0])) {
+			continue
+		}
 		if sl.AcceptString(sym.Name) {
+			if sym.Type == ItemVariable {
+				return sl.lexVariable
+			}
 			sl.Emit(sym.Type)
 			return sl.lexInsideTag
 		}
@@ -394,7 +603,7 @@ func (sl *Lexer) lexInsideTag(l lex.Lexer) lex.LexFn {
 		return sl.EmitErrorf("unclosed tag")
 	case r == '#':
 		return sl.lexComment
-	case isSpace(r):
+	case isSpace(r), isEndOfLine(r):
 		sl.Backup()
 		return sl.lexSpace
 	case isNumeric(r):
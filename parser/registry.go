@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"sort"
+	"sync"
+)
+
+// Options are the options given to a Factory. They come from the
+// "Parser" argument of xslate.New(), and include "Syntax"
+type Options interface {
+	Get(string) (interface{}, bool)
+}
+
+// Factory creates a Parser for a syntax, configured with opts
+type Factory func(opts Options) (Parser, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register makes a syntax available by name, so that it can be chosen
+// with the "Syntax" option of the parser. Syntaxes are usually
+// registered from the init() of the package that implements them.
+// Register panics if the name is already taken, or factory is nil.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if factory == nil {
+		panic("parser: Register factory for syntax " + name + " is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic("parser: Register called twice for syntax " + name)
+	}
+	factories[name] = factory
+}
+
+// Lookup returns the Factory registered for the syntax `name`
+func Lookup(name string) (Factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	factory, ok := factories[name]
+	return factory, ok
+}
+
+// Syntaxes returns the sorted names of the registered syntaxes
+func Syntaxes() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
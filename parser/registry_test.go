@@ -0,0 +1,46 @@
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegister(t *testing.T) {
+	factory := func(opts Options) (Parser, error) {
+		return &Syntax{Symbols: DefaultSymbolSet}, nil
+	}
+	Register("test-registry-b", factory)
+	Register("test-registry-a", factory)
+
+	if _, ok := Lookup("test-registry-a"); !ok {
+		t.Errorf("Expected test-registry-a to be registered")
+	}
+	if _, ok := Lookup("test-registry-c"); ok {
+		t.Errorf("Expected test-registry-c to not be registered")
+	}
+
+	var names []string
+	for _, name := range Syntaxes() {
+		if name == "test-registry-a" || name == "test-registry-b" {
+			names = append(names, name)
+		}
+	}
+	if expected := []string{"test-registry-a", "test-registry-b"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected %v, got %v", expected, names)
+	}
+
+	for _, f := range []Factory{factory, nil} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected Register to panic")
+				}
+			}()
+			name := "test-registry-a"
+			if f == nil {
+				name = "test-registry-nil"
+			}
+			Register(name, f)
+		}()
+	}
+}
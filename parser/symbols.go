@@ -11,17 +11,23 @@ var DefaultSymbolSet = NewLexSymbolSet()
 
 func init() {
 	DefaultSymbolSet.Set("==", ItemEquals, 1.0)
-	DefaultSymbolSet.Set("eq", ItemEquals, 0.0)
+	DefaultSymbolSet.Set("eq", ItemStrEquals, 0.0)
 	DefaultSymbolSet.Set("!=", ItemNotEquals, 1.0)
-	DefaultSymbolSet.Set("ne", ItemNotEquals, 0.0)
+	DefaultSymbolSet.Set("ne", ItemStrNotEquals, 0.0)
 	DefaultSymbolSet.Set("+=", ItemAssignAdd, 1.0)
 	DefaultSymbolSet.Set("-=", ItemAssignSub, 1.0)
 	DefaultSymbolSet.Set("*=", ItemAssignMul, 1.0)
 	DefaultSymbolSet.Set("/=", ItemAssignDiv, 1.0)
+	DefaultSymbolSet.Set("%=", ItemAssignMod, 1.0)
+	DefaultSymbolSet.Set("++", ItemIncr, 1.0)
+	DefaultSymbolSet.Set("--", ItemDecr, 1.0)
 	DefaultSymbolSet.Set("(", ItemOpenParen, 0.0)
 	DefaultSymbolSet.Set(")", ItemCloseParen, 0.0)
 	DefaultSymbolSet.Set("[", ItemOpenSquareBracket, 0.0)
 	DefaultSymbolSet.Set("]", ItemCloseSquareBracket, 0.0)
+	DefaultSymbolSet.Set("{", ItemOpenCurlyBracket, 0.0)
+	DefaultSymbolSet.Set("}", ItemCloseCurlyBracket, 0.0)
+	DefaultSymbolSet.Set("=>", ItemFatComma, 1.0)
 	DefaultSymbolSet.Set("..", ItemRange, 1.0)
 	DefaultSymbolSet.Set(".", ItemPeriod, 0.0)
 	DefaultSymbolSet.Set(",", ItemComma, 0.0)
@@ -29,10 +35,29 @@ func init() {
 	DefaultSymbolSet.Set("=", ItemAssign, 0.0)
 	DefaultSymbolSet.Set(">", ItemGT, 0.0)
 	DefaultSymbolSet.Set("<", ItemLT, 0.0)
+	DefaultSymbolSet.Set(">=", ItemGE, 1.0)
+	DefaultSymbolSet.Set("<=", ItemLE, 1.0)
+	DefaultSymbolSet.Set("<=>", ItemCmp, 2.0)
+	DefaultSymbolSet.Set("lt", ItemStrLT, 0.0)
+	DefaultSymbolSet.Set("gt", ItemStrGT, 0.0)
+	DefaultSymbolSet.Set("le", ItemStrLE, 0.0)
+	DefaultSymbolSet.Set("ge", ItemStrGE, 0.0)
+	DefaultSymbolSet.Set("cmp", ItemStrCmp, 0.0)
 	DefaultSymbolSet.Set("+", ItemPlus, 0.0)
 	DefaultSymbolSet.Set("-", ItemMinus, 0.0)
 	DefaultSymbolSet.Set("*", ItemAsterisk, 0.0)
 	DefaultSymbolSet.Set("/", ItemSlash, 0.0)
+	DefaultSymbolSet.Set("%", ItemMod, 0.0)
+	DefaultSymbolSet.Set("~", ItemTilde, 0.0)
+	DefaultSymbolSet.Set("?", ItemQuestion, 0.0)
+	DefaultSymbolSet.Set(":", ItemColon, 0.0)
+	DefaultSymbolSet.Set("&&", ItemAnd, 1.0)
+	DefaultSymbolSet.Set("||", ItemOr, 1.0)
+	DefaultSymbolSet.Set("//", ItemDefinedOr, 1.0)
+	DefaultSymbolSet.Set("!", ItemNot, 0.0)
+	DefaultSymbolSet.Set("and", ItemLowAnd, 0.0)
+	DefaultSymbolSet.Set("or", ItemLowOr, 0.0)
+	DefaultSymbolSet.Set("not", ItemLowNot, 0.0)
 }
 
 // Sort returns a sorted list of LexSymbols, sorted by Priority
@@ -62,8 +87,8 @@ func (s LexSymbolSorter) Swap(i, j int) {
 // NewLexSymbolSet creates a new LexSymbolSet
 func NewLexSymbolSet() *LexSymbolSet {
 	return &LexSymbolSet{
-		make(map[string]LexSymbol),
-		nil,
+		Map:        make(map[string]LexSymbol),
+		SortedList: nil,
 	}
 }
 
@@ -94,6 +119,9 @@ func (l *LexSymbolSet) Set(name string, typ lex.ItemType, prio ...float32) {
 	} else {
 		x = prio[0]
 	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	l.Map[name] = LexSymbol{name, typ, x}
 	l.SortedList = nil // reset
 }
@@ -108,6 +136,12 @@ func (l *LexSymbolSet) GetSortedList() LexSymbolList {
 	// max-length forces us to make more comparisons than necessary.
 	// To get the best of both world, we allow passing a floating point
 	// "priority" parameter to sort the symbols
+	//
+	// Multiple parsers may be sharing the same LexSymbolSet, so the
+	// list must be built while holding the lock
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
 	if l.SortedList != nil {
 		return l.SortedList
 	}
@@ -0,0 +1,116 @@
+package parser
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Syntax is a Parser that lexes templates with its own symbols and
+// delimiters, and builds the AST with the Builder. TTerse and Kolon are
+// both built on it, and so can other syntaxes.
+type Syntax struct {
+	Symbols    *LexSymbolSet
+	Delimiters Delimiters
+	Whitespace Whitespace
+}
+
+// NewStringLexer creates a new lexer that uses the symbols and
+// delimiters of s
+func (s *Syntax) NewStringLexer(template string) *Lexer {
+	l := NewStringLexer(template, s.Symbols)
+	l.SetDelimiters(s.Delimiters)
+	return l
+}
+
+// NewReaderLexer creates a new lexer that uses the symbols and
+// delimiters of s
+func (s *Syntax) NewReaderLexer(rdr io.Reader) *Lexer {
+	l := NewReaderLexer(rdr, s.Symbols)
+	l.SetDelimiters(s.Delimiters)
+	return l
+}
+
+// Parse parses the given template and creates an AST
+func (s *Syntax) Parse(name string, template []byte) (*AST, error) {
+	return s.ParseString(name, string(template))
+}
+
+// ParseString is the same as Parse, but receives a string instead of []byte
+func (s *Syntax) ParseString(name, template string) (*AST, error) {
+	b := NewBuilder()
+	b.Whitespace = s.Whitespace
+	return b.Parse(name, template, s.NewStringLexer(template))
+}
+
+// ParseReader gets the template content from an io.Reader type
+func (s *Syntax) ParseReader(name string, rdr io.Reader) (*AST, error) {
+	// The whole template is read in so that the parser and compiler can
+	// map positions in the template to lines and columns
+	template, err := ioutil.ReadAll(rdr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read template")
+	}
+	return s.ParseString(name, string(template))
+}
+
+// Configure changes the delimiters and the whitespace handling of s
+// with the following options, if they are given:
+//
+//   - TagStart, TagEnd: strings that start and end a tag
+//   - LineStart: string that starts a line of code. An empty string
+//     disables lines of code
+//   - PreChomp, PostChomp: ChompMode (or the equivalent int) for the
+//     whitespace before and after each tag
+//   - Trim: bool, to remove the leading and trailing whitespace of
+//     templates, BLOCKs and MACROs
+func (s *Syntax) Configure(opts Options) error {
+	for key, dst := range map[string]*string{
+		"TagStart":  &s.Delimiters.TagStart,
+		"TagEnd":    &s.Delimiters.TagEnd,
+		"LineStart": &s.Delimiters.LineStart,
+	} {
+		tmp, ok := opts.Get(key)
+		if !ok {
+			continue
+		}
+		v, ok := tmp.(string)
+		if !ok || (v == "" && key != "LineStart") {
+			return errors.Errorf("Parser option '%s' must be a non-empty string", key)
+		}
+		*dst = v
+	}
+
+	for key, dst := range map[string]*ChompMode{
+		"PreChomp":  &s.Whitespace.PreChomp,
+		"PostChomp": &s.Whitespace.PostChomp,
+	} {
+		tmp, ok := opts.Get(key)
+		if !ok {
+			continue
+		}
+		var v ChompMode
+		switch tmp := tmp.(type) {
+		case ChompMode:
+			v = tmp
+		case int:
+			v = ChompMode(tmp)
+		default:
+			v = -1
+		}
+		if v < ChompNone || v > ChompGreedy {
+			return errors.Errorf("Parser option '%s' must be a parser.ChompMode", key)
+		}
+		*dst = v
+	}
+
+	if tmp, ok := opts.Get("Trim"); ok {
+		v, ok := tmp.(bool)
+		if !ok {
+			return errors.New("Parser option 'Trim' must be a bool")
+		}
+		s.Whitespace.Trim = v
+	}
+	return nil
+}
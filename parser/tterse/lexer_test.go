@@ -274,3 +274,40 @@ func TestBareQuotedString(t *testing.T) {
 	}
 	compareLex(t, expected, l)
 }
+
+func TestLexLogicalOperators(t *testing.T) {
+	tmpl := `[% a && !b || c // d and not order or e %]`
+	l := lexit(tmpl)
+
+	expected := []lex.LexItem{
+		tagStart,
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "a"),
+		space,
+		makeItem(parser.ItemAnd, 0, 1, ""),
+		space,
+		makeItem(parser.ItemNot, 0, 1, ""),
+		makeItem(parser.ItemIdentifier, 0, 1, "b"),
+		space,
+		makeItem(parser.ItemOr, 0, 1, ""),
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "c"),
+		space,
+		makeItem(parser.ItemDefinedOr, 0, 1, ""),
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "d"),
+		space,
+		makeItem(parser.ItemLowAnd, 0, 1, ""),
+		space,
+		makeItem(parser.ItemLowNot, 0, 1, ""),
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "order"),
+		space,
+		makeItem(parser.ItemLowOr, 0, 1, ""),
+		space,
+		makeItem(parser.ItemIdentifier, 0, 1, "e"),
+		space,
+		tagEnd,
+	}
+	compareLex(t, expected, l)
+}
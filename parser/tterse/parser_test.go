@@ -114,3 +114,18 @@ func TestSimpleAssign(t *testing.T) {
 
 	matchNodeTypes(t, ast, expected)
 }
+
+func TestSwitch(t *testing.T) {
+	tmpl := `[% SWITCH x %][% CASE 'a' %]A[% CASE %]B[% END %]`
+	ast := parse(t, tmpl)
+
+	expected := []node.NodeType{
+		node.Root,
+		node.Switch,
+		node.FetchSymbol,
+		node.Case,
+		node.Case,
+	}
+
+	matchNodeTypes(t, ast, expected)
+}
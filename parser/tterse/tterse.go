@@ -1,8 +1,9 @@
 package tterse
 
 import (
-	"github.com/lestrrat-go/xslate/parser"
 	"io"
+
+	"github.com/lestrrat-go/xslate/parser"
 )
 
 // SymbolSet contains TTerse specific symbols
@@ -22,54 +23,64 @@ func init() {
 	SymbolSet.Set("ELSIF", parser.ItemElseIf)
 	SymbolSet.Set("ELSE", parser.ItemElse)
 	SymbolSet.Set("UNLESS", parser.ItemUnless)
+	SymbolSet.Set("SWITCH", parser.ItemSwitch)
+	SymbolSet.Set("CASE", parser.ItemCase)
+	SymbolSet.Set("DEFAULT", parser.ItemDefault)
 	SymbolSet.Set("FOREACH", parser.ItemForeach)
 	SymbolSet.Set("WHILE", parser.ItemWhile)
+	SymbolSet.Set("LAST", parser.ItemLast)
+	SymbolSet.Set("NEXT", parser.ItemNext)
 	SymbolSet.Set("MACRO", parser.ItemMacro)
+	SymbolSet.Set("IMPORT", parser.ItemImport)
+	SymbolSet.Set("PROCESS", parser.ItemProcess)
+	SymbolSet.Set("CASCADE", parser.ItemCascade)
+	SymbolSet.Set("BEFORE", parser.ItemBefore)
+	SymbolSet.Set("AFTER", parser.ItemAfter)
+	SymbolSet.Set("AROUND", parser.ItemAround)
+	SymbolSet.Set("SUPER", parser.ItemSuper)
+	SymbolSet.Set(";", parser.ItemSemicolon)
+	SymbolSet.Set("INTO", parser.ItemInto)
 	SymbolSet.Set("BLOCK", parser.ItemBlock)
 	SymbolSet.Set("END", parser.ItemEnd)
+
+	parser.Register("TTerse", newParser)
 }
 
-// TTerse is the main parser for TTerse
-type TTerse struct{}
+// TTerse is the main parser for TTerse. Its Delimiters may be changed
+// before parsing, for templates that use other tags, and Whitespace
+// for templates whose whitespace matters
+type TTerse struct {
+	parser.Syntax
+}
 
-// NewStringLexer creates a new lexer
+// NewStringLexer creates a new lexer with the default delimiters
 func NewStringLexer(template string) *parser.Lexer {
-	l := parser.NewStringLexer(template, SymbolSet)
-	l.SetTagStart("[%")
-	l.SetTagEnd("%]")
-
-	return l
+	return New().NewStringLexer(template)
 }
 
-// NewReaderLexer creates a new lexer
+// NewReaderLexer creates a new lexer with the default delimiters
 func NewReaderLexer(rdr io.Reader) *parser.Lexer {
-	l := parser.NewReaderLexer(rdr, SymbolSet)
-	l.SetTagStart("[%")
-	l.SetTagEnd("%]")
-
-	return l
+	return New().NewReaderLexer(rdr)
 }
 
 // New creates a new TTerse parser
 func New() *TTerse {
-	return &TTerse{}
-}
-
-// Parse parses the given template and creates an AST
-func (p *TTerse) Parse(name string, template []byte) (*parser.AST, error) {
-	return p.ParseString(name, string(template))
-}
-
-// ParseString is the same as Parse, but receives a string instead of []byte
-func (p *TTerse) ParseString(name, template string) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewStringLexer(template)
-	return b.Parse(name, lex)
+	return &TTerse{
+		parser.Syntax{
+			Symbols: SymbolSet,
+			Delimiters: parser.Delimiters{
+				TagStart: "[%",
+				TagEnd:   "%]",
+			},
+		},
+	}
 }
 
-// ParseReader gets the template content from an io.Reader type
-func (p *TTerse) ParseReader(name string, rdr io.Reader) (*parser.AST, error) {
-	b := parser.NewBuilder()
-	lex := NewReaderLexer(rdr)
-	return b.Parse(name, lex)
+// newParser creates a TTerse parser configured with opts, for the registry
+func newParser(opts parser.Options) (parser.Parser, error) {
+	p := New()
+	if err := p.Configure(opts); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
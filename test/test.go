@@ -73,7 +73,7 @@ func (f *File) WriteString(body string) {
 	f.Mkdir()
 
 	fullpath := f.FullPath()
-	fh, err := os.OpenFile(fullpath, os.O_CREATE|os.O_WRONLY, 0666)
+	fh, err := os.OpenFile(fullpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
 	if err != nil {
 		f.Fatalf("error: Failed to open file %s for writing: %s", fullpath, err)
 	}
@@ -2,11 +2,16 @@ package xslate
 
 import (
 	"bytes"
+	"html"
 	"os"
 	"regexp"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/lestrrat-go/xslate/parser"
+	"github.com/lestrrat-go/xslate/vm"
+	"github.com/pkg/errors"
 )
 
 func TestTTerse_SimpleString(t *testing.T) {
@@ -91,6 +96,49 @@ func TestTTerse_While(t *testing.T) {
 	c.renderStringAndCompare(`[% i = 0 %][% WHILE i < 10 %][% i %],[% CALL i += 1 %][% END %]`, Vars{"i": 0}, `0,1,2,3,4,5,6,7,8,9,`)
 }
 
+func TestTTerse_CompoundAssignment(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% SET x = 10 %][% x += 5 %][% x %]`, nil, `15`)
+	c.renderStringAndCompare(`[% SET x = 10 %][% x -= 3 %][% x %]`, nil, `7`)
+	c.renderStringAndCompare(`[% SET x = 10 %][% x *= 2 %][% x %]`, nil, `20`)
+	c.renderStringAndCompare(`[% SET x = 10 %][% x /= 2 %][% x %]`, nil, `5`)
+	c.renderStringAndCompare(`[% SET x = 10 %][% x %= 4 %][% x %]`, nil, `2`)
+	c.renderStringAndCompare(`[% SET x = 1 %][% SET x += 2 %][% x %]`, nil, `3`)
+	c.renderStringAndCompare(`[% x += 1 %][% x %]`, Vars{"x": 41}, `42`)
+
+	c.renderStringAndCompare(`[% SET i = 0 %][% i++ %][% i++ %][% i %]`, nil, `2`)
+	c.renderStringAndCompare(`[% SET i = 5 %][% i-- %][% --i %][% i %]`, nil, `3`)
+	c.renderStringAndCompare(`[% SET i = 0 %][% ++i %][% i %]`, nil, `1`)
+}
+
+func TestTTerse_ForeachAccumulate(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"list": []int{1, 2, 3, 4}}
+	c.renderStringAndCompare(
+		`[% SET total = 0 %][% SET count = 0 %][% FOREACH x IN list %][% total += x %][% count++ %][% END %][% total %]/[% count %]`,
+		vars,
+		`10/4`,
+	)
+
+	// Local variables declared before a loop must not be clobbered by
+	// the loop variables, even when loops are nested
+	c.renderStringAndCompare(
+		`[% SET a = "a" %][% SET b = "b" %][% FOREACH x IN [1, 2] %][% FOREACH y IN [3, 4] %][% x %][% y %][% a %][% b %],[% END %][% END %]`,
+		nil,
+		`13ab,14ab,23ab,24ab,`,
+	)
+
+	c.renderStringAndCompare(
+		`[% SET n = 0 %][% WHILE n < 3 %][% SET m = n * 2 %][% m %][% n++ %][% END %][% n %]`,
+		nil,
+		`0243`,
+	)
+}
+
 func TestTTerse_Foreach(t *testing.T) {
 	var list [10]int
 	for i := 0; i < 10; i++ {
@@ -131,6 +179,54 @@ func TestTTerse_ForeachLoopVar(t *testing.T) {
 	c.renderStringAndCompare(template, nil, `9,9,9,9,9,9,9,9,9,9,`)
 }
 
+func TestTTerse_LoopControl(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"list": []int{1, 2, 3, 4, 5, 6}}
+	c.renderStringAndCompare(`[% FOREACH i IN list %][% IF i > 3 %][% LAST %][% END %][% i %][% END %]`, vars, `123`)
+	c.renderStringAndCompare(`[% FOREACH i IN list %][% IF i % 2 %][% NEXT %][% END %][% i %][% END %]`, vars, `246`)
+	c.renderStringAndCompare(`[% FOREACH i IN list %][% SWITCH i %][% CASE 2 %][% NEXT %][% CASE 4 %][% LAST %][% END %][% i %][% END %]`, vars, `13`)
+
+	// "show the first 5 in stock"
+	products := []map[string]interface{}{
+		{"name": "a", "stock": 1},
+		{"name": "b", "stock": 0},
+		{"name": "c", "stock": 3},
+		{"name": "d", "stock": 2},
+		{"name": "e", "stock": 0},
+		{"name": "f", "stock": 5},
+		{"name": "g", "stock": 1},
+		{"name": "h", "stock": 1},
+	}
+	c.renderStringAndCompare(
+		`[% SET shown = 0 %][% FOREACH p IN products %][% IF !p.stock %][% NEXT %][% END %][% p.name %][% shown++ %][% IF shown >= 5 %][% LAST %][% END %][% END %]`,
+		Vars{"products": products},
+		`acdfg`,
+	)
+
+	// Nested loops only leave the innermost loop
+	c.renderStringAndCompare(
+		`[% FOREACH x IN [1, 2, 3] %][% FOREACH y IN [1, 2, 3] %][% IF y == x %][% LAST %][% END %][% x %][% y %],[% END %]|[% END %]`,
+		nil,
+		`|21,|31,32,|`,
+	)
+
+	c.renderStringAndCompare(`[% SET i = 0 %][% WHILE i < 10 %][% i++ %][% IF i == 2 %][% NEXT %][% END %][% IF i > 4 %][% LAST %][% END %][% i %][% END %]`, nil, `134`)
+
+	// Wrappers are closed properly when leaving the loop from within
+	c.File("loopctl/wrapper.tx").WriteString(`<[% content %]>`)
+	c.renderStringAndCompare(`[% FOREACH i IN list %][% WRAPPER "loopctl/wrapper.tx" %][% i %][% END %][% IF i == 2 %][% LAST %][% END %][% END %]done`, vars, `<1><2>done`)
+
+	tx := c.CreateTx()
+	if _, err := tx.RenderString(`[% LAST %]`, nil); err == nil {
+		t.Errorf("Expected LAST outside of a loop to fail")
+	}
+	if _, err := tx.RenderString(`[% FOREACH i IN list %][% MACRO foo BLOCK %][% NEXT %][% END %][% END %]`, vars); err == nil {
+		t.Errorf("Expected NEXT in a MACRO to fail")
+	}
+}
+
 func TestTTerse_ForeachMakeArrayRange(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
@@ -148,6 +244,45 @@ func TestTTerse_ForeachMakeArrayList(t *testing.T) {
 	c.renderStringAndCompare(template, nil, `Alice,Bob,Charlie,`)
 }
 
+func TestTTerse_HashLiteral(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"name": "Bob"}
+	c.renderStringAndCompare(`[% SET h = { a => 1, "b" => 2 } %][% h.a %],[% h.b %]`, nil, `1,2`)
+	c.renderStringAndCompare(`[% SET h = { name => name, greeting => "Hello, " ~ name } %][% h.greeting %]`, vars, `Hello, Bob`)
+	c.renderStringAndCompare(`[% SET h = { list => [1, 2, 3], inner => { x => "y" } } %][% FOREACH i IN h.list %][% i %][% END %][% h.inner.x %]`, nil, `123y`)
+	c.renderStringAndCompare(`[% SET h = {} %][% h.missing %]`, nil, ``)
+	c.renderStringAndCompare(`[% FOREACH h IN [ { n => 1 }, { n => 2 } ] %][% h.n %][% END %]`, nil, `12`)
+
+	// Literals at the start of an expression, with lookups on them
+	c.renderStringAndCompare(`[% { a => 1 }.a %]`, nil, `1`)
+	c.renderStringAndCompare(`[% { a => 1, b => 2 }.keys().size() %]`, nil, `2`)
+	c.renderStringAndCompare(`[% {}.keys().size() %]`, nil, `0`)
+	c.renderStringAndCompare(`[% { a => name }.a ~ "!" %]`, vars, `Bob!`)
+	c.renderStringAndCompare(`[% [1, 2, 3].size() %],[% [1, 2, 3][1] %]`, nil, `3,2`)
+}
+
+func TestTTerse_ForeachMap(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"m":       map[string]int{"c": 3, "a": 1, "b": 2},
+		"numbers": map[int]string{10: "ten", 9: "nine", 1: "one"},
+	}
+	c.renderStringAndCompare(`[% FOREACH pair IN m %][% pair.key %]=[% pair.value %],[% END %]`, vars, `a=1,b=2,c=3,`)
+	c.renderStringAndCompare(`[% FOREACH pair IN numbers %][% pair.value %][% IF !loop.last %],[% END %][% END %]`, vars, `one,nine,ten`)
+	c.renderStringAndCompare(`[% FOREACH pair IN { z => 26, y => 25 } %][% pair.key %][% pair.value %][% END %]`, nil, `y25z26`)
+
+	// Numeric keys come before all other keys. Render a few times, as
+	// the order of a map's keys changes from one iteration to the next
+	mixed := Vars{"m": map[string]int{"2": 0, "10": 0, "1a": 0, "b": 0, "3": 0, "20": 0, "1b": 0}}
+	for i := 0; i < 10; i++ {
+		c.renderStringAndCompare(`[% FOREACH pair IN m %][% pair.key %],[% END %]`, mixed, `2,3,10,20,1a,1b,b,`)
+	}
+}
+
 func TestTTerse_ForeachArrayInStruct(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
@@ -174,6 +309,73 @@ func TestTTerse_IfElse(t *testing.T) {
 	c.renderStringAndCompare(template, Vars{"foo": false}, `Goodbye, World!`)
 }
 
+func TestTTerse_IfElsif(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+	template := `[% IF foo == 1 %]one[% ELSIF foo == 2 %]two[% ELSIF (foo == 3) %]three[% ELSE %]many[% END %]`
+	c.renderStringAndCompare(template, Vars{"foo": 1}, `one`)
+	c.renderStringAndCompare(template, Vars{"foo": 2}, `two`)
+	c.renderStringAndCompare(template, Vars{"foo": 3}, `three`)
+	c.renderStringAndCompare(template, Vars{"foo": 4}, `many`)
+
+	// Nested IFs must not be confused with ELSIF
+	template = `[% IF foo %]a[% ELSIF bar %][% IF baz %]b[% ELSE %]c[% END %][% END %]d`
+	c.renderStringAndCompare(template, Vars{"foo": true}, `ad`)
+	c.renderStringAndCompare(template, Vars{"bar": true, "baz": true}, `bd`)
+	c.renderStringAndCompare(template, Vars{"bar": true}, `cd`)
+	c.renderStringAndCompare(template, nil, `d`)
+}
+
+func TestTTerse_Unless(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+	template := `[% UNLESS foo %]Hello, World![% END %]`
+	c.renderStringAndCompare(template, Vars{"foo": true}, ``)
+	c.renderStringAndCompare(template, Vars{"foo": false}, `Hello, World!`)
+
+	template = `[% UNLESS (foo) %]Hello, World![% ELSE %]Goodbye, World![% END %]`
+	c.renderStringAndCompare(template, Vars{"foo": true}, `Goodbye, World!`)
+	c.renderStringAndCompare(template, Vars{"foo": false}, `Hello, World!`)
+}
+
+func TestTTerse_Switch(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+	template := `[% SWITCH x %]
+[%- CASE 'a' -%]A
+[%- CASE ['b', 'c'] -%]B or C
+[%- CASE -%]Other
+[%- END %]`
+	c.renderStringAndCompare(template, Vars{"x": "a"}, `A`)
+	c.renderStringAndCompare(template, Vars{"x": "b"}, `B or C`)
+	c.renderStringAndCompare(template, Vars{"x": "c"}, `B or C`)
+	c.renderStringAndCompare(template, Vars{"x": "d"}, `Other`)
+
+	// Without a default, nothing is printed when there's no match
+	template = `[% SWITCH x %][% CASE 1 %]one[% CASE DEFAULT %]default[% CASE 2 %]two[% END %]!`
+	c.renderStringAndCompare(template, Vars{"x": 1}, `one!`)
+	c.renderStringAndCompare(template, Vars{"x": 2}, `two!`)
+	c.renderStringAndCompare(template, Vars{"x": 3}, `default!`)
+
+	template = `[% SWITCH x %][% CASE 1 %]one[% END %]!`
+	c.renderStringAndCompare(template, Vars{"x": 2}, `!`)
+
+	// The first CASE may follow the SWITCH in the same tag
+	template = `[% SWITCH x; CASE "a" %]A[% CASE %]Other[% END %]`
+	c.renderStringAndCompare(template, Vars{"x": "a"}, `A`)
+	c.renderStringAndCompare(template, Vars{"x": "b"}, `Other`)
+
+	// Numbers and strings that look like numbers match each other,
+	// whichever side they are on
+	template = `[% SWITCH x %][% CASE 1 %]one[% CASE "2" %]two[% CASE "a" %]A[% CASE %]other[% END %]`
+	c.renderStringAndCompare(template, Vars{"x": "1"}, `one`)
+	c.renderStringAndCompare(template, Vars{"x": "1.0"}, `one`)
+	c.renderStringAndCompare(template, Vars{"x": 2}, `two`)
+	c.renderStringAndCompare(template, Vars{"x": 2.0}, `two`)
+	c.renderStringAndCompare(template, Vars{"x": 0}, `other`)
+	c.renderStringAndCompare(template, Vars{"x": "a"}, `A`)
+}
+
 func TestTTerse_Include(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
@@ -266,6 +468,38 @@ func TestTTerse_FunCallVariable(t *testing.T) {
 	x()
 }
 
+func TestTTerse_FunCallBuiltinFilterName(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	// Without a function of the same name, the builtin filters are used
+	c.renderStringAndCompare(`[% html("<b>") %]`, nil, `&lt;b&gt;`)
+	c.renderStringAndCompare(`[% raw("<b>") %]`, nil, `<b>`)
+
+	// Registered functions and variables win over the builtin filters
+	p := func(s string) string { return "<p>" + s + "</p>" }
+	c.renderStringAndCompare(`[% html("x") | mark_raw %]`, Vars{"html": p}, `<p>x</p>`)
+
+	tx, err := New(Args{
+		"Functions": Args{
+			"html": p,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create xslate: %s", err)
+	}
+
+	output, err := tx.RenderString(`[% html("x") | mark_raw %]`, nil)
+	if err != nil {
+		t.Fatalf("Failed to render: %s", err)
+	}
+
+	expected := `<p>x</p>`
+	if output != expected {
+		t.Errorf("Expected '%s', got '%s'", expected, output)
+	}
+}
+
 func TestTTerse_MethodCallVariable(t *testing.T) {
 	template := `[% t1.Before(t2) %]`
 
@@ -357,6 +591,221 @@ func TestTTerse_BooleanComparators(t *testing.T) {
 	c.renderStringAndCompare(template, Vars{"foo": "bar"}, ``)
 }
 
+func TestTTerse_OrderingComparators(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	template := `[% a < b %] [% a <= b %] [% a > b %] [% a >= b %] [% a <=> b %]`
+	c.renderStringAndCompare(template, Vars{"a": 1, "b": 2}, `true true false false -1`)
+	c.renderStringAndCompare(template, Vars{"a": 2, "b": 2}, `false true false true 0`)
+	c.renderStringAndCompare(template, Vars{"a": 2.5, "b": 2}, `false false true true 1`)
+	// Strings that look like numbers are compared as numbers
+	c.renderStringAndCompare(template, Vars{"a": "10", "b": 9}, `false false true true 1`)
+	c.renderStringAndCompare(template, Vars{"a": "10", "b": "9"}, `false false true true 1`)
+	// ...other strings are compared lexically
+	c.renderStringAndCompare(template, Vars{"a": "apple", "b": "banana"}, `true true false false -1`)
+
+	template = `[% a lt b %] [% a le b %] [% a gt b %] [% a ge b %] [% a cmp b %]`
+	c.renderStringAndCompare(template, Vars{"a": "apple", "b": "banana"}, `true true false false -1`)
+	c.renderStringAndCompare(template, Vars{"a": "b", "b": "b"}, `false true false true 0`)
+	c.renderStringAndCompare(template, Vars{"a": "10", "b": "9"}, `true true false false -1`)
+
+	c.renderStringAndCompare(`[% IF x >= 1 && x <= 10 %]in range[% END %]`, Vars{"x": 10}, `in range`)
+	c.renderStringAndCompare(`[% IF x <=> 1 == 0 %]one[% END %]`, Vars{"x": 1}, `one`)
+
+	// == and != agree with <=>, whichever side the number is on
+	template = `[% 1 <= x %]/[% 1 == x %]/[% x == 1 %]/[% 1 != x %]/[% x != 1 %]/[% 1 <=> x %]`
+	c.renderStringAndCompare(template, Vars{"x": "1"}, `true/true/true/false/false/0`)
+	c.renderStringAndCompare(template, Vars{"x": "1.0"}, `true/true/true/false/false/0`)
+	// A number and a string that doesn't look like one are never equal
+	c.renderStringAndCompare(`[% 1 == x %]/[% x == 1 %]/[% 1 != x %]/[% x != 1 %]`, Vars{"x": "a"}, `false/false/true/true`)
+	// ...while eq and ne always compare strings
+	template = `[% 1 eq x %]/[% x eq 1 %]/[% 1 ne x %]/[% x ne 1 %]`
+	c.renderStringAndCompare(template, Vars{"x": "1"}, `true/true/false/false`)
+	c.renderStringAndCompare(template, Vars{"x": "1.0"}, `false/false/true/true`)
+
+	if _, err := c.renderString(`[% a < b %]`, Vars{"a": "apple", "b": 1}); err == nil {
+		t.Errorf("Expected comparing a string and a number to fail")
+	}
+}
+
+func TestTTerse_LogicalOperators(t *testing.T) {
+	var template string
+
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	template = `[% IF a && !b %]yes[% ELSE %]no[% END %]`
+	c.renderStringAndCompare(template, Vars{"a": true, "b": false}, `yes`)
+	c.renderStringAndCompare(template, Vars{"a": true, "b": true}, `no`)
+	c.renderStringAndCompare(template, Vars{"a": false, "b": false}, `no`)
+
+	template = `[% IF a || b %]yes[% ELSE %]no[% END %]`
+	c.renderStringAndCompare(template, Vars{"a": false, "b": true}, `yes`)
+	c.renderStringAndCompare(template, Vars{"a": false, "b": false}, `no`)
+
+	template = `[% IF a and not b or c %]yes[% ELSE %]no[% END %]`
+	c.renderStringAndCompare(template, Vars{"a": true, "b": false}, `yes`)
+	c.renderStringAndCompare(template, Vars{"a": true, "b": true}, `no`)
+	c.renderStringAndCompare(template, Vars{"c": true}, `yes`)
+
+	// && binds tighter than ||, and comparisons tighter than both
+	template = `[% IF x == 1 || x == 2 && y == 3 %]yes[% ELSE %]no[% END %]`
+	c.renderStringAndCompare(template, Vars{"x": 1, "y": 0}, `yes`)
+	c.renderStringAndCompare(template, Vars{"x": 2, "y": 3}, `yes`)
+	c.renderStringAndCompare(template, Vars{"x": 2, "y": 0}, `no`)
+
+	// The result is the value of the last evaluated operand
+	c.renderStringAndCompare(`[% name || "anonymous" %]`, Vars{"name": "Bob"}, `Bob`)
+	c.renderStringAndCompare(`[% name || "anonymous" %]`, Vars{"name": ""}, `anonymous`)
+	c.renderStringAndCompare(`[% name // "anonymous" %]`, Vars{"name": ""}, ``)
+	c.renderStringAndCompare(`[% name // "anonymous" %]`, nil, `anonymous`)
+	c.renderStringAndCompare(`[% a && b %]`, Vars{"a": "x", "b": "y"}, `y`)
+
+	// not may start a printed expression, and binds tighter than or
+	c.renderStringAndCompare(`[% not a %]`, Vars{"a": true}, `false`)
+	c.renderStringAndCompare(`[% not a or b %]`, Vars{"a": true, "b": "x"}, `x`)
+	c.renderStringAndCompare(`[% not a or b %]`, Vars{"a": false, "b": "x"}, `true`)
+
+	// Words are only operators when they are not part of an identifier
+	c.renderStringAndCompare(`[% order %] [% notes %] [% android %]`, Vars{"order": 1, "notes": 2, "android": 3}, `1 2 3`)
+}
+
+func TestTTerse_ShortCircuit(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	called := 0
+	vars := Vars{
+		"yes": true,
+		"no":  false,
+		"f": func() bool {
+			called++
+			return true
+		},
+	}
+
+	for _, template := range []string{`[% no && f() %]`, `[% yes || f() %]`, `[% yes // f() %]`} {
+		called = 0
+		if _, err := c.renderString(template, vars); err != nil {
+			t.Fatalf("Failed to render template: %s", err)
+		}
+		if called != 0 {
+			t.Errorf("Expected right hand side of '%s' not to be evaluated", template)
+		}
+	}
+
+	called = 0
+	c.renderStringAndCompare(`[% yes && f() %]`, vars, `true`)
+	if called != 1 {
+		t.Errorf("Expected right hand side to be evaluated once, got %d", called)
+	}
+}
+
+func TestTTerse_OperatorPrecedence(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% 1 + 2 * 3 %]`, nil, `7`)
+	c.renderStringAndCompare(`[% 2 * 3 + 1 %]`, nil, `7`)
+	c.renderStringAndCompare(`[% 10 - 4 - 3 %]`, nil, `3`)
+	c.renderStringAndCompare(`[% 12 / 2 / 3 %]`, nil, `2`)
+	c.renderStringAndCompare(`[% IF 1 + 1 == 2 %]ok[% END %]`, nil, `ok`)
+	c.renderStringAndCompare(`[% 1 + 2 | html %]`, nil, `3`)
+}
+
+func TestTTerse_Modulo(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% 10 % 3 %]`, nil, `1`)
+	c.renderStringAndCompare(`[% 1 + 10 % 3 * 2 %]`, nil, `3`)
+
+	vars := Vars{"list": []int{1, 2, 3, 4}}
+	c.renderStringAndCompare(
+		`[% FOREACH i IN list %][% IF loop.index % 2 == 0 %]even[% ELSE %]odd[% END %] [% END %]`,
+		vars,
+		`even odd even odd `,
+	)
+
+	tx := c.CreateTx()
+	if _, err := tx.RenderString(`[% 1 % 0 %]`, nil); err == nil {
+		t.Errorf("Expected modulus by zero to fail")
+	}
+}
+
+func TestTTerse_Concat(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"name":  "row",
+		"index": 3,
+		"html":  "<b>",
+		"raw":   Raw("<i>"),
+	}
+	c.renderStringAndCompare(`[% "Hello, " ~ "World" %]`, nil, `Hello, World`)
+	c.renderStringAndCompare(`[% name ~ "-" ~ index %]`, vars, `row-3`)
+	c.renderStringAndCompare(`[% "total: " ~ (1 + 2) %]`, nil, `total: 3`)
+	c.renderStringAndCompare(`[% html ~ raw %]`, vars, `&lt;b&gt;&lt;i&gt;`)
+	c.renderStringAndCompare(`[% raw ~ raw %]`, vars, `<i><i>`)
+}
+
+func TestTTerse_UnaryMinusPlus(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"x": 5, "s": "7"}
+	c.renderStringAndCompare(`[% -x %]`, vars, `-5`)
+	c.renderStringAndCompare(`[% - 1 + 3 %]`, nil, `2`)
+	c.renderStringAndCompare(`[% x - -1 %]`, vars, `6`)
+	c.renderStringAndCompare(`[% -(x * 2) %]`, vars, `-10`)
+	c.renderStringAndCompare(`[% +s + 1 %]`, vars, `8`)
+}
+
+func TestTTerse_Ternary(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"a": 1, "b": 0, "name": "foo"}
+	c.renderStringAndCompare(`[% a ? "yes" : "no" %]`, vars, `yes`)
+	c.renderStringAndCompare(`[% b ? "yes" : "no" %]`, vars, `no`)
+	c.renderStringAndCompare(`[% b ? "first" : a ? "second" : "third" %]`, vars, `second`)
+	c.renderStringAndCompare(`[% b || a ? "yes" : "no" %]`, vars, `yes`)
+	c.renderStringAndCompare(`[% a == 1 ? name ~ "!" : name %]`, vars, `foo!`)
+	c.renderStringAndCompare(`[% (a ? 10 : 20) + 1 %]`, vars, `11`)
+}
+
+func TestTTerse_AutoEscape(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"escaped": "<b>Hello</b>",
+		"raw":     Raw("<b>Hello</b>"),
+	}
+
+	c.renderStringAndCompare(`[% escaped %]`, vars, `&lt;b&gt;Hello&lt;/b&gt;`)
+	c.renderStringAndCompare(`[% raw %]`, vars, `<b>Hello</b>`)
+	c.renderStringAndCompare(`[% escaped | mark_raw %]`, vars, `<b>Hello</b>`)
+	c.renderStringAndCompare(`[% raw | html %]`, vars, `&lt;b&gt;Hello&lt;/b&gt;`)
+
+	c.XslateArgs["AutoEscape"] = AutoEscapeNone
+	c.renderStringAndCompare(`[% escaped %]`, vars, `<b>Hello</b>`)
+	c.renderStringAndCompare(`[% raw %]`, vars, `<b>Hello</b>`)
+	c.renderStringAndCompare(`[% escaped | html %]`, vars, `&lt;b&gt;Hello&lt;/b&gt;`)
+
+	// Included templates follow the same mode
+	c.File("autoescape/index.tx").WriteString(`[% INCLUDE "autoescape/include.tx" %]`)
+	c.File("autoescape/include.tx").WriteString(`[% escaped %]`)
+	c.renderAndCompare(c.CreateTx(), "autoescape/index.tx", vars, `<b>Hello</b>`)
+
+	c.XslateArgs["AutoEscape"] = "xml"
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("Expected unknown AutoEscape mode to be rejected")
+	}
+}
+
 func TestTTerse_FilterHTML(t *testing.T) {
 	template := `[% "<abc>" | html %]`
 
@@ -366,6 +815,57 @@ func TestTTerse_FilterHTML(t *testing.T) {
 	c.renderStringAndCompare(template, nil, `&lt;abc&gt;`)
 }
 
+func TestTTerse_FilterCustom(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.XslateArgs["Filters"] = Args{
+		"nl2br": func(s string) Raw {
+			return Raw(strings.Replace(html.EscapeString(s), "\n", "<br />", -1))
+		},
+		"truncate": func(s string, n int, suffix ...string) string {
+			if len(s) <= n {
+				return s
+			}
+			if len(suffix) > 0 {
+				return s[:n] + suffix[0]
+			}
+			return s[:n]
+		},
+		"upper": strings.ToUpper,
+		"fail": func(v interface{}) (string, error) {
+			return "", errors.New("filter failed")
+		},
+	}
+
+	vars := Vars{"text": "Hello, <World>\nGoodbye"}
+	c.renderStringAndCompare(`[% text | nl2br %]`, vars, `Hello, &lt;World&gt;<br />Goodbye`)
+	c.renderStringAndCompare(`[% text | truncate(5) %]`, vars, `Hello`)
+	c.renderStringAndCompare(`[% text | truncate(5, "...") %]`, vars, `Hello...`)
+	c.renderStringAndCompare(`[% text | truncate(9) | upper | html %]`, vars, `HELLO, &lt;W`)
+	c.renderStringAndCompare(`[% "<b>" | upper %]`, nil, `&lt;B&gt;`)
+
+	_, err := c.renderString(`[% text | fail %]`, vars)
+	if err == nil {
+		t.Fatalf("Expected error from filter to be returned")
+	}
+	if !strings.Contains(err.Error(), "filter failed") {
+		t.Errorf("Could not find expected error string in '%s'", err)
+	}
+}
+
+func TestTTerse_FilterMacro(t *testing.T) {
+	template := `
+[%- MACRO bold(text, class) BLOCK -%]
+<b class="[% class %]">[% text %]</b>
+[%- END -%]
+[% "<Hello>" | bold("greeting") %] [% "World" | bold | mark_raw %]`
+
+	c := newTestCtx(t)
+	defer c.Cleanup()
+	c.renderStringAndCompare(template, nil, `<b class="greeting">&lt;Hello&gt;</b> <b class="">World</b>`)
+}
+
 func TestTTerse_FilterUri(t *testing.T) {
 	template := `[% "日本語" | uri %]`
 
@@ -375,6 +875,53 @@ func TestTTerse_FilterUri(t *testing.T) {
 	c.renderStringAndCompare(template, nil, `%E6%97%A5%E6%9C%AC%E8%AA%9E`)
 }
 
+func TestTTerse_FilterUnknown(t *testing.T) {
+	template := `[% "abc" | no_such_filter %]`
+
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	_, err := c.renderString(template, nil)
+	if err == nil {
+		t.Fatalf("Expected unknown filter to be an error")
+	}
+	if _, ok := errors.Cause(err).(*vm.RuntimeError); !ok {
+		t.Errorf("Expected *vm.RuntimeError, got %T (%s)", errors.Cause(err), err)
+	}
+}
+
+func TestTTerse_FilterBuiltinArgs(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	for _, template := range []string{`[% s | html(1, 2) %]`, `[% s | raw("x") %]`, `[% s | uri(5) %]`, `[% s | unmark_raw(s) %]`} {
+		_, err := c.renderString(template, Vars{"s": "<b>"})
+		if err == nil {
+			t.Errorf("Expected arguments to a builtin filter to be an error in %s", template)
+			continue
+		}
+		if _, ok := errors.Cause(err).(*vm.RuntimeError); !ok {
+			t.Errorf("Expected *vm.RuntimeError, got %T (%s)", errors.Cause(err), err)
+		}
+	}
+}
+
+func TestTTerse_IncludeMissing(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("include/missing.tx").WriteString(`Hello, [% INCLUDE "include/no_such_file.tx" %]`)
+
+	tx := c.CreateTx()
+	_, err := tx.Render("include/missing.tx", nil)
+	if err == nil {
+		t.Fatalf("Expected missing include target to be an error")
+	}
+	if _, ok := errors.Cause(err).(*vm.RuntimeError); !ok {
+		t.Errorf("Expected *vm.RuntimeError, got %T (%s)", errors.Cause(err), err)
+	}
+}
+
 func TestTTerse_Wrapper(t *testing.T) {
 	c := newTestCtx(t)
 	defer c.Cleanup()
@@ -443,7 +990,38 @@ func TestTTerse_Error(t *testing.T) {
 		t.Fatalf("Expected error, got none")
 	}
 
-	if !strings.Contains(err.Error(), `Unexpected token found: Expected TagEnd, got Error ("unclosed tag") in errors/index.tx at line 2`) {
+	if !strings.Contains(err.Error(), `errors/index.tx:2:9: Unexpected token found: Expected TagEnd, got Error ("unclosed tag")`) {
+		t.Errorf("Could not find expected error string in '%s'", err)
+	}
+
+	// The offending line should be included
+	if !strings.Contains(err.Error(), "\n    [% name \n") {
+		t.Errorf("Could not find source snippet in '%s'", err)
+	}
+}
+
+func TestTTerse_RuntimeErrorPosition(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("errors/runtime.tx").WriteString("Hello World,\n[% name %] [% name | no_such_filter %]")
+
+	tx := c.CreateTx()
+	_, err := tx.Render("errors/runtime.tx", Vars{"name": "Bob"})
+	if err == nil {
+		t.Fatalf("Expected error, got none")
+	}
+
+	rterr, ok := errors.Cause(err).(*vm.RuntimeError)
+	if !ok {
+		t.Fatalf("Expected *vm.RuntimeError, got %T (%s)", errors.Cause(err), err)
+	}
+
+	if rterr.Line != 2 || rterr.Column != 22 {
+		t.Errorf("Expected error at 2:22, got %d:%d", rterr.Line, rterr.Column)
+	}
+
+	if !strings.Contains(err.Error(), "errors/runtime.tx:2:22: unknown filter 'no_such_filter'") {
 		t.Errorf("Could not find expected error string in '%s'", err)
 	}
 }
@@ -455,22 +1033,107 @@ func TestTTerse_Macro(t *testing.T) {
 [% i %]: [% text %]
 [%- END # FOREACH %]
 [%- END -%]
-[%- CALL repeat("Hello!", 10) -%]
+[%- repeat("Hello!", 3) -%]
   `
 
 	c := newTestCtx(t)
 	defer c.Cleanup()
 	c.renderStringAndCompare(template, nil, `
-1: Hello
-2: Hello
-3: Hello
-4: Hello
-5: Hello
-6: Hello
-7: Hello
-8: Hello
-9: Hello
-10: Hello`)
+1: Hello!
+2: Hello!
+3: Hello!`)
+}
+
+func TestTTerse_MacroArgs(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	const greet = `[% MACRO greet(greeting, name) BLOCK %][% greeting %], [% name %]![% END %]`
+	c.renderStringAndCompare(greet+`[% greet("Hello", "Bob") %]`, nil, `Hello, Bob!`)
+	c.renderStringAndCompare(greet+`[% greet(name => "Bob", greeting => "Hi") %]`, nil, `Hi, Bob!`)
+	c.renderStringAndCompare(greet+`[% greet("Hey", name => "Alice") %]`, nil, `Hey, Alice!`)
+	c.renderStringAndCompare(greet+`[% greet("Hello") %]`, nil, `Hello, !`)
+
+	// Parameters hide local variables with the same name, but other
+	// local variables are visible
+	c.renderStringAndCompare(
+		`[% SET name = "outer" %][% SET punct = "?" %][% MACRO show(name) BLOCK %][% name %][% punct %][% END %][% show("inner") %][% name %]`,
+		nil,
+		`inner?outer`,
+	)
+
+	// The output is a raw string that can be used in expressions
+	c.renderStringAndCompare(
+		`[% MACRO bold(s) BLOCK %]<b>[% s %]</b>[% END %][% SET b = bold("x") %][% b %][% IF bold("y") == "<b>y</b>" %] ok[% END %]`,
+		nil,
+		`<b>x</b> ok`,
+	)
+
+	tx := c.CreateTx()
+	if _, err := tx.RenderString(greet+`[% greet(nickname => "Bob") %]`, nil); err == nil {
+		t.Errorf("Expected unknown named parameter to fail")
+	}
+	if _, err := tx.RenderString(greet+`[% greet("a", "b", "c") %]`, nil); err == nil {
+		t.Errorf("Expected too many arguments to fail")
+	}
+
+	const link = `[% MACRO link(url, text) BLOCK %]<a href="[% url %]">[% text %]</a>[% END %]`
+	_, err := tx.RenderString(link+`[% link("/", url => "/x") %]`, nil)
+	if err == nil || !strings.Contains(err.Error(), "parameter 'url' given twice") {
+		t.Errorf("Expected a parameter given twice to fail, got %v", err)
+	}
+	if _, err := tx.RenderString(link+`[% link(url => "/", url => "/x") %]`, nil); err == nil {
+		t.Errorf("Expected a named parameter given twice to fail")
+	}
+
+	_, err = tx.RenderString(`[% MACRO add(a, a) BLOCK %][% a %][% END %][% add(1, 2) %]`, nil)
+	if err == nil || !strings.Contains(err.Error(), "parameter 'a' declared twice") {
+		t.Errorf("Expected a parameter declared twice to fail, got %v", err)
+	}
+}
+
+func TestTTerse_MacroRecursion(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(
+		`[% MACRO countdown(n) BLOCK %][% n %][% IF n > 0 %],[% countdown(n - 1) %][% END %][% END %][% countdown(3) %]`,
+		nil,
+		`3,2,1,0`,
+	)
+
+	// The output of a macro can be used in arithmetic
+	c.renderStringAndCompare(
+		`[% MACRO fact(n) BLOCK %][% IF n <= 1 %]1[% ELSE %][% n * fact(n - 1) %][% END %][% END %][% fact(5) %]`,
+		nil,
+		`120`,
+	)
+	c.renderStringAndCompare(
+		`[% MACRO fib(n) BLOCK %][% IF n < 2 %][% n %][% ELSE %][% fib(n - 1) + fib(n - 2) %][% END %][% END %][% fib(10) %]`,
+		nil,
+		`55`,
+	)
+	c.renderStringAndCompare(`[% "3" + 1 %] [% x * 2 %]`, Vars{"x": "1.5"}, `4 3`)
+
+	c.XslateArgs["VM"] = Args{"MaxDepth": 5}
+	tx := c.CreateTx()
+	_, err := tx.RenderString(`[% MACRO forever(n) BLOCK %][% forever(n + 1) %][% END %][% forever(0) %]`, nil)
+	if lerr, ok := errors.Cause(err).(*vm.LimitError); !ok || lerr.Limit != "MaxDepth" {
+		t.Errorf("Expected MaxDepth to be exceeded, got %v", err)
+	}
+}
+
+func TestTTerse_MacroImport(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("macros/lib.tx").WriteString(`This is not printed
+[%- SET sep = ", " %]
+[%- MACRO join_list(list) BLOCK %][% FOREACH i IN list %][% i %][% IF !loop.last %][% sep %][% END %][% END %][% END %]
+[%- MACRO fact(n) BLOCK %][% n %][% IF n > 1 %]*[% fact(n - 1) %][% END %][% END %]`)
+	c.File("macros/index.tx").WriteString(`[% IMPORT "macros/lib.tx" %][% join_list([1, 2, 3]) %] [% fact(5) %]`)
+
+	c.renderAndCompare(c.CreateTx(), "macros/index.tx", nil, `1, 2, 3 5*4*3*2*1`)
 }
 
 func TestTTerse_NilOnIfBlock(t *testing.T) {
@@ -499,3 +1162,243 @@ func TestTTerse_WrapperAndForeach(t *testing.T) {
 	c.renderAndCompare(tx, "wrapper/raw.tx", vars, "Hi! Bob, Freddie, ")
 	c.renderAndCompare(tx, "wrapper/index.tx", vars, "Hello World! Hi! Bob, Freddie, Hello World!")
 }
+
+func TestTTerse_Block(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	// BLOCKs can be used before they are defined, and see the local
+	// variables of the caller
+	c.renderStringAndCompare(
+		`<ul>[% FOREACH item IN list %][% PROCESS row %][% END %]</ul>[% BLOCK row %]<li>[% item %]</li>[% END %]`,
+		Vars{"list": []int{1, 2, 3}},
+		`<ul><li>1</li><li>2</li><li>3</li></ul>`,
+	)
+
+	// INCLUDE localizes variables, PROCESS does not
+	c.renderStringAndCompare(
+		`[% BLOCK incr %][% x = x + 1 %][% x %][% END %][% SET x = 1 %][% INCLUDE incr %] [% x %] [% PROCESS incr %] [% x %]`,
+		nil,
+		`2 1 2 2`,
+	)
+
+	// ...including for template variables, and variables that the
+	// caller doesn't have yet
+	c.renderStringAndCompare(`[% BLOCK incr %][% x = x + 1 %][% END %][% PROCESS incr %][% x %]`, Vars{"x": 1}, `2`)
+	c.renderStringAndCompare(`[% BLOCK incr %][% x = x + 1 %][% END %][% INCLUDE incr %][% x %]`, Vars{"x": 1}, `1`)
+	c.renderStringAndCompare(`[% BLOCK b %][% SET y = "new" %][% END %][% PROCESS b %][% y %]`, nil, `new`)
+	c.renderStringAndCompare(`[% BLOCK b %][% SET y = "new" %][% END %][% INCLUDE b %][% y %]`, nil, ``)
+
+	// Arguments, template variables, and BLOCKs calling BLOCKs
+	c.renderStringAndCompare(
+		`[% BLOCK greet %][% PROCESS name WITH who = who %], [% title %][% END %][% BLOCK name %]Hello [% who %][% END %][% INCLUDE greet WITH who = "Bob" %]`,
+		Vars{"title": "Dr."},
+		`Hello Bob, Dr.`,
+	)
+
+	// Macros defined outside of a BLOCK can be called from within
+	c.renderStringAndCompare(
+		`[% SET n = 3 %][% MACRO show(x) BLOCK %][[% x %]/[% n %]][% END %][% BLOCK b %][% show(1) %][% END %][% PROCESS b %]`,
+		nil,
+		`[1/3]`,
+	)
+
+	// Local variables in a BLOCK are separate from those of the caller
+	c.renderStringAndCompare(
+		`[% BLOCK b %][% SET y = "inner" %][% y %][% END %][% FOREACH i IN [1] %][% SET y = "outer" %][% INCLUDE b %][% y %][% END %]`,
+		nil,
+		`innerouter`,
+	)
+
+	// Bare words that are not BLOCKs are still variables
+	c.File("block/file.tx").WriteString(`file`)
+	c.renderStringAndCompare(`[% INCLUDE tmpl %]`, Vars{"tmpl": "block/file.tx"}, `file`)
+
+	tx := c.CreateTx()
+	if _, err := tx.RenderString(`[% BLOCK a %][% END %][% BLOCK a %][% END %]`, nil); err == nil {
+		t.Errorf("Expected duplicate BLOCK to fail")
+	}
+}
+
+func TestTTerse_Cascade(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("cascade/base.tx").WriteString(`<title>[% PROCESS title %]</title><body>[% PROCESS content %]</body>
+[%- BLOCK title %]Default[% END %]
+[%- BLOCK content %][% FOREACH i IN [1, 2] %][% i %][% END %][% END %]`)
+	c.File("cascade/child.tx").WriteString(`[% CASCADE "cascade/base.tx" %]This is not printed
+[%- BLOCK title %]My Page[% END %]
+[%- AROUND content %]<div>[% SUPER %]</div>[% END %]`)
+	c.File("cascade/grandchild.tx").WriteString(`[% CASCADE "cascade/child.tx" %]
+[%- BEFORE content %]<h1>[% name %]</h1>[% END %]
+[%- AFTER content %]<p>end</p>[% END %]`)
+
+	tx := c.CreateTx()
+	c.renderAndCompare(tx, "cascade/base.tx", nil, `<title>Default</title><body>12</body>`)
+	c.renderAndCompare(tx, "cascade/child.tx", nil, `<title>My Page</title><body><div>12</div></body>`)
+	c.renderAndCompare(tx, "cascade/grandchild.tx", Vars{"name": "Bob"}, `<title>My Page</title><body><h1>Bob</h1><div>12</div><p>end</p></body>`)
+	c.renderStringAndCompare(`[% CASCADE "cascade/base.tx" %][% BLOCK content %][% name %][% END %]`, Vars{"name": "Alice"}, `<title>Default</title><body>Alice</body>`)
+
+	// Changes to any of the ancestors invalidate the cached ByteCode
+	c.File("cascade/base.tx").WriteString(`<h2>[% PROCESS title %]</h2>[% PROCESS content %]
+[%- BLOCK title %]Default[% END %]
+[%- BLOCK content %][% END %]`)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(c.Mkpath("cascade/base.tx"), future, future); err != nil {
+		t.Fatalf("Chtimes failed: %s", err)
+	}
+	c.renderAndCompare(tx, "cascade/grandchild.tx", Vars{"name": "Bob"}, `<h2>My Page</h2><h1>Bob</h1><div></div><p>end</p>`)
+
+	// Errors
+	c.File("cascade/nosuchblock.tx").WriteString(`[% CASCADE "cascade/base.tx" %][% AROUND nosuchblock %][% END %]`)
+	c.File("cascade/loop1.tx").WriteString(`[% CASCADE "cascade/loop2.tx" %]`)
+	c.File("cascade/loop2.tx").WriteString(`[% CASCADE "cascade/loop1.tx" %]`)
+	for _, name := range []string{"cascade/nosuchblock.tx", "cascade/loop1.tx"} {
+		if _, err := tx.Render(name, nil); err == nil {
+			t.Errorf("Expected %s to fail", name)
+		}
+	}
+	if _, err := tx.RenderString(`[% BLOCK foo %][% SUPER %][% END %]`, nil); err == nil {
+		t.Errorf("Expected SUPER outside of AROUND to fail")
+	}
+}
+
+func TestTTerse_WrapperInto(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("wrapper/layout.tx").WriteString(`<title>[% title %]</title>[% content %]<body>[% body %]</body>`)
+	c.File("wrapper/outer.tx").WriteString(`<html>[% content %]</html>`)
+	c.File("wrapper/inner.tx").WriteString(`<div class="[% class %]">[% content %]</div>`)
+
+	c.renderStringAndCompare(`[% WRAPPER "wrapper/layout.tx" INTO body WITH title = "x" %]<b>Hi</b>[% END %]`, Vars{"content": "meta"}, `<title>x</title>meta<body><b>Hi</b></body>`)
+	c.renderStringAndCompare(`[% WRAPPER ["wrapper/outer.tx", "wrapper/inner.tx"] WITH class = "a", title = "t" %]<b>Hi</b>[% END %]`, nil, `<html><div class="a"><b>Hi</b></div></html>`)
+	c.renderStringAndCompare(`[% WRAPPER ["wrapper/outer.tx", "wrapper/layout.tx"] INTO body WITH title = "t" %]Hi[% END %]`, Vars{"content": "meta"}, `<html>meta</html>`)
+}
+
+func TestTTerse_Interpolation(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{
+		"name": "Bob",
+		"kind": "card",
+		"user": map[string]interface{}{"name": "Alice", "tags": []string{"x", "y"}},
+		"list": []string{"x", "y"},
+	}
+	c.renderStringAndCompare(`[% "Hello, $name!" %]`, vars, `Hello, Bob!`)
+	c.renderStringAndCompare(`[% "Hello, ${user.name}!" %]`, vars, `Hello, Alice!`)
+	c.renderStringAndCompare(`[% "${ user.tags.size() } tags, first is ${list[0]}" %]`, vars, `2 tags, first is x`)
+	c.renderStringAndCompare(`[% SET n = 3 %][% "$n * 2 = ${n * 2}" %]`, nil, `3 * 2 = 6`)
+	c.renderStringAndCompare(`[% FOREACH i IN [1, 2] %][% "[$i]" %][% END %]`, nil, `[1][2]`)
+	c.renderStringAndCompare(`[% "a\tb\nc \$name \"q\" \\" %]`, vars, "a\tb\nc $name &#34;q&#34; \\")
+	c.renderStringAndCompare(`[% '$name\n' %]`, vars, `$name\n`)
+	c.renderStringAndCompare(`[% "$ 5 and $1" %]`, vars, `$ 5 and $1`)
+	c.renderStringAndCompare(`[% "<$name>" %]`, Vars{"name": "<b>"}, `&lt;&lt;b&gt;&gt;`)
+
+	// $name may be followed by fields. A '.' that isn't followed by a
+	// field name is just text, and so are method calls
+	c.renderStringAndCompare(`[% "x $user.name" %]`, vars, `x Alice`)
+	c.renderStringAndCompare(`[% "Hi, $user.name. Bye, $name." %]`, vars, `Hi, Alice. Bye, Bob.`)
+	c.renderStringAndCompare(`[% "$user.tags.size() tags" %]`, vars, `[x y].size() tags`)
+
+	// ${...} may contain braces and quoted strings of its own
+	c.renderStringAndCompare(`[% "${ "}" }" %]`, nil, `}`)
+	c.renderStringAndCompare(`[% "[${ '{' ~ "}" }]" %]`, nil, `[{}]`)
+	c.renderStringAndCompare(`[% "${ "<$name>" }" %]`, vars, `&lt;Bob&gt;`)
+
+	c.File("partials/card.tx").WriteString(`card for [% name %]`)
+	c.renderStringAndCompare(`[% INCLUDE "partials/${kind}.tx" %]`, vars, `card for Bob`)
+
+	for _, tmpl := range []string{`[% "${name" %]`, `[% "${}" %]`, `[% "${ 1 + }" %]`, `[% "${ "}" %]`} {
+		if _, err := c.renderString(tmpl, vars); err == nil {
+			t.Errorf("expected %s to fail", tmpl)
+		}
+	}
+}
+
+func TestTTerse_NumberLiterals(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.renderStringAndCompare(`[% 0x1F %] [% 0XfF %] [% 0o17 %] [% 017 %] [% 0b1010 %] [% 1_000_000 %]`, nil, `31 255 15 15 10 1000000`)
+	c.renderStringAndCompare(`[% 1.5e3 %] [% 25E-1 %] [% 1_000.5 %] [% 0.25 %]`, nil, `1500 2.5 1000.5 0.25`)
+	c.renderStringAndCompare(`[% FOREACH i IN [0..2] %][% i %][% END %]`, nil, `012`)
+
+	// Mixed int/float arithmetic
+	c.renderStringAndCompare(`[% 1 + 0.5 %] [% 0.5 * 4 %] [% 10 / 4 %] [% 10 / 2.5 %] [% 7 % 2.5 %]`, nil, `1.5 2 2.5 4 2`)
+	c.renderStringAndCompare(`[% a - b %] [% a / c %]`, Vars{"a": uint8(3), "b": -5, "c": float32(0.5)}, `8 6`)
+
+	for _, tmpl := range []string{`[% 0x %]`, `[% 1__0 %]`, `[% 09 %]`, `[% 1e %]`, `[% 12abc %]`, `[% 0x8000000000000000 %]`, `[% 1 / 0 %]`, `[% 1.5 / 0 %]`} {
+		if _, err := c.renderString(tmpl, nil); err == nil {
+			t.Errorf("expected %s to fail", tmpl)
+		}
+	}
+}
+
+func TestTTerse_ChompMarkers(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"x": 1}
+	c.renderStringAndCompare("a \n [%- x -%] \n b", vars, `a1b`)
+	c.renderStringAndCompare("a \n [%~ x ~%] \n b", vars, `a 1 b`)
+	c.renderStringAndCompare("a \n [%+ x +%] \n b", vars, "a \n 1 \n b")
+	c.renderStringAndCompare("a [%~ x -%] b", vars, `a 1b`)
+
+	// '~' and '+' are still operators elsewhere
+	c.renderStringAndCompare(`[%~ "a" ~ x ~%] [% +x %] [%+1+%] [% x + 1 ~%] !`, vars, `a1 1 1 2 !`)
+}
+
+func TestTTerse_GlobalChomp(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	const template = "a\n  [% x %]  \n  b\n[% y %]\r\nc"
+	vars := Vars{"x": 1, "y": 2}
+	for _, mode := range []struct {
+		pre, post parser.ChompMode
+		expected  string
+	}{
+		{parser.ChompNone, parser.ChompNone, "a\n  1  \n  b\n2\r\nc"},
+		{parser.ChompOne, parser.ChompNone, "a1  \n  b2\r\nc"},
+		{parser.ChompNone, parser.ChompOne, "a\n  1  b\n2c"},
+		{parser.ChompCollapse, parser.ChompCollapse, "a 1 b 2 c"},
+		{parser.ChompGreedy, parser.ChompGreedy, "a1b2c"},
+	} {
+		c.XslateArgs["Parser"] = Args{"PreChomp": mode.pre, "PostChomp": mode.post}
+		c.renderStringAndCompare(template, vars, mode.expected)
+	}
+
+	// Markers take precedence over the global modes
+	c.XslateArgs["Parser"] = Args{"PreChomp": parser.ChompGreedy, "PostChomp": int(parser.ChompGreedy)}
+	c.renderStringAndCompare("a \n [%+ x +%] \n b [%~ y %] c", vars, "a \n 1 \n b 2c")
+
+	// A tag that is not the first thing in its line keeps the spaces
+	// before it with ChompOne
+	c.XslateArgs["Parser"] = Args{"PreChomp": parser.ChompOne}
+	c.renderStringAndCompare("a  [% x %]\n  [% y %]", vars, "a  12")
+
+	for _, args := range []Args{{"PreChomp": 4}, {"PostChomp": "greedy"}, {"Trim": 1}} {
+		c.XslateArgs["Parser"] = args
+		if _, err := New(c.XslateArgs); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
+}
+
+func TestTTerse_Trim(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.XslateArgs["Parser"] = Args{"Trim": true}
+	vars := Vars{"x": 1}
+	c.renderStringAndCompare("\n  [% x %] \n", vars, `1`)
+	c.renderStringAndCompare("\n  Hello, [% x %]!\n\n", vars, `Hello, 1!`)
+	c.renderStringAndCompare("[% BLOCK foo %]\n  foo\n[% END %]<[% PROCESS foo %]>", vars, `<foo>`)
+	c.renderStringAndCompare("[% MACRO m BLOCK %]\n  m [% x %]\n[% END %]<[% m() %]>", vars, `<m 1>`)
+
+	// Whitespace printed by expressions is kept
+	c.renderStringAndCompare(`[% " x " %]`, vars, ` x `)
+}
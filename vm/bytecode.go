@@ -7,13 +7,18 @@ import (
 	"github.com/lestrrat-go/xslate/internal/rbpool"
 )
 
+// ByteCodeVersion is the version of the ByteCode created by this package.
+// It changes whenever the op codes or their encoding change, so that
+// ByteCode cached by another version is compiled again
+const ByteCodeVersion float32 = 2.0
+
 // NewByteCode creates an empty ByteCode instance.
 func NewByteCode() *ByteCode {
 	return &ByteCode{
 		GeneratedOn: time.Now(),
 		Name:        "",
 		OpList:      nil,
-		Version:     1.0,
+		Version:     ByteCodeVersion,
 	}
 }
 
@@ -41,6 +46,37 @@ func (b *ByteCode) AppendOp(o OpType, args ...interface{}) Op {
 	return x
 }
 
+// Position returns the location in the template source of the op at
+// location i. The zero SourcePos is returned if the location is unknown
+func (b *ByteCode) Position(i int) SourcePos {
+	if i < 0 || i >= len(b.Positions) {
+		return SourcePos{}
+	}
+	return b.Positions[i]
+}
+
+// Origin returns the name and the source of the template that the op at
+// location i was compiled from
+func (b *ByteCode) Origin(i int) (string, string) {
+	for _, s := range b.Sections {
+		if i >= s.Start && i < s.End {
+			return s.Name, s.Source
+		}
+	}
+	return b.Name, b.Source
+}
+
+// SetPosition records the location in the template source of the op at
+// location i
+func (b *ByteCode) SetPosition(i int, pos SourcePos) {
+	if i >= len(b.Positions) {
+		l := make([]SourcePos, b.Len())
+		copy(l, b.Positions)
+		b.Positions = l
+	}
+	b.Positions[i] = pos
+}
+
 // String returns the textual representation of this ByteCode
 func (b *ByteCode) String() string {
 	buf := rbpool.Get()
@@ -1,9 +1,13 @@
 package vm
 
 import (
+	"bytes"
+	"encoding/gob"
 	"fmt"
 	"testing"
 	"time"
+
+	"github.com/lestrrat-go/xslate/node"
 )
 
 func TestByteCode_Len(t *testing.T) {
@@ -32,3 +36,65 @@ func TestByteCode_String(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, bc.String())
 	}
 }
+
+func TestByteCode_Position(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, "foo")
+	bc.AppendOp(TXOPPrint)
+	bc.AppendOp(TXOPEnd)
+
+	bc.SetPosition(1, SourcePos{Line: 3, Column: 4})
+	if pos := bc.Position(1); pos.Line != 3 || pos.Column != 4 {
+		t.Errorf("Expected position 3:4, got %d:%d", pos.Line, pos.Column)
+	}
+
+	for _, i := range []int{-1, 0, 2, 3} {
+		if pos := bc.Position(i); pos.Line != 0 {
+			t.Errorf("Expected unknown position for op %d, got %d:%d", i, pos.Line, pos.Column)
+		}
+	}
+}
+
+func TestByteCode_Gob(t *testing.T) {
+	bc := NewByteCode()
+	bc.Name = "index.tx"
+	bc.Source = "[% foo %]"
+	bc.GeneratedOn = time.Unix(1500000000, 0)
+	bc.AppendOp(TXOPLiteral, "foo").SetComment("a comment")
+	bc.AppendOp(TXOPLiteral, 1)
+	bc.AppendOp(TXOPLiteral, int64(2))
+	bc.AppendOp(TXOPLiteral, 3.5)
+	bc.AppendOp(TXOPLiteral, true)
+	bc.AppendOp(TXOPLiteral, []byte("bar"))
+	bc.AppendOp(TXOPLoadLvar, node.NewLocalVarNode(0, "baz", 2))
+	bc.AppendOp(TXOPEnd)
+	bc.SetPosition(0, SourcePos{Line: 1, Column: 4})
+
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(bc); err != nil {
+		t.Fatalf("Failed to encode ByteCode: %s", err)
+	}
+
+	var decoded ByteCode
+	if err := gob.NewDecoder(buf).Decode(&decoded); err != nil {
+		t.Fatalf("Failed to decode ByteCode: %s", err)
+	}
+
+	if decoded.Name != bc.Name || decoded.Source != bc.Source {
+		t.Errorf("Expected name/source to be preserved, got '%s'/'%s'", decoded.Name, decoded.Source)
+	}
+
+	if decoded.String() != bc.String() {
+		t.Errorf("Expected decoded ByteCode to be\n%s\ngot\n%s", bc, &decoded)
+	}
+
+	for i, arg := range []interface{}{"foo", 1, int64(2), 3.5, true} {
+		if v := decoded.Get(i).Arg(); v != arg {
+			t.Errorf("Expected arg %#v for op %d, got %#v", arg, i, v)
+		}
+	}
+
+	if pos := decoded.Position(0); pos.Line != 1 || pos.Column != 4 {
+		t.Errorf("Expected position 1:4, got %d:%d", pos.Line, pos.Column)
+	}
+}
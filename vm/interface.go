@@ -1,8 +1,10 @@
 package vm
 
 import (
+	"context"
 	"io"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/lestrrat-go/xslate/internal/stack"
@@ -15,6 +17,31 @@ type ByteCode struct {
 	GeneratedOn time.Time
 	Name        string
 	Version     float32
+	Positions   []SourcePos // location in Source of each op in OpList
+	Source      string      // template source, used for error messages
+	Sections    []Section   // ops compiled from other templates (see CASCADE)
+
+	// set for ByteCode that was taken from the middle of another one,
+	// whose ops are referred to by their original position
+	root *ByteCode
+}
+
+// Section is a range of ops in a ByteCode that were compiled from a
+// template other than the one named by ByteCode.Name, as is the case
+// with templates that cascade from another
+type Section struct {
+	Start  int // index of the first op
+	End    int // index of the op after the last one
+	Name   string
+	Source string
+}
+
+// SourcePos is the location in the template source that an op was
+// compiled from. Line and Column start from 1. A zero Line means that
+// the location is unknown
+type SourcePos struct {
+	Line   int
+	Column int
 }
 
 // OpType is an integer identifying the type of op code
@@ -71,6 +98,36 @@ type State struct {
 
 	Loader       byteCodeLoader
 	MaxLoopCount int
+
+	// set by ops when execution cannot continue
+	err error
+
+	// given to VM.RunContext, and passed down to nested templates
+	ctx context.Context
+
+	// execution limits. budget points to ownBudget, unless this is
+	// a nested template, in which case it's shared with the caller
+	limits    Limits
+	depth     int
+	budget    *budget
+	ownBudget budget
+
+	escape EscapeMode
+
+	// user-defined filters, by name
+	filters Vars
+}
+
+// RuntimeError is the error returned by VM.Run when the bytecode could
+// not be executed. It records which op caused the error
+type RuntimeError struct {
+	Name    string // name of the template (ByteCode.Name)
+	OpIndex int    // position of the failing op in the ByteCode
+	Op      OpType // type of the failing op
+	Line    int    // line in the template source, 0 if unknown
+	Column  int    // column in the template source, 0 if unknown
+	Message string
+	Snippet string // offending line from the template source, if available
 }
 
 // LoopVar is the variable available within FOREACH loops
@@ -86,6 +143,33 @@ type LoopVar struct {
 	IsLast   bool          // true only if Index == MaxIndex
 }
 
+// Pair is the item given to FOREACH loops over maps. Pairs are visited
+// in sorted key order: numeric keys first, then all others as strings
+type Pair struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// Macro is the value of a MACRO defined in a template. Macros can be
+// called like functions, or used as filters, and return their output
+// as a Raw string
+type Macro struct {
+	Name     string
+	ByteCode *ByteCode // bytecode that contains the macro
+	Entry    int       // position of the first op of the macro in ByteCode
+	Params   []string  // names of the parameters, in order
+
+	// Local variables of the template that defined the macro. This is
+	// only set for macros that were IMPORTed from other templates, as
+	// otherwise the local variables of the caller are used
+	Frame []interface{}
+}
+
+// NamedArgs holds the named arguments given to a function call, as in
+// `foo(bar => 1)`. Functions that accept a map[string]interface{} as
+// their last argument receive them as such
+type NamedArgs map[string]interface{}
+
 // Vars represents the variables passed into the Virtual Machine
 type Vars map[string]interface{}
 
@@ -95,11 +179,79 @@ type byteCodeLoader interface {
 	Load(string) (*ByteCode, error)
 }
 
-// VM represents the Xslate Virtual Machine
+// VM represents the Xslate Virtual Machine. A VM does not hold any
+// execution state of its own, so the same VM may be used to run templates
+// from multiple goroutines
 type VM struct {
-	st        *State
 	functions Vars
+	filters   Vars
+	warn      io.Writer
+	limits    Limits
+	escape    EscapeMode
 	Loader    byteCodeLoader
+
+	// only used for nested templates (see State.runNestedFrame)
+	frame []interface{}
+	exit  func(*State)
+
+	// the op where the last Run stopped (see CurrentOp)
+	lastOpMu sync.Mutex
+	lastOp   Op
+}
+
+// EscapeMode specifies how values are escaped when they are printed
+type EscapeMode int
+
+// These are the possible EscapeMode values
+const (
+	EscapeHTML EscapeMode = iota // escape HTML special characters (default)
+	EscapeNone                   // print values as is
+)
+
+// Raw is a string that is printed as is, regardless of the EscapeMode.
+// Use it to pass values that are already HTML-escaped (or otherwise
+// known to be safe) to templates. The mark_raw filter creates these
+type Raw string
+
+// Limits describes the execution budget for a single call to VM.Run.
+// Templates executed through INCLUDE, WRAPPER and macro calls share the
+// budget of the template that called them. A zero value means that
+// there is no limit
+type Limits struct {
+	MaxOps         int // number of ops executed
+	MaxOutputBytes int // number of bytes written to the output
+	MaxDepth       int // nesting depth of INCLUDE, WRAPPER and macro calls
+	MaxLoopCount   int // number of iterations in a single FOREACH or WHILE loop
+}
+
+// Default values for Limits used by NewVM
+const (
+	DefaultMaxDepth     = 100
+	DefaultMaxLoopCount = 1000
+)
+
+// LimitError is the error returned by VM.Run when the execution of a
+// template goes over one of the Limits. Limit is the name of the field
+// in Limits that was exceeded, and Max is its value
+type LimitError struct {
+	*RuntimeError
+	Limit string
+	Max   int
+}
+
+// budget keeps track of resources used by a template, and all the
+// templates that it calls
+type budget struct {
+	ops    int
+	output *limitWriter
+}
+
+// limitWriter is an io.Writer that stops writing to the underlying
+// writer after `remaining` bytes have been written
+type limitWriter struct {
+	w         io.Writer
+	remaining int
+	exceeded  bool
 }
 
 // These TXOP... constants are identifiers for each op
@@ -151,6 +303,28 @@ const (
 	TXOPFilter
 	TXOPSaveWriter
 	TXOPRestoreWriter
+	TXOPMakeMacro
+	TXOPOr
+	TXOPDefinedOr
+	TXOPNot
+	TXOPLessThanEquals
+	TXOPGreaterThanEquals
+	TXOPCmp
+	TXOPStrLessThan
+	TXOPStrGreaterThan
+	TXOPStrLessThanEquals
+	TXOPStrGreaterThanEquals
+	TXOPStrCmp
+	TXOPMod
+	TXOPConcat
+	TXOPUnaryMinus
+	TXOPUnaryPlus
+	TXOPMakeNamedArgs
+	TXOPImport
+	TXOPCallBlock
+	TXOPWhileIter
+	TXOPStrEquals
+	TXOPStrNotEquals
 	TXOPEnd
 	TXOPMax
 )
@@ -3,8 +3,9 @@ package vm
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/gob"
 	"fmt"
-	"reflect"
+	"io"
 
 	"github.com/lestrrat-go/xslate/internal/rbpool"
 	"github.com/lestrrat-go/xslate/node"
@@ -47,6 +48,44 @@ func (o op) Handler() OpHandler {
 	return o.OpHandler
 }
 
+// Argument types, as encoded by MarshalBinary
+const (
+	argInt      = 1
+	argInt64    = 2
+	argFloat64  = 3
+	argBool     = 4
+	argBytes    = 5
+	argString   = 6
+	argLocalVar = 7
+)
+
+func init() {
+	// ByteCode.OpList holds Op interfaces, so the concrete type needs
+	// to be registered in order for ByteCode to be gob-encoded
+	gob.Register(&op{})
+}
+
+func writeBinaryString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.LittleEndian, int64(len(s)))
+	buf.WriteString(s)
+}
+
+func readBinaryString(buf *bytes.Reader) (string, error) {
+	var l int64
+	if err := binary.Read(buf, binary.LittleEndian, &l); err != nil {
+		return "", errors.Wrap(err, "failed to read length")
+	}
+	if l < 0 || l > int64(buf.Len()) {
+		return "", errors.Errorf("invalid length %d", l)
+	}
+
+	b := make([]byte, l)
+	if _, err := io.ReadFull(buf, b); err != nil {
+		return "", errors.Wrap(err, "failed to read bytes")
+	}
+	return string(b), nil
+}
+
 // MarshalBinary is used to serialize an Op into a binary form. This
 // is used to cache the ByteCode
 func (o op) MarshalBinary() ([]byte, error) {
@@ -59,8 +98,7 @@ func (o op) MarshalBinary() ([]byte, error) {
 	}
 
 	// If this has args, we need to encode the args
-	tArg := reflect.TypeOf(o.uArg)
-	hasArg := tArg != nil
+	hasArg := o.uArg != nil
 	if hasArg {
 		binary.Write(buf, binary.LittleEndian, int8(1))
 	} else {
@@ -68,30 +106,31 @@ func (o op) MarshalBinary() ([]byte, error) {
 	}
 
 	if hasArg {
-		switch tArg.Kind() {
-		case reflect.Int:
-			binary.Write(buf, binary.LittleEndian, int64(2))
-			binary.Write(buf, binary.LittleEndian, int64(o.uArg.(int)))
-		case reflect.Int64:
-			binary.Write(buf, binary.LittleEndian, int64(2))
-			binary.Write(buf, binary.LittleEndian, int64(o.uArg.(int64)))
-		case reflect.Slice:
-			if tArg.Elem().Kind() != reflect.Uint8 {
-				panic("Slice of what?")
-			}
-			binary.Write(buf, binary.LittleEndian, int64(5))
-			binary.Write(buf, binary.LittleEndian, int64(len(o.uArg.([]byte))))
-			for _, v := range o.uArg.([]byte) {
-				binary.Write(buf, binary.LittleEndian, v)
-			}
-		case reflect.String:
-			binary.Write(buf, binary.LittleEndian, int64(6))
-			binary.Write(buf, binary.LittleEndian, int64(len(o.uArg.(string))))
-			for _, v := range []byte(o.uArg.(string)) {
-				binary.Write(buf, binary.LittleEndian, v)
-			}
+		switch v := o.uArg.(type) {
+		case int:
+			binary.Write(buf, binary.LittleEndian, int64(argInt))
+			binary.Write(buf, binary.LittleEndian, int64(v))
+		case int64:
+			binary.Write(buf, binary.LittleEndian, int64(argInt64))
+			binary.Write(buf, binary.LittleEndian, v)
+		case float64:
+			binary.Write(buf, binary.LittleEndian, int64(argFloat64))
+			binary.Write(buf, binary.LittleEndian, v)
+		case bool:
+			binary.Write(buf, binary.LittleEndian, int64(argBool))
+			binary.Write(buf, binary.LittleEndian, v)
+		case []byte:
+			binary.Write(buf, binary.LittleEndian, int64(argBytes))
+			writeBinaryString(buf, string(v))
+		case string:
+			binary.Write(buf, binary.LittleEndian, int64(argString))
+			writeBinaryString(buf, v)
+		case *node.LocalVarNode:
+			binary.Write(buf, binary.LittleEndian, int64(argLocalVar))
+			binary.Write(buf, binary.LittleEndian, int64(v.Offset))
+			writeBinaryString(buf, v.Name)
 		default:
-			panic("Unknown type " + tArg.String())
+			return nil, errors.Errorf("failed to marshal op to binary: unsupported argument type %T", o.uArg)
 		}
 	}
 
@@ -99,12 +138,15 @@ func (o op) MarshalBinary() ([]byte, error) {
 	hasComment := v != ""
 	if hasComment {
 		binary.Write(buf, binary.LittleEndian, int8(1))
-		binary.Write(buf, binary.LittleEndian, v)
+		writeBinaryString(buf, v)
 	} else {
 		binary.Write(buf, binary.LittleEndian, int8(0))
 	}
 
-	return buf.Bytes(), nil
+	// buf goes back to the pool, so we need a copy
+	ret := make([]byte, buf.Len())
+	copy(ret, buf.Bytes())
+	return ret, nil
 }
 
 // UnmarshalBinary is used to deserialize an Op from binary form.
@@ -131,27 +173,50 @@ func (o *op) UnmarshalBinary(data []byte) error {
 		}
 
 		switch tArg {
-		case 2:
+		case argInt, argInt64:
 			var i int64
 			if err := binary.Read(buf, binary.LittleEndian, &i); err != nil {
 				return errors.Wrap(err, "failed to read integer argument during UnmarshalBinary")
 			}
-			o.uArg = i
-		case 5:
-			var l int64
-			if err := binary.Read(buf, binary.LittleEndian, &l); err != nil {
-				return errors.Wrap(err, "failed to read length argument during UnmarshalBinary")
+			if tArg == argInt {
+				o.uArg = int(i)
+			} else {
+				o.uArg = i
 			}
-
-			b := make([]byte, l)
-			for i := int64(0); i < l; i++ {
-				if err := binary.Read(buf, binary.LittleEndian, &b[i]); err != nil {
-					return errors.Wrap(err, "failed to read bytes from buffer during UnmarshalBinary")
-				}
+		case argFloat64:
+			var f float64
+			if err := binary.Read(buf, binary.LittleEndian, &f); err != nil {
+				return errors.Wrap(err, "failed to read float argument during UnmarshalBinary")
+			}
+			o.uArg = f
+		case argBool:
+			var b bool
+			if err := binary.Read(buf, binary.LittleEndian, &b); err != nil {
+				return errors.Wrap(err, "failed to read bool argument during UnmarshalBinary")
 			}
 			o.uArg = b
+		case argBytes, argString:
+			s, err := readBinaryString(buf)
+			if err != nil {
+				return errors.Wrap(err, "failed to read string argument during UnmarshalBinary")
+			}
+			if tArg == argBytes {
+				o.uArg = []byte(s)
+			} else {
+				o.uArg = s
+			}
+		case argLocalVar:
+			var offset int64
+			if err := binary.Read(buf, binary.LittleEndian, &offset); err != nil {
+				return errors.Wrap(err, "failed to read local variable offset during UnmarshalBinary")
+			}
+			name, err := readBinaryString(buf)
+			if err != nil {
+				return errors.Wrap(err, "failed to read local variable name during UnmarshalBinary")
+			}
+			o.uArg = node.NewLocalVarNode(0, name, int(offset))
 		default:
-			panic(fmt.Sprintf("Unknown tArg: %d", tArg))
+			return errors.Errorf("unknown argument type %d during UnmarshalBinary", tArg)
 		}
 	}
 
@@ -161,9 +226,11 @@ func (o *op) UnmarshalBinary(data []byte) error {
 	}
 
 	if hasComment == 1 {
-		if err := binary.Read(buf, binary.LittleEndian, &o.comment); err != nil {
-			return errors.Wrap(err, "failed to read comment bytes during UnmarshalBinary")
+		s, err := readBinaryString(buf)
+		if err != nil {
+			return errors.Wrap(err, "failed to read comment during UnmarshalBinary")
 		}
+		o.comment = s
 	}
 
 	return nil
@@ -208,8 +275,7 @@ func (o *op) String() string {
 
 	fmt.Fprintf(&buf, "Op[%s]", o.Type())
 
-	if o.Type() == TXOPLoadLvar {
-		n := o.uArg.(*node.LocalVarNode)
+	if n, ok := o.uArg.(*node.LocalVarNode); ok {
 		fmt.Fprintf(&buf, " '%s' (%d)", n.Name, n.Offset)
 	} else {
 		if o.uArg != nil {
@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"html"
 	"io"
+	"io/ioutil"
+	"math"
 	"reflect"
+	"sort"
 	"strconv"
 	"unicode"
 	"unicode/utf8"
@@ -87,6 +90,69 @@ func init() {
 		case TXOPAnd:
 			h = txAnd
 			n = "and"
+		case TXOPOr:
+			h = txOr
+			n = "or"
+		case TXOPDefinedOr:
+			h = txDefinedOr
+			n = "dor"
+		case TXOPNot:
+			h = txNot
+			n = "not"
+		case TXOPLessThanEquals:
+			h = txLessThanEquals
+			n = "less_than_equals"
+		case TXOPGreaterThanEquals:
+			h = txGreaterThanEquals
+			n = "greater_than_equals"
+		case TXOPCmp:
+			h = txCmp
+			n = "ncmp"
+		case TXOPStrLessThan:
+			h = txStrLessThan
+			n = "str_less_than"
+		case TXOPStrGreaterThan:
+			h = txStrGreaterThan
+			n = "str_greater_than"
+		case TXOPStrLessThanEquals:
+			h = txStrLessThanEquals
+			n = "str_less_than_equals"
+		case TXOPStrGreaterThanEquals:
+			h = txStrGreaterThanEquals
+			n = "str_greater_than_equals"
+		case TXOPStrCmp:
+			h = txStrCmp
+			n = "scmp"
+		case TXOPMod:
+			h = txMod
+			n = "mod"
+		case TXOPConcat:
+			h = txConcat
+			n = "concat"
+		case TXOPUnaryMinus:
+			h = txUnaryMinus
+			n = "minus"
+		case TXOPUnaryPlus:
+			h = txUnaryPlus
+			n = "plus"
+		case TXOPMakeNamedArgs:
+			h = txMakeNamedArgs
+			n = "make_named_args"
+		case TXOPImport:
+			h = txImport
+			n = "import"
+		case TXOPCallBlock:
+			h = txCallBlock
+			n = "call_block"
+		case TXOPStrEquals:
+			h = txStrEquals
+			n = "str_equals"
+		case TXOPStrNotEquals:
+			h = txStrNotEquals
+			n = "str_not_equals"
+		case TXOPWhileIter:
+			h = txWhileIter
+			n = "while_iter"
 		case TXOPGoto:
 			h = txGoto
 			n = "goto"
@@ -168,6 +234,9 @@ func init() {
 		case TXOPRestoreWriter:
 			h = txRestoreWriter
 			n = "restore_writer"
+		case TXOPMakeMacro:
+			h = txMakeMacro
+			n = "make_macro"
 		default:
 			panic("No such optype")
 		}
@@ -265,61 +334,88 @@ func txFetchField(st *State) {
 			}
 
 			if v.Type().Name() == "LoopVar" {
-				// some special treatment here
+				// some special treatment here. The second set of
+				// names are the ones used by Kolon
 				switch name {
-				case "Max":
+				case "Max", "Max_index":
 					name = "MaxIndex"
-				case "Next":
+				case "Next", "Peek_next":
 					name = "PeekNext"
-				case "Prev":
-					name = "PeeekPrev"
-				case "First":
+				case "Prev", "Peek_prev":
+					name = "PeekPrev"
+				case "First", "Is_first":
 					name = "IsFirst"
-				case "Last":
+				case "Last", "Is_last":
 					name = "IsLast"
 				}
 			}
 
 			f = v.FieldByName(name)
+			if !f.IsValid() {
+				st.Errorf("cannot fetch field '%s': no such field in %s", name, v.Type())
+				return
+			}
 		case reflect.Map:
 			v = reflect.ValueOf(container)
 			f = v.MapIndex(reflect.ValueOf(name))
 		default:
-			panic(fmt.Sprintf("XXX Put proper error handling here: %s (%s)", container, t))
+			st.Errorf("cannot fetch field '%s' from non-struct/map value (%s)", name, t)
+			return
 		}
 
-		st.sa = f.Interface()
+		if f.IsValid() {
+			st.sa = f.Interface()
+		} else {
+			// Missing map keys are simply undefined
+			st.sa = nil
+		}
 	}
 	st.Advance()
 }
 
 func txFetchArrayElement(st *State) {
-	defer st.Advance()
-
 	array := reflect.ValueOf(st.StackPop())
 	switch array.Kind() {
 	case reflect.Array, reflect.Slice:
+	case reflect.Map:
+		// Hashes are subscripted by their keys, as in `$h["key"]`
+		key := reflect.ValueOf(interfaceToString(st.StackPop()))
+		kt := array.Type().Key()
+		if !key.Type().ConvertibleTo(kt) {
+			st.Errorf("cannot index into map with %s keys", kt)
+			return
+		}
+		if v := array.MapIndex(key.Convert(kt)); v.IsValid() {
+			st.sa = v.Interface()
+		} else {
+			// Missing map keys are simply undefined
+			st.sa = nil
+		}
+		st.Advance()
+		return
 	default:
-		st.Warnf("cannot index into non-array/slice element")
+		st.Errorf("cannot index into non-array/slice/map element")
 		return
 	}
 
-	idx := st.StackPop()
-	v := array.Index(int(idx.(int64)))
-	st.sa = v.Interface()
+	idx := int(interfaceToNumeric(st.StackPop()).Convert(reflect.TypeOf(0)).Int())
+	if idx < 0 || idx >= array.Len() {
+		// Out of range elements are undefined
+		st.sa = nil
+	} else {
+		st.sa = array.Index(idx).Interface()
+	}
+	st.Advance()
 }
 
-type rawString string
-
-func (s rawString) String() string { return string(s) }
-
-var rawStringType = reflect.TypeOf(new(rawString)).Elem()
+// String returns the raw string
+func (s Raw) String() string { return string(s) }
 
 // Wraps the contents of register sa with a "raw string" mark
 // Note that this effectively stringifies the contents of register sa
 func txMarkRaw(st *State) {
-	if reflect.ValueOf(st.sa).Type() != rawStringType {
-		st.sa = rawString(interfaceToString(st.sa))
+	if _, ok := st.sa.(Raw); !ok {
+		st.sa = Raw(interfaceToString(st.sa))
 	}
 	st.Advance()
 }
@@ -328,22 +424,25 @@ func txMarkRaw(st *State) {
 // the "raw string" mark, forcing html escapes to be applied when printing.
 // Note that this effectively stringifies the contents of register sa
 func txUnmarkRaw(st *State) {
-	if reflect.ValueOf(st.sa).Type() == rawStringType {
-		st.sa = string(interfaceToString(st.sa))
+	if v, ok := st.sa.(Raw); ok {
+		st.sa = string(v)
 	}
 	st.Advance()
 }
 
 // Prints the contents of register sa to Output.
-// Forcefully applies html escaping unless the variable in sa is marked "raw"
+// Applies html escaping unless the variable in sa is marked "raw", or
+// auto escaping has been turned off
 func txPrint(st *State) {
 	arg := st.sa
 	if arg == nil {
 		st.Warnf("Use of nil to print\n")
-	} else if reflect.ValueOf(st.sa).Type() != rawStringType {
-		st.AppendOutputString(html.EscapeString(interfaceToString(arg)))
-	} else {
+	} else if v, ok := arg.(Raw); ok {
+		st.AppendOutputString(string(v))
+	} else if st.escape == EscapeNone {
 		st.AppendOutputString(interfaceToString(arg))
+	} else {
+		st.AppendOutputString(html.EscapeString(interfaceToString(arg)))
 	}
 	st.Advance()
 }
@@ -372,10 +471,21 @@ func txSaveToLvar(st *State) {
 }
 
 func txLoadLvar(st *State) {
-	n := st.CurrentOp().Arg().(*node.LocalVarNode)
-	v, err := st.CurrentFrame().GetLvar(n.Offset)
+	// The compiler gives us a *node.LocalVarNode, but hand-assembled
+	// bytecode may just specify the offset
+	var idx int
+	var name string
+	switch arg := st.CurrentOp().Arg().(type) {
+	case *node.LocalVarNode:
+		idx, name = arg.Offset, arg.Name
+	default:
+		idx = st.CurrentOp().ArgInt()
+		name = strconv.Itoa(idx)
+	}
+
+	v, err := st.CurrentFrame().GetLvar(idx)
 	if err != nil {
-		st.Warnf("failed to load variable '%s': %s\n", n.Name, err)
+		st.Warnf("failed to load variable '%s': %s\n", name, err)
 	} else {
 		st.sa = v
 	}
@@ -427,21 +537,112 @@ func txMul(st *State) {
 	st.Advance()
 }
 
+// txDiv divides sb by sa. Integers that divide evenly give an integer,
+// otherwise the result is a float, so that 10 / 4 is 2.5
 func txDiv(st *State) {
+	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
+	switch leftV.Kind() {
+	case reflect.Int64:
+		l, r := leftV.Int(), rightV.Int()
+		if r == 0 {
+			st.Errorf("division by zero")
+			return
+		}
+		if l%r == 0 {
+			st.sa = l / r
+		} else {
+			st.sa = float64(l) / float64(r)
+		}
+	case reflect.Uint64:
+		l, r := leftV.Uint(), rightV.Uint()
+		if r == 0 {
+			st.Errorf("division by zero")
+			return
+		}
+		if l%r == 0 {
+			st.sa = l / r
+		} else {
+			st.sa = float64(l) / float64(r)
+		}
+	case reflect.Float64:
+		if rightV.Float() == 0 {
+			st.Errorf("division by zero")
+			return
+		}
+		st.sa = leftV.Float() / rightV.Float()
+	}
+
+	// XXX: set to targ?
+	st.Advance()
+}
+
+func txMod(st *State) {
 	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
 	switch leftV.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		// XXX This is a hack. We rely on interfaceToString() using FormatFloat(prec = -1)
-		// to get rid of the fractional portions when printing
-		typeF := reflect.TypeOf(0.1)
-		st.sa = leftV.Convert(typeF).Float() / rightV.Convert(typeF).Float()
+		if rightV.Int() == 0 {
+			st.Errorf("modulus by zero")
+			return
+		}
+		st.sa = leftV.Int() % rightV.Int()
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() / rightV.Uint()
+		if rightV.Uint() == 0 {
+			st.Errorf("modulus by zero")
+			return
+		}
+		st.sa = leftV.Uint() % rightV.Uint()
 	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() / rightV.Float()
+		if rightV.Float() == 0 {
+			st.Errorf("modulus by zero")
+			return
+		}
+		st.sa = math.Mod(leftV.Float(), rightV.Float())
 	}
+	st.Advance()
+}
 
-	// XXX: set to targ?
+// txConcat concatenates sb and sa as strings. The result is only Raw
+// if both operands are, as otherwise we can't tell which parts need
+// to be escaped
+func txConcat(st *State) {
+	s := interfaceToString(st.sb) + interfaceToString(st.sa)
+	_, leftRaw := st.sb.(Raw)
+	_, rightRaw := st.sa.(Raw)
+	if leftRaw && rightRaw {
+		st.sa = Raw(s)
+	} else {
+		st.sa = s
+	}
+	st.Advance()
+}
+
+func txUnaryMinus(st *State) {
+	n, ok := interfaceToNumber(st.sa)
+	if !ok {
+		st.Errorf("cannot negate %T", st.sa)
+		return
+	}
+
+	v := reflect.ValueOf(n)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		st.sa = -v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		st.sa = -int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		st.sa = -v.Float()
+	}
+	st.Advance()
+}
+
+// txUnaryPlus converts sa to a number
+func txUnaryPlus(st *State) {
+	n, ok := interfaceToNumber(st.sa)
+	if !ok {
+		st.Errorf("cannot convert %T to a number", st.sa)
+		return
+	}
+	st.sa = n
 	st.Advance()
 }
 
@@ -453,6 +654,29 @@ func txAnd(st *State) {
 	}
 }
 
+// txOr jumps when sa is true, which is the opposite of txAnd
+func txOr(st *State) {
+	if interfaceToBool(st.sa) {
+		st.AdvanceBy(st.CurrentOp().ArgInt())
+	} else {
+		st.Advance()
+	}
+}
+
+// txDefinedOr jumps when sa is not nil
+func txDefinedOr(st *State) {
+	if st.sa != nil {
+		st.AdvanceBy(st.CurrentOp().ArgInt())
+	} else {
+		st.Advance()
+	}
+}
+
+func txNot(st *State) {
+	st.sa = !interfaceToBool(st.sa)
+	st.Advance()
+}
+
 func txGoto(st *State) {
 	st.AdvanceBy(st.CurrentOp().ArgInt())
 }
@@ -473,52 +697,125 @@ func NewLoopVar(idx int, array reflect.Value) *LoopVar {
 	return lv
 }
 
+// mapToPairs converts a map to a list of Pairs, sorted by key
+func mapToPairs(m reflect.Value) []Pair {
+	pairs := make([]Pair, 0, m.Len())
+	for _, k := range m.MapKeys() {
+		pairs = append(pairs, Pair{Key: k.Interface(), Value: m.MapIndex(k).Interface()})
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return compareKeys(pairs[i].Key, pairs[j].Key) < 0
+	})
+	return pairs
+}
+
+// compareKeys orders map keys so that keys that are numbers come first,
+// in numeric order, followed by all other keys in string order. Numbers
+// that compare equal (as in "1" and "1.0") are ordered as strings
+func compareKeys(left, right interface{}) int {
+	_, leftOK := interfaceToNumber(left)
+	_, rightOK := interfaceToNumber(right)
+	switch {
+	case leftOK && rightOK:
+		if c, err := compareNumeric(left, right); err == nil && c != 0 {
+			return c
+		}
+	case leftOK:
+		return -1
+	case rightOK:
+		return 1
+	}
+
+	c, _ := compareString(left, right)
+	return c
+}
+
 func txForStart(st *State) {
 	array := reflect.ValueOf(st.sa)
 
 	switch array.Kind() {
 	case reflect.Array, reflect.Slice:
 		// Normal case. nothing to do
+	case reflect.Map:
+		array = reflect.ValueOf(mapToPairs(array))
 	default:
 		// Oh you silly goose. You didn't give me a array.
 		// Use a dummy array
 		array = reflect.ValueOf([]struct{}{})
 	}
 
+	// The item goes in the local variable given by the compiler, and
+	// the loop variable right after it
+	idx := st.CurrentOp().ArgInt()
 	cf := st.CurrentFrame()
-	cf.SetLvar(0, nil) // item
-	cf.SetLvar(1, NewLoopVar(-1, array))
+	cf.SetLvar(idx, nil) // item
+	cf.SetLvar(idx+1, NewLoopVar(-1, array))
 
 	st.Advance()
 }
 
+// txWhileIter counts the iterations of a WHILE loop in the local
+// variable given as its argument, and stops the loop when it goes
+// over MaxLoopCount
+func txWhileIter(st *State) {
+	idx := st.CurrentOp().ArgInt()
+	cf := st.CurrentFrame()
+	v, err := cf.GetLvar(idx)
+	if err != nil {
+		st.Errorf("loop counter not found: %s", err)
+		return
+	}
+
+	count, ok := v.(int)
+	if !ok {
+		st.Errorf("expected loop counter to be an int, got %T", v)
+		return
+	}
+	count++
+	if st.MaxLoopCount > 0 && count > st.MaxLoopCount {
+		st.err = st.newLimitError(st.opidx, "MaxLoopCount", st.MaxLoopCount)
+		return
+	}
+	cf.SetLvar(idx, count)
+	st.Advance()
+}
+
+// txForIter expects the index of the item variable in sa
 func txForIter(st *State) {
+	idx, ok := st.sa.(int)
+	if !ok {
+		st.Errorf("expected index of loop item in sa, got %T", st.sa)
+		return
+	}
 	cf := st.CurrentFrame()
 	var loop *LoopVar
 
-	// The loop variable MUST exist. Not having one is a sure panic
-	v, err := cf.GetLvar(1)
+	// The loop variable MUST exist
+	v, err := cf.GetLvar(idx + 1)
 	if err != nil {
-		panic("loop var not found: " + err.Error())
+		st.Errorf("loop var not found: %s", err)
+		return
 	}
 
-	var ok bool
 	if loop, ok = v.(*LoopVar); !ok {
-		panic("failed to convert loop var")
+		st.Errorf("failed to convert loop var")
+		return
 	}
 
 	slice := loop.Body
 	loop.Index++
 	loop.Count++
-	if loop.Count > st.MaxLoopCount {
-		panic("looped for " + strconv.Itoa(loop.Count) + " times, aborting")
+	if st.MaxLoopCount > 0 && loop.Count > st.MaxLoopCount {
+		st.err = st.newLimitError(st.opidx, "MaxLoopCount", st.MaxLoopCount)
+		return
 	}
 
 	loop.IsFirst = loop.Index == 0
 	loop.IsLast = loop.Index == loop.MaxIndex
 
 	if loop.Size > loop.Index {
-		cf.SetLvar(0, slice.Index(loop.Index).Interface())
+		cf.SetLvar(idx, slice.Index(loop.Index).Interface())
 
 		if loop.Size > loop.Index+1 {
 			loop.PeekNext = slice.Index(loop.Index + 1).Interface()
@@ -539,20 +836,55 @@ func txForIter(st *State) {
 	st.AdvanceBy(st.CurrentOp().ArgInt())
 }
 
+// Filters get the value to be filtered in sa, and extra arguments (if
+// any) on the stack. Filters registered through VM.SetFilters take
+// precedence over the builtin ones
 func txFilter(st *State) {
 	name := st.CurrentOp().Arg().(string)
+	args := st.popArgs()
+
+	if f, ok := st.filters[name]; ok && f != nil {
+		fun := reflect.ValueOf(f)
+		if fun.Kind() != reflect.Func {
+			st.Errorf("filter '%s' is not a function", name)
+			return
+		}
+		in := make([]reflect.Value, len(args)+1)
+		in[0] = reflect.ValueOf(st.sa)
+		for i, arg := range args {
+			in[i+1] = reflect.ValueOf(arg)
+		}
+		invokeFuncSingleReturn(st, fun, in)
+		st.Advance()
+		return
+	}
+
+	// None of the builtin filters take arguments
+	if len(args) > 0 && isBuiltinFilter(name) {
+		st.Errorf("filter '%s' takes no arguments, got %d", name, len(args))
+		return
+	}
 
-	// XXX Check for local vars first?
 	switch name {
 	case "html":
 		txHTMLEscape(st)
 	case "uri":
 		txUriEscape(st)
-	case "mark_raw":
+	case "mark_raw", "raw":
 		txMarkRaw(st)
+	case "unmark_raw":
+		txUnmarkRaw(st)
 	default:
-		panic("User-specified filters not implemented yet")
+		st.Errorf("unknown filter '%s'", name)
+	}
+}
+
+func isBuiltinFilter(name string) bool {
+	switch name {
+	case "html", "uri", "mark_raw", "raw", "unmark_raw":
+		return true
 	}
+	return false
 }
 
 func txUriEscape(st *State) {
@@ -563,74 +895,116 @@ func txUriEscape(st *State) {
 
 func txHTMLEscape(st *State) {
 	v := interfaceToString(st.sa)
-	st.sa = rawString(html.EscapeString(v))
+	st.sa = Raw(html.EscapeString(v))
 	st.Advance()
 }
 
-func _txEquals(st *State) bool {
-	var leftV, rightV interface{}
+// _txEquals compares sb and sa the same way as <=> does: values that
+// are (or look like) numbers are compared as numbers, strings are
+// compared lexically, and a number and a string that does not look like
+// one are compared as strings. Other values are compared with Go's ==
+func _txEquals(st *State) (bool, error) {
+	leftV, rightV := st.sb, st.sa
+	if c, err := compareNumeric(leftV, rightV); err == nil {
+		return c == 0, nil
+	}
 
-	switch {
-	case isInterfaceNumeric(st.sb):
-		leftV, rightV = alignTypesForArithmetic(st.sb, st.sa)
-	case isInterfaceStringType(st.sb):
-		leftV, rightV = interfaceToString(st.sb), interfaceToString(st.sa)
-	default:
-		leftV, rightV = st.sb, st.sa
-	}
-
-	switch leftV.(type) {
-	case reflect.Value:
-		leftVV := leftV.(reflect.Value)
-		rightVV := rightV.(reflect.Value)
-		switch leftVV.Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			return leftVV.Int() == rightVV.Int()
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-			return leftVV.Uint() == rightVV.Uint()
-		case reflect.Float32, reflect.Float64:
-			return leftVV.Float() == rightVV.Float()
-		default:
-			panic(fmt.Sprintf("Unhandled type in '==': %s", leftVV.Kind()))
-		}
-	default:
-		return leftV == rightV
+	if isInterfaceStringType(leftV) || isInterfaceStringType(rightV) {
+		return interfaceToString(leftV) == interfaceToString(rightV), nil
 	}
+
+	// Values such as slices and maps are not comparable, and
+	// would cause a runtime panic with ==
+	if leftV != nil && rightV != nil && (!reflect.TypeOf(leftV).Comparable() || !reflect.TypeOf(rightV).Comparable()) {
+		return false, fmt.Errorf("cannot compare %T and %T", leftV, rightV)
+	}
+	return leftV == rightV, nil
 }
 
 func txEquals(st *State) {
-	st.sa = _txEquals(st)
+	eq, err := _txEquals(st)
+	if err != nil {
+		st.Errorf("%s", err)
+		return
+	}
+	st.sa = eq
 	st.Advance()
 }
 
 func txNotEquals(st *State) {
-	st.sa = !_txEquals(st)
+	eq, err := _txEquals(st)
+	if err != nil {
+		st.Errorf("%s", err)
+		return
+	}
+	st.sa = !eq
 	st.Advance()
 }
 
-func txLessThan(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
-	switch leftV.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() < rightV.Int()
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() < rightV.Uint()
-	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() < rightV.Float()
-	}
+// txStrEquals and txStrNotEquals implement eq and ne, which always
+// compare the string representations of sb and sa
+func txStrEquals(st *State) {
+	st.sa = interfaceToString(st.sb) == interfaceToString(st.sa)
+	st.Advance()
+}
+
+func txStrNotEquals(st *State) {
+	st.sa = interfaceToString(st.sb) != interfaceToString(st.sa)
 	st.Advance()
 }
 
+// Comparison ops compare sb (left) to sa (right). The numeric ones
+// (<, >, <=, >=, <=>) compare strings that look like numbers as numbers,
+// and other strings lexically. The string ones (lt, gt, le, ge, cmp)
+// always compare lexically
+
+func txLessThan(st *State) {
+	txCompare(st, compareNumeric, func(c int) interface{} { return c < 0 })
+}
+
 func txGreaterThan(st *State) {
-	leftV, rightV := alignTypesForArithmetic(st.sb, st.sa)
-	switch leftV.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		st.sa = leftV.Int() > rightV.Int()
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		st.sa = leftV.Uint() > rightV.Uint()
-	case reflect.Float32, reflect.Float64:
-		st.sa = leftV.Float() > rightV.Float()
+	txCompare(st, compareNumeric, func(c int) interface{} { return c > 0 })
+}
+
+func txLessThanEquals(st *State) {
+	txCompare(st, compareNumeric, func(c int) interface{} { return c <= 0 })
+}
+
+func txGreaterThanEquals(st *State) {
+	txCompare(st, compareNumeric, func(c int) interface{} { return c >= 0 })
+}
+
+func txCmp(st *State) {
+	txCompare(st, compareNumeric, func(c int) interface{} { return c })
+}
+
+func txStrLessThan(st *State) {
+	txCompare(st, compareString, func(c int) interface{} { return c < 0 })
+}
+
+func txStrGreaterThan(st *State) {
+	txCompare(st, compareString, func(c int) interface{} { return c > 0 })
+}
+
+func txStrLessThanEquals(st *State) {
+	txCompare(st, compareString, func(c int) interface{} { return c <= 0 })
+}
+
+func txStrGreaterThanEquals(st *State) {
+	txCompare(st, compareString, func(c int) interface{} { return c >= 0 })
+}
+
+func txStrCmp(st *State) {
+	txCompare(st, compareString, func(c int) interface{} { return c })
+}
+
+func txCompare(st *State, compare func(interface{}, interface{}) (int, error), result func(int) interface{}) {
+	c, err := compare(st.sb, st.sa)
+	if err != nil {
+		st.Errorf("%s", err)
+		return
 	}
+	st.sa = result(c)
 	st.Advance()
 }
 
@@ -686,21 +1060,74 @@ func txPop(st *State) {
 var funcZero = reflect.Zero(reflect.ValueOf(func() {}).Type())
 
 func invokeFuncSingleReturn(st *State, fun reflect.Value, args []reflect.Value) {
-	if fun.Type().NumIn() != len(args) {
-		st.Warnf("Number of arguments for function does not match (expected %d, got %d)\n", fun.Type().NumIn(), len(args))
+	ftype := fun.Type()
+	if ftype.IsVariadic() {
+		if len(args) < ftype.NumIn()-1 {
+			st.Warnf("Number of arguments for function does not match (expected at least %d, got %d)\n", ftype.NumIn()-1, len(args))
+			st.sa = ""
+			return
+		}
+	} else if ftype.NumIn() != len(args) {
+		st.Warnf("Number of arguments for function does not match (expected %d, got %d)\n", ftype.NumIn(), len(args))
 		st.sa = ""
-	} else if fun.Type().NumOut() == 0 {
+		return
+	}
+
+	for i, arg := range args {
+		var want reflect.Type
+		if ftype.IsVariadic() && i >= ftype.NumIn()-1 {
+			want = ftype.In(ftype.NumIn() - 1).Elem()
+		} else {
+			want = ftype.In(i)
+		}
+
+		v, ok := convertArg(arg, want)
+		if !ok {
+			st.Errorf("cannot use %s as %s in argument %d to function", arg.Type(), want, i+1)
+			return
+		}
+		args[i] = v
+	}
+
+	ret := fun.Call(args)
+	if len(ret) == 0 {
 		// Purely for side effect
 		st.sa = ""
-	} else {
-		ret := fun.Call(args)
-		// grab only the first return value. If you need the
-		// entire return value set, you need to call invokeFunMultiReturn
-		// (to be implemented)
-		st.sa = ret[0].Interface()
+		return
+	}
+
+	// grab only the first return value. If you need the
+	// entire return value set, you need to call invokeFunMultiReturn
+	// (to be implemented). The exception is a trailing error, which
+	// stops the execution
+	st.sa = ret[0].Interface()
+	if last := ret[len(ret)-1]; len(ret) > 1 && last.Type() == errorType && !last.IsNil() {
+		st.Errorf("%s", last.Interface().(error))
 	}
 }
 
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// convertArg converts template values to the type of a function
+// parameter: nil becomes the zero value, and numbers and strings are
+// converted between their respective kinds
+func convertArg(v reflect.Value, want reflect.Type) (reflect.Value, bool) {
+	if !v.IsValid() {
+		return reflect.Zero(want), true
+	}
+
+	vtype := v.Type()
+	switch {
+	case vtype.AssignableTo(want):
+		return v, true
+	case isInterfaceNumeric(v.Interface()) && isNumericKind(want.Kind()):
+		return v.Convert(want), true
+	case isInterfaceStringType(v.Interface()) && want.Kind() == reflect.String:
+		return reflect.ValueOf(interfaceToString(v.Interface())).Convert(want), true
+	}
+	return v, false
+}
+
 // Function calls (NOT to be confused with method calls, which are totally
 // sane, and fine) in go-xslate is a bit different. Unlike in non-compiled
 // languages like Perl, we can't just lookup a function out of nowhere
@@ -727,17 +1154,12 @@ func invokeFuncSingleReturn(st *State, fun reflect.Value, args []reflect.Value)
 // ...And that's how we manage function calls
 // See also:
 func txFunCall(st *State) {
-	// Everything in our lvars up to the current tip is our argument list
-	mark := st.CurrentMark()
-	tip := st.stack.Size() - 1
-	var args []reflect.Value
-
-	if tip-mark-1 > 0 {
-		args = make([]reflect.Value, tip-mark-1)
-		for i := mark + 1; tip > i; i++ {
-			v, _ := st.stack.Get(i)
-			args[i-mark] = reflect.ValueOf(v)
-		}
+	// Everything on the stack from the current mark up to the tip
+	// is our argument list
+	list := st.popArgs()
+	args := make([]reflect.Value, len(list))
+	for i, v := range list {
+		args[i] = reflect.ValueOf(v)
 	}
 
 	x := st.sa
@@ -799,15 +1221,13 @@ func txMethodCall(st *State) {
 	mark := st.CurrentMark()
 	tip := st.stack.Size()
 
-	var invocant reflect.Value
+	// The invocant is pushed first, followed by the arguments
 	args := make([]reflect.Value, tip-mark)
 	for i := mark; i < tip; i++ {
 		v := st.stack.Pop()
 		args[tip-i-1] = reflect.ValueOf(v)
-		if i == mark {
-			invocant = args[tip-i-1]
-		}
 	}
+	invocant := args[0]
 
 	// For maps, arrays, slices, we call virtual methods, if they are available
 	switch invocant.Kind() {
@@ -858,8 +1278,11 @@ func txMakeArray(st *State) {
 	start := st.CurrentMark() // start
 	end := st.StackTip()      // end
 
-	if end <= start {
-		panic(fmt.Sprintf("MakeArray: list start (%d) >= end (%d)", start, end))
+	if end < start {
+		// Nothing was pushed since the mark: empty list
+		st.sa = []interface{}{}
+		st.Advance()
+		return
 	}
 
 	list := make([]interface{}, end-start+1)
@@ -878,6 +1301,11 @@ func txMakeHash(st *State) {
 	for i := end; i > start; {
 		v := st.StackPop()
 		k := st.StackPop()
+		// String literals may be given as []byte, which can't be
+		// used as map keys
+		if isInterfaceStringType(k) {
+			k = interfaceToString(k)
+		}
 		hash[k] = v
 		i -= 2
 	}
@@ -886,6 +1314,15 @@ func txMakeHash(st *State) {
 	st.Advance()
 }
 
+func txMakeNamedArgs(st *State) {
+	args := NamedArgs{}
+	for list := st.popArgs(); len(list) > 1; list = list[2:] {
+		args[interfaceToString(list[0])] = list[1]
+	}
+	st.sa = args
+	st.Advance()
+}
+
 func txInclude(st *State) {
 	// st.sa should contain the include target
 	// st.sb should contain the map[interface{}]interface{}
@@ -911,19 +1348,32 @@ func txInclude(st *State) {
 	target := interfaceToString(st.sa)
 	bc, err := st.LoadByteCode(target)
 	if err != nil {
-		panic(fmt.Sprintf("Include: Failed to compile %s: %s", target, err))
+		st.Errorf("failed to compile include target %s: %s", target, err)
+		return
 	}
 
 	buf := rbpool.Get()
 	defer rbpool.Release(buf)
 
-	vm := NewVM()
-	vm.Run(bc, vars, buf)
+	if err := st.runNested(bc, vars, buf); err != nil {
+		st.nestedErrorf(err, "failed to render include target %s", target)
+		return
+	}
 	st.AppendOutputString(buf.String())
 	st.Advance()
 }
 
+// txWrapper wraps the content with one or more templates. The stack
+// contains the content, followed by the names of the templates, the
+// outermost first. The content is passed to each template in the
+// variable named by the op's argument
 func txWrapper(st *State) {
+	args := st.popArgs()
+	if len(args) < 2 {
+		st.Errorf("wrapper requires the content and at least one template")
+		return
+	}
+
 	// See txInclude
 	vars := Vars(rvpool.Get())
 	defer rvpool.Release(vars)
@@ -942,16 +1392,38 @@ func txWrapper(st *State) {
 			vars.Set(interfaceToString(k), v)
 		}
 	}
-	vars.Set("content", rawString(st.sa.(string)))
 
-	target := st.CurrentOp().ArgString()
-	bc, err := st.LoadByteCode(target)
-	if err != nil {
-		panic(fmt.Sprintf("Wrapper: Failed to compile %s: %s", target, err))
+	into := st.CurrentOp().ArgString()
+	if into == "" {
+		into = "content"
 	}
 
-	vm := NewVM()
-	vm.Run(bc, vars, st.output)
+	content := interfaceToString(args[0])
+	buf := rbpool.Get()
+	defer rbpool.Release(buf)
+	for i := len(args) - 1; i > 0; i-- {
+		vars.Set(into, Raw(content))
+
+		target := interfaceToString(args[i])
+		bc, err := st.LoadByteCode(target)
+		if err != nil {
+			st.Errorf("failed to compile wrapper %s: %s", target, err)
+			return
+		}
+
+		// The outermost wrapper writes to the output, the others
+		// produce the content for the next one
+		output := st.output
+		if i > 1 {
+			buf.Reset()
+			output = buf
+		}
+		if err := st.runNested(bc, vars, output); err != nil {
+			st.nestedErrorf(err, "failed to render wrapper %s", target)
+			return
+		}
+		content = buf.String()
+	}
 	st.Advance()
 }
 
@@ -976,29 +1448,227 @@ func txRestoreWriter(st *State) {
 	st.Advance()
 }
 
+// txMakeMacro creates a Macro that starts at the position given as the
+// op's argument. The macro name is in sb, and the parameter names in sa
+func txMakeMacro(st *State) {
+	names, _ := st.sa.([]interface{})
+	params := make([]string, len(names))
+	for i, name := range names {
+		params[i] = interfaceToString(name)
+	}
+
+	st.sa = &Macro{
+		Name:     interfaceToString(st.sb),
+		ByteCode: st.pc,
+		Entry:    st.CurrentOp().ArgInt(),
+		Params:   params,
+	}
+	st.Advance()
+}
+
+// txImport runs the template in sa, and makes the macros that it
+// defines available as template variables. Its output is discarded
+func txImport(st *State) {
+	target := interfaceToString(st.sa)
+	bc, err := st.LoadByteCode(target)
+	if err != nil {
+		st.Errorf("failed to compile import target %s: %s", target, err)
+		return
+	}
+
+	collect := func(nested *State) {
+		frame := make([]interface{}, nested.framestack.Size())
+		copy(frame, nested.framestack)
+		for _, v := range frame {
+			if m, ok := v.(*Macro); ok {
+				m.Frame = frame
+				st.vars.Set(m.Name, m)
+			}
+		}
+	}
+	if err := st.runNestedFrame(bc, st.Vars(), ioutil.Discard, nil, collect); err != nil {
+		st.nestedErrorf(err, "failed to import %s", target)
+		return
+	}
+	st.Advance()
+}
+
 func txMacroCall(st *State) {
-	x := st.sa.(int)
+	m := st.sa.(*Macro)
+	args := st.popArgs()
+
+	var named NamedArgs
+	if len(args) > 0 {
+		if x, ok := args[len(args)-1].(NamedArgs); ok {
+			named = x
+			args = args[:len(args)-1]
+		}
+	}
+
+	if len(args) > len(m.Params) {
+		st.Errorf("too many arguments for macro %s (expected %d, got %d)", m.Name, len(m.Params), len(args))
+		return
+	}
+
+	bc := subByteCode(m.ByteCode, m.Entry)
+
+	// Arguments are visible as template variables within the macro
+	vars := Vars(rvpool.Get())
+	defer rvpool.Release(vars)
+	defer vars.Reset()
+	for k, v := range st.Vars() {
+		vars.Set(k, v)
+	}
+	for i, name := range m.Params {
+		var v interface{}
+		if i < len(args) {
+			v = args[i]
+		}
+		vars.Set(name, v)
+	}
+	for name, v := range named {
+		i := m.paramIndex(name)
+		if i < 0 {
+			st.Errorf("unknown parameter '%s' for macro %s", name, m.Name)
+			return
+		}
+		if i < len(args) {
+			st.Errorf("parameter '%s' given twice for macro %s", name, m.Name)
+			return
+		}
+		vars.Set(name, v)
+	}
+
+	// The macro can see the local variables of the template that
+	// defined it, which includes the macro itself (for recursion)
+	frame := m.Frame
+	if frame == nil {
+		frame = make([]interface{}, st.framestack.Size())
+		copy(frame, st.framestack)
+	}
+
+	buf := rbpool.Get()
+	defer rbpool.Release(buf)
+
+	if err := st.runNestedFrame(bc, vars, buf, frame, nil); err != nil {
+		st.nestedErrorf(err, "failed to call macro %s", m.Name)
+		return
+	}
+
+	// The output has already been escaped as needed
+	st.sa = Raw(buf.String())
+	st.Advance()
+}
+
+// subByteCode returns a ByteCode that starts at the op at `entry`
+func subByteCode(src *ByteCode, entry int) *ByteCode {
+	if src.root != nil {
+		src = src.root
+	}
+
 	bc := NewByteCode()
-	bc.OpList = st.pc.OpList[x:]
-	vars := Vars{"count": 10, "text": "Hello"}
+	bc.root = src
+	bc.Name, bc.Source = src.Origin(entry)
+	bc.OpList = src.OpList[entry:]
+	if entry < len(src.Positions) {
+		bc.Positions = src.Positions[entry:]
+	}
+	return bc
+}
 
-	vm := NewVM()
-	vm.Run(bc, vars, st.output)
+// txCallBlock renders the BLOCK that starts at the position given as
+// the op's argument. The name of the BLOCK is in sa, and the variables
+// to pass to it are in sb. The stack contains pairs of a local variable
+// index in the BLOCK, and either a local variable index or a template
+// variable name in the caller: when the BLOCK is done, each of them is
+// set to the value of the corresponding local variable of the BLOCK
+func txCallBlock(st *State) {
+	name := interfaceToString(st.sa)
+	args := st.popArgs()
+
+	vars := Vars(rvpool.Get())
+	defer rvpool.Release(vars)
+	defer vars.Reset()
+	for k, v := range st.Vars() {
+		vars.Set(k, v)
+	}
+	if hash, ok := st.sb.(map[interface{}]interface{}); ok {
+		for k, v := range hash {
+			// Macros defined in the caller may refer to the caller's
+			// local variables, which the BLOCK cannot see
+			if m, ok := v.(*Macro); ok && m.Frame == nil {
+				x := *m
+				x.Frame = make([]interface{}, st.framestack.Size())
+				copy(x.Frame, st.framestack)
+				v = &x
+			}
+			vars.Set(interfaceToString(k), v)
+		}
+	}
+
+	var exit func(*State)
+	if len(args) > 0 {
+		exit = func(nested *State) {
+			for ; len(args) > 1; args = args[2:] {
+				v, err := nested.framestack.Get(int(interfaceToNumeric(args[0]).Int()))
+				if name, ok := args[1].(string); ok {
+					// Variables that the BLOCK never got to set are
+					// left alone
+					if err == nil && v != nil {
+						st.vars.Set(name, v)
+					}
+					continue
+				}
+				st.CurrentFrame().SetLvar(int(interfaceToNumeric(args[1]).Int()), v)
+			}
+		}
+	}
+
+	bc := subByteCode(st.pc, st.CurrentOp().ArgInt())
+	if err := st.runNestedFrame(bc, vars, st.output, nil, exit); err != nil {
+		st.nestedErrorf(err, "failed to render BLOCK %s", name)
+		return
+	}
 	st.Advance()
 }
 
+// paramIndex returns the position of the parameter `name`, or -1 if
+// the macro has no such parameter
+func (m *Macro) paramIndex(name string) int {
+	for i, p := range m.Params {
+		if p == name {
+			return i
+		}
+	}
+	return -1
+}
+
 // Executes what's in st.sa
 func txFunCallOmni(st *State) {
+	if _, ok := st.sa.(*Macro); ok {
+		txMacroCall(st)
+		return
+	}
+
 	t := reflect.ValueOf(st.sa)
 	switch t.Kind() {
-	case reflect.Int:
-		// If it's an int, assume that it's a MACRO, which points to
-		// the location in the bytecode that contains the macro code
-		txMacroCall(st)
 	case reflect.Func:
 		txFunCall(st)
 	default:
+		// raw($x), html($x) and friends apply the builtin filters, unless
+		// a function or variable of the same name was given
+		if name, ok := st.CurrentOp().Arg().(string); ok && st.sa == nil && isBuiltinFilter(name) {
+			args := st.popArgs()
+			if len(args) != 1 {
+				st.Errorf("%s() takes exactly one argument, got %d", name, len(args))
+				return
+			}
+			st.sa = args[0]
+			txFilter(st)
+			return
+		}
 		st.Warnf("Unknown variable as function call: %s\n", st.sa)
+		st.popArgs()
 		st.sa = nil
 		st.Advance()
 	}
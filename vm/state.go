@@ -1,26 +1,62 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 
 	"github.com/lestrrat-go/xslate/internal/frame"
+	"github.com/lestrrat-go/xslate/internal/position"
 	"github.com/lestrrat-go/xslate/internal/stack"
+	"github.com/pkg/errors"
 )
 
+// State objects are reused between calls to VM.Run(), as allocating
+// the stacks for each render is relatively expensive
+var statePool = sync.Pool{
+	New: allocState,
+}
+
+func allocState() interface{} {
+	return NewState()
+}
+
+func getState() *State {
+	st := statePool.Get().(*State)
+	st.Reset()
+	return st
+}
+
+func releaseState(st *State) {
+	// Drop references to objects that belong to the previous
+	// execution, so they can be garbage collected
+	st.pc = nil
+	st.output = nil
+	st.vars = nil
+	st.Loader = nil
+	st.ctx = nil
+	st.filters = nil
+	st.warn = os.Stderr
+	st.Reset()
+	statePool.Put(st)
+}
+
 // NewState creates a new State struct
 func NewState() *State {
 	st := &State{
-		opidx:      0,
-		pc:         NewByteCode(),
-		stack:      stack.New(5),
-		markstack:  stack.New(5),
-		framestack: stack.New(5),
-		frames:     stack.New(5),
-		vars:       make(Vars),
-		warn:       os.Stderr,
-		MaxLoopCount: 1000,
+		opidx:        0,
+		pc:           NewByteCode(),
+		stack:        stack.New(5),
+		markstack:    stack.New(5),
+		framestack:   stack.New(5),
+		frames:       stack.New(5),
+		vars:         make(Vars),
+		warn:         os.Stderr,
+		MaxLoopCount: DefaultMaxLoopCount,
 	}
+	st.budget = &st.ownBudget
 
 	st.Pushmark()
 	st.PushFrame()
@@ -59,9 +95,9 @@ func (st *State) CurrentOp() Op {
 
 // PushFrame pushes a new frame to the frame stack
 func (st *State) PushFrame() *frame.Frame {
-	f := frame.New(st.framestack)
+	f := frame.New(&st.framestack)
 	st.frames.Push(f)
-	f.SetMark(st.frames.Size())
+	f.SetMark(st.framestack.Size())
 	return f
 }
 
@@ -72,7 +108,7 @@ func (st *State) PopFrame() *frame.Frame {
 		return nil
 	}
 	f := x.(*frame.Frame)
-	for i := st.framestack.Size(); i > f.Mark(); i-- {
+	for st.framestack.Size() > f.Mark() {
 		st.framestack.Pop()
 	}
 	return f
@@ -92,6 +128,42 @@ func (st *State) Warnf(format string, args ...interface{}) {
 	st.warn.Write([]byte(fmt.Sprintf(format, args...)))
 }
 
+// Errorf records a runtime error for the op currently being executed.
+// Once an error is recorded the virtual machine stops, so the op must
+// return immediately after calling Errorf (without advancing)
+func (st *State) Errorf(format string, args ...interface{}) {
+	st.err = st.newRuntimeError(fmt.Sprintf(format, args...))
+}
+
+// Err returns the runtime error recorded by Errorf, if any
+func (st *State) Err() error {
+	return st.err
+}
+
+func (st *State) newRuntimeError(msg string) *RuntimeError {
+	return st.newRuntimeErrorAt(st.opidx, msg)
+}
+
+func (st *State) newRuntimeErrorAt(idx int, msg string) *RuntimeError {
+	e := &RuntimeError{
+		OpIndex: idx,
+		Message: msg,
+	}
+	if pc := st.pc; pc != nil {
+		var source string
+		e.Name, source = pc.Origin(idx)
+		if idx >= 0 && idx < pc.Len() {
+			e.Op = pc.Get(idx).Type()
+		}
+		pos := pc.Position(idx)
+		e.Line, e.Column = pos.Line, pos.Column
+		if pos.Line > 0 && source != "" {
+			e.Snippet = position.Snippet(source, pos.Line, pos.Column)
+		}
+	}
+	return e
+}
+
 // AppendOutput appends the specified bytes to the output
 func (st *State) AppendOutput(b []byte) {
 	// XXX Error checking?
@@ -139,17 +211,95 @@ func (st *State) StackPush(v interface{}) {
 	st.stack.Push(v)
 }
 
+// popArgs pops everything pushed to the stack since the current mark,
+// and returns them in the order they were pushed. This is how
+// arguments are passed to functions, macros and filters
+func (st *State) popArgs() []interface{} {
+	start := st.CurrentMark()
+	end := st.stack.Size()
+	if end <= start {
+		return nil
+	}
+
+	args := make([]interface{}, end-start)
+	for i := len(args) - 1; i >= 0; i-- {
+		args[i] = st.StackPop()
+	}
+	return args
+}
+
 // LoadByteCode loads a new ByteCode. This is used for op codes that
 // call to external templates such as `include`
 func (st *State) LoadByteCode(key string) (*ByteCode, error) {
+	if st.Loader == nil {
+		return nil, errors.New("no loader specified")
+	}
 	return st.Loader.Load(key)
 }
 
+func (st *State) newLimitError(idx int, limit string, max int) *LimitError {
+	return &LimitError{
+		RuntimeError: st.newRuntimeErrorAt(idx, fmt.Sprintf("execution limit %s (%d) exceeded", limit, max)),
+		Limit:        limit,
+		Max:          max,
+	}
+}
+
+// Context returns the context.Context given to VM.RunContext
+func (st *State) Context() context.Context {
+	if st.ctx == nil {
+		return context.Background()
+	}
+	return st.ctx
+}
+
+// runNested executes templates that are called from within the
+// currently executing template (e.g. include, wrapper). The nested
+// template shares the same loader, warning output, filters, and
+// execution budget
+func (st *State) runNested(bc *ByteCode, vars Vars, output io.Writer) error {
+	return st.runNestedFrame(bc, vars, output, nil, nil)
+}
+
+// runNestedFrame is the same as runNested, but the nested template starts
+// with the local variables in `frame`. If `exit` is non-nil, it is called
+// with the State of the nested template once it completes successfully
+func (st *State) runNestedFrame(bc *ByteCode, vars Vars, output io.Writer, frame []interface{}, exit func(*State)) error {
+	if max := st.limits.MaxDepth; max > 0 && st.depth >= max {
+		return st.newLimitError(st.opidx, "MaxDepth", max)
+	}
+
+	vm := NewVM()
+	vm.Loader = st.Loader
+	vm.warn = st.warn
+	vm.limits = st.limits
+	vm.escape = st.escape
+	vm.filters = st.filters
+	vm.frame = frame
+	vm.exit = exit
+	return vm.run(st.Context(), bc, vars, output, st)
+}
+
+// nestedErrorf records an error returned by runNested. Limit errors are
+// recorded as is, so that the caller can tell which limit was exceeded
+func (st *State) nestedErrorf(err error, format string, args ...interface{}) {
+	if lerr, ok := err.(*LimitError); ok {
+		st.err = lerr
+		return
+	}
+	st.Errorf("%s: %s", fmt.Sprintf(format, args...), errorSummary(err))
+}
+
 // Reset resets the whole State object
 func (st *State) Reset() {
 	st.opidx = 0
 	st.sa = nil
 	st.sb = nil
+	st.targ = nil
+	st.err = nil
+	st.depth = 0
+	st.ownBudget = budget{}
+	st.budget = &st.ownBudget
 	st.stack.Reset()
 	st.markstack.Reset()
 	st.frames.Reset()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"reflect"
 	"strconv"
+	"strings"
 )
 
 var hexdigits = []byte("0123456789ABCDEF")
@@ -37,6 +38,9 @@ func shouldEscapeUri(v byte) bool {
 }
 
 func isInterfaceStringType(v interface{}) bool {
+	if v == nil {
+		return false
+	}
 	t := reflect.TypeOf(v)
 	switch t.Kind() {
 	case reflect.String:
@@ -48,24 +52,35 @@ func isInterfaceStringType(v interface{}) bool {
 }
 
 func isInterfaceNumeric(v interface{}) bool {
-	switch reflect.TypeOf(v).Kind() {
+	if v == nil {
+		return false
+	}
+	return isNumericKind(reflect.TypeOf(v).Kind())
+}
+
+func isNumericKind(k reflect.Kind) bool {
+	switch k {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Float32, reflect.Float64:
 		return true
 	}
 	return false
 }
 
+// interfaceToNumeric returns v as a number. Strings (including Raw
+// strings, such as the output of a macro) are parsed, and anything that
+// is not a number becomes 0
 func interfaceToNumeric(v interface{}) reflect.Value {
-	if isInterfaceNumeric(v) {
-		return reflect.ValueOf(v)
+	if n, ok := interfaceToNumber(v); ok {
+		return reflect.ValueOf(n)
 	}
 	return reflect.ValueOf(0)
 }
 
 // Given possibly non-matched pair of things to perform arithmetic
 // operations on, align their types so that the given operation
-// can be performed correctly.
-// e.g. given int, float, we align them to float, float
+// can be performed correctly: float64 if either of them is a float,
+// uint64 if both are unsigned integers, and int64 otherwise.
+// e.g. given int, float, we align them to float64, float64
 func alignTypesForArithmetic(left, right interface{}) (reflect.Value, reflect.Value) {
 	// These avoid crashes for accessing nil interfaces
 	if left == nil {
@@ -78,21 +93,35 @@ func alignTypesForArithmetic(left, right interface{}) (reflect.Value, reflect.Va
 	leftV := interfaceToNumeric(left)
 	rightV := interfaceToNumeric(right)
 
-	if leftV.Kind() == rightV.Kind() {
-		return leftV, rightV
-	}
-
 	var alignTo reflect.Type
-	if leftV.Kind() > rightV.Kind() {
-		alignTo = leftV.Type()
-	} else {
-		alignTo = rightV.Type()
+	switch leftK, rightK := leftV.Kind(), rightV.Kind(); {
+	case isFloatKind(leftK) || isFloatKind(rightK):
+		alignTo = reflect.TypeOf(float64(0))
+	case isUintKind(leftK) && isUintKind(rightK):
+		alignTo = reflect.TypeOf(uint64(0))
+	default:
+		alignTo = reflect.TypeOf(int64(0))
 	}
 
 	return leftV.Convert(alignTo), rightV.Convert(alignTo)
 }
 
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
 func interfaceToString(arg interface{}) string {
+	if arg == nil {
+		return ""
+	}
 	t := reflect.TypeOf(arg)
 	var v string
 	switch t.Kind() {
@@ -116,16 +145,82 @@ func interfaceToString(arg interface{}) string {
 	return v
 }
 
+// compareNumeric compares two values as numbers, and returns -1, 0 or 1.
+// nil is treated as 0, and strings that look like numbers are converted.
+// If both values are strings that do not look like numbers, they are
+// compared lexically
+func compareNumeric(left, right interface{}) (int, error) {
+	leftN, leftOK := interfaceToNumber(left)
+	rightN, rightOK := interfaceToNumber(right)
+	if !leftOK || !rightOK {
+		if isInterfaceStringType(left) && isInterfaceStringType(right) {
+			return compareString(left, right)
+		}
+		return 0, fmt.Errorf("cannot compare %T and %T", left, right)
+	}
+
+	leftV, rightV := alignTypesForArithmetic(leftN, rightN)
+	switch leftV.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareOrdered(leftV.Int() < rightV.Int(), leftV.Int() > rightV.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareOrdered(leftV.Uint() < rightV.Uint(), leftV.Uint() > rightV.Uint()), nil
+	default:
+		return compareOrdered(leftV.Float() < rightV.Float(), leftV.Float() > rightV.Float()), nil
+	}
+}
+
+// compareString compares the string representation of two values
+func compareString(left, right interface{}) (int, error) {
+	return strings.Compare(interfaceToString(left), interfaceToString(right)), nil
+}
+
+func compareOrdered(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+// interfaceToNumber returns `v` if it's a number, or the number that it
+// represents if it's a string. nil is treated as 0
+func interfaceToNumber(v interface{}) (interface{}, bool) {
+	switch {
+	case v == nil:
+		return 0, true
+	case isInterfaceNumeric(v):
+		return v, true
+	case isInterfaceStringType(v):
+		s := strings.TrimSpace(interfaceToString(v))
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return i, true
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
 func interfaceToBool(arg interface{}) bool {
 	if arg == nil {
 		return false
 	}
 
-	t := reflect.TypeOf(arg)
-	if t.Kind() == reflect.Bool {
-		return arg.(bool)
+	v := reflect.ValueOf(arg)
+	switch k := v.Kind(); {
+	case k == reflect.Bool:
+		return v.Bool()
+	case isNumericKind(k):
+		return v.Interface() != reflect.Zero(v.Type()).Interface()
+	case k == reflect.String, k == reflect.Array, k == reflect.Slice, k == reflect.Map, k == reflect.Chan:
+		// Empty strings and containers are false
+		return v.Len() > 0
+	case k == reflect.Ptr, k == reflect.Interface, k == reflect.Func:
+		return !v.IsNil()
 	}
-
-	z := reflect.Zero(t)
-	return reflect.DeepEqual(z, t)
+	return true
 }
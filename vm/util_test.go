@@ -46,4 +46,31 @@ func TestAlignTypesForArithmetic(t *testing.T) {
 	if leftV.Kind() != reflect.Float64 {
 		t.Errorf("leftV should have been upgraded to Float64, but got %s", leftV.Kind())
 	}
+
+	// Signed and unsigned integers are aligned to int64, so that
+	// negative numbers survive
+	leftV, rightV = alignTypesForArithmetic(uint8(1), -2)
+	if leftV.Kind() != reflect.Int64 || rightV.Int() != -2 {
+		t.Errorf("Expected int64 and -2, got %s and %v", leftV.Kind(), rightV)
+	}
+
+	leftV, _ = alignTypesForArithmetic(uint8(1), uint32(2))
+	if leftV.Kind() != reflect.Uint64 {
+		t.Errorf("Expected unsigned integers to be aligned to Uint64, got %s", leftV.Kind())
+	}
+}
+
+func TestInterfaceToBool(t *testing.T) {
+	for _, x := range []interface{}{true, 1, -1, 0.5, "0", "a", Raw("a"), []byte("a"), []int{0}, map[string]int{"a": 0}, &struct{}{}, struct{}{}} {
+		if !interfaceToBool(x) {
+			t.Errorf("Expected %#v to be true", x)
+		}
+	}
+
+	var nilptr *struct{}
+	for _, x := range []interface{}{nil, false, 0, 0.0, uint8(0), "", Raw(""), []byte{}, []int{}, map[string]int{}, nilptr} {
+		if interfaceToBool(x) {
+			t.Errorf("Expected %#v to be false", x)
+		}
+	}
 }
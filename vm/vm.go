@@ -16,56 +16,163 @@ package vm
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"os"
 
+	"github.com/lestrrat-go/xslate/internal/position"
 	"github.com/lestrrat-go/xslate/internal/rvpool"
 )
 
 // NewVM creates a new VM
 func NewVM() *VM {
 	return &VM{
-		st:        NewState(),
 		functions: nil,
-		Loader:    nil,
+		warn:      os.Stderr,
+		limits: Limits{
+			MaxDepth:     DefaultMaxDepth,
+			MaxLoopCount: DefaultMaxLoopCount,
+		},
+		Loader: nil,
 	}
 }
 
+// AutoEscape returns the EscapeMode used when printing values
+func (vm *VM) AutoEscape() EscapeMode {
+	return vm.escape
+}
+
+// SetAutoEscape sets the EscapeMode used when printing values. Values
+// of type Raw are never escaped
+func (vm *VM) SetAutoEscape(m EscapeMode) {
+	vm.escape = m
+}
+
+// Limits returns the execution limits currently in effect
+func (vm *VM) Limits() Limits {
+	return vm.limits
+}
+
+// SetLimits sets the execution limits for templates run by this VM.
+// Zero values mean that there is no limit
+func (vm *VM) SetLimits(l Limits) {
+	vm.limits = l
+}
+
 func (vm *VM) SetFunctions(vars Vars) {
 	vm.functions = vars
 }
 
-// CurrentOp returns the current Op to be executed
+// SetFilters registers user-defined filters, keyed by name. A filter is
+// a function that receives the filtered value, followed by any extra
+// arguments given in the template (`[% x | truncate(30) %]`). If it
+// returns more than one value and the last is a non-nil error, the
+// execution stops with that error.
+//
+// The return value is escaped when printed like any other value. Return
+// a Raw from filters that produce markup. User-defined filters take
+// precedence over the builtin ones (html, uri, mark_raw)
+func (vm *VM) SetFilters(filters Vars) {
+	vm.filters = filters
+}
+
+// SetWarnOutput sets the io.Writer where warnings generated during
+// execution are written to. By default warnings go to os.Stderr
+func (vm *VM) SetWarnOutput(w io.Writer) {
+	vm.warn = w
+}
+
+// CurrentOp returns the op where the most recent call to Run stopped, or
+// nil if nothing has been run yet.
+//
+// Deprecated: each call to Run has its own State, and calls may happen
+// concurrently, so this only tells which of them finished last. Use the
+// OpIndex and Op fields of *RuntimeError to find where a template failed
 func (vm *VM) CurrentOp() Op {
-	return vm.st.CurrentOp()
+	vm.lastOpMu.Lock()
+	defer vm.lastOpMu.Unlock()
+	return vm.lastOp
 }
 
 // IsSupportedByteCodeVersion returns true if this VM can handle the
 // provided bytecode version
 func (vm *VM) IsSupportedByteCodeVersion(bc *ByteCode) bool {
-	return bc.Version == 1.0
+	return bc.Version == ByteCodeVersion
 }
 
-// Run executes the given vm.ByteCode using the given variables. For historical
-// reasons, it also allows re-executing the previous bytecode instructions
-// given to a virtual machine, but this will probably be removed in the future
-func (vm *VM) Run(bc *ByteCode, vars Vars, output io.Writer) {
+var errOutputLimitExceeded = errors.New("output limit exceeded")
+
+// ctxCheckInterval is the number of ops executed between checks for
+// cancellation of the context given to RunContext
+const ctxCheckInterval = 256
+
+// Run executes the given vm.ByteCode using the given variables. Each call
+// to Run is executed using its own State, which is taken from (and
+// returned to) a pool, so it is safe to call Run on the same VM from
+// multiple goroutines.
+//
+// If the execution fails, a *RuntimeError is returned. Output generated
+// up to the point of failure may have already been written to `output`
+func (vm *VM) Run(bc *ByteCode, vars Vars, output io.Writer) error {
+	return vm.RunContext(context.Background(), bc, vars, output)
+}
+
+// RunContext is the same as Run, but stops the execution when `ctx` is
+// canceled or its deadline passes, in which case ctx.Err() is returned.
+// The context is checked periodically as ops are executed (including
+// those in FOREACH and WHILE loops), and is passed down to templates
+// executed via INCLUDE and WRAPPER
+func (vm *VM) RunContext(ctx context.Context, bc *ByteCode, vars Vars, output io.Writer) error {
+	return vm.run(ctx, bc, vars, output, nil)
+}
+
+// run executes the ByteCode. `parent` is the State of the template that
+// called this template (via INCLUDE, WRAPPER, etc), or nil
+func (vm *VM) run(ctx context.Context, bc *ByteCode, vars Vars, output io.Writer, parent *State) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if !vm.IsSupportedByteCodeVersion(bc) {
-		panic(fmt.Sprintf(
-			"error: ByteCode version %f no supported",
-			bc.Version,
-		))
+		return &RuntimeError{
+			Name:    bc.Name,
+			Message: fmt.Sprintf("ByteCode version %f not supported", bc.Version),
+		}
 	}
 
-	st := vm.st
+	st := getState()
+	defer releaseState(st)
+
+	st.limits = vm.limits
+	st.escape = vm.escape
+	st.filters = vm.filters
+	if parent != nil {
+		st.depth = parent.depth + 1
+		st.budget = parent.budget
+	} else if max := st.limits.MaxOutputBytes; max > 0 {
+		// Output is counted right before it reaches the writer given
+		// to us, so that bytes that are discarded (e.g. output from
+		// templates that error out) are not counted
+		st.budget.output = &limitWriter{w: output, remaining: max}
+		output = st.budget.output
+	}
+	st.MaxLoopCount = st.limits.MaxLoopCount
 
 	if _, ok := output.(*bufio.Writer); !ok {
 		output = bufio.NewWriter(output)
 		defer output.(*bufio.Writer).Flush()
 	}
-	st.Reset()
 	st.pc = bc
 	st.output = output
+	if parent == nil {
+		defer func() {
+			vm.lastOpMu.Lock()
+			vm.lastOp = st.CurrentOp()
+			vm.lastOpMu.Unlock()
+		}()
+	}
 	newvars := Vars(rvpool.Get())
 	defer rvpool.Release(newvars)
 	defer newvars.Reset()
@@ -83,9 +190,114 @@ func (vm *VM) Run(bc *ByteCode, vars Vars, output io.Writer) {
 		}
 	}
 	st.Loader = vm.Loader
+	st.ctx = ctx
+	for i, v := range vm.frame {
+		st.CurrentFrame().SetLvar(i, v)
+	}
+	if vm.warn != nil {
+		st.warn = vm.warn
+	}
+
+	// Ops report errors through State.Errorf, but we may still get
+	// panics from things like user-supplied functions and methods.
+	// Don't let them take down the caller
+	defer func() {
+		if r := recover(); r != nil {
+			err = st.newRuntimeError(fmt.Sprintf("%v", r))
+		}
+	}()
 
 	// This is the main loop
+	done := ctx.Done()
+	b := st.budget
+	maxOps := st.limits.MaxOps
+	count := 0
 	for op := st.CurrentOp(); op.Type() != TXOPEnd; op = st.CurrentOp() {
+		idx := st.opidx
 		op.Call(st)
+		if st.err != nil {
+			// Errors from nested templates may have been caused by
+			// cancellation, so report that instead
+			if cerr := ctx.Err(); cerr != nil {
+				return cerr
+			}
+			return st.err
+		}
+
+		if b.output != nil && b.output.exceeded {
+			return st.newLimitError(idx, "MaxOutputBytes", st.limits.MaxOutputBytes)
+		}
+
+		if maxOps > 0 {
+			if b.ops++; b.ops > maxOps {
+				return st.newLimitError(idx, "MaxOps", maxOps)
+			}
+		}
+
+		// done is nil for contexts that are never canceled
+		if count++; done != nil && count%ctxCheckInterval == 0 {
+			select {
+			case <-done:
+				return ctx.Err()
+			default:
+			}
+		}
+	}
+
+	// Anything left in the buffer may still go over the output limit
+	if parent == nil && b.output != nil {
+		output.(*bufio.Writer).Flush()
+		if b.output.exceeded {
+			return st.newLimitError(st.opidx, "MaxOutputBytes", st.limits.MaxOutputBytes)
+		}
+	}
+
+	if vm.exit != nil {
+		vm.exit(st)
+	}
+	return nil
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if len(p) <= lw.remaining {
+		n, err := lw.w.Write(p)
+		lw.remaining -= n
+		return n, err
+	}
+
+	n, err := lw.w.Write(p[:lw.remaining])
+	lw.remaining -= n
+	lw.exceeded = true
+	if err == nil {
+		err = errOutputLimitExceeded
+	}
+	return n, err
+}
+
+// Error returns the textual representation of the error, which looks
+// like "index.tx:42:7: message", followed by the snippet. If the
+// location in the template is unknown, the op is reported instead,
+// using the same numbering as ByteCode.String()
+func (e *RuntimeError) Error() string {
+	msg := e.summary()
+	if e.Snippet != "" {
+		msg += "\n" + e.Snippet
+	}
+	return msg
+}
+
+// summary is the same as Error(), minus the snippet. It's used when
+// errors from nested templates are reported
+func (e *RuntimeError) summary() string {
+	if e.Line <= 0 {
+		return fmt.Sprintf("%s: op %03d (%s): %s", e.Name, e.OpIndex+1, e.Op, e.Message)
+	}
+	return position.Format(e.Name, e.Line, e.Column, e.Message)
+}
+
+func errorSummary(err error) string {
+	if rterr, ok := err.(*RuntimeError); ok {
+		return rterr.summary()
 	}
+	return err.Error()
 }
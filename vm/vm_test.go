@@ -2,11 +2,14 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	txtime "github.com/lestrrat-go/xslate/functions/time"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,7 +17,10 @@ import (
 func assertOutput(t *testing.T, bc *ByteCode, vars Vars, expected interface{}) {
 	buf := &bytes.Buffer{}
 	vm := NewVM()
-	vm.Run(bc, vars, buf)
+	if err := vm.Run(bc, vars, buf); err != nil {
+		t.Errorf("Failed to run bytecode: %s", err)
+		return
+	}
 	output := buf.String()
 
 	vtype := reflect.TypeOf(expected)
@@ -62,7 +68,7 @@ func TestNonExistingSymbol(t *testing.T) {
 
 	buf := &bytes.Buffer{}
 	vm := NewVM()
-	vm.st.warn = buf
+	vm.SetWarnOutput(buf)
 
 	vm.Run(bc, nil, &bytes.Buffer{})
 
@@ -179,6 +185,22 @@ func TestVM_DivFloat(t *testing.T) {
 	assertOutput(t, bc, nil, "2.5")
 }
 
+func TestVM_DivByZero(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, 1)
+	bc.AppendOp(TXOPMoveToSb)
+	bc.AppendOp(TXOPLiteral, 0.0)
+	bc.AppendOp(TXOPDiv)
+	bc.AppendOp(TXOPPrintRaw)
+	bc.AppendOp(TXOPEnd)
+
+	vm := NewVM()
+	buf := &bytes.Buffer{}
+	if err := vm.Run(bc, nil, buf); err == nil {
+		t.Errorf("Expected division by zero to fail")
+	}
+}
+
 func TestVM_LvarAssignArithmeticResult(t *testing.T) {
 	bc := NewByteCode()
 	bc.AppendOp(TXOPLiteral, 1)
@@ -411,3 +433,266 @@ func TestVM_MakeHash(t *testing.T) {
 		}
 	}
 }
+
+func TestVM_ConcurrentRun(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPFetchSymbol, "list")
+	bc.AppendOp(TXOPForStart, 0)
+	bc.AppendOp(TXOPLiteral, 0)
+	bc.AppendOp(TXOPForIter, 8)
+	bc.AppendOp(TXOPFetchSymbol, "name")
+	bc.AppendOp(TXOPPrint)
+	bc.AppendOp(TXOPLoadLvar, 0)
+	bc.AppendOp(TXOPPrint)
+	bc.AppendOp(TXOPLiteral, ",")
+	bc.AppendOp(TXOPPrint)
+	bc.AppendOp(TXOPGoto, -8)
+	bc.AppendOp(TXOPEnd)
+
+	// A single VM is shared by all goroutines
+	vm := NewVM()
+	if op := vm.CurrentOp(); op != nil {
+		t.Errorf("Expected no current op before running, got %s", op)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := strconv.Itoa(i)
+			expected := name + "1," + name + "2," + name + "3,"
+			for j := 0; j < 100; j++ {
+				buf := &bytes.Buffer{}
+				vm.Run(bc, Vars{"name": name, "list": []int{1, 2, 3}}, buf)
+				if buf.String() != expected {
+					t.Errorf("Expected output '%s', got '%s'", expected, buf.String())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if op := vm.CurrentOp(); op == nil || op.Type() != TXOPEnd {
+		t.Errorf("Expected current op to be End, got %v", op)
+	}
+}
+
+func assertRuntimeError(t *testing.T, bc *ByteCode, vars Vars, op OpType) {
+	vm := NewVM()
+	err := vm.Run(bc, vars, &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("Expected runtime error, got nil")
+		return
+	}
+
+	rterr, ok := err.(*RuntimeError)
+	if !ok {
+		t.Errorf("Expected *RuntimeError, got %T", err)
+		return
+	}
+
+	if rterr.Op != op {
+		t.Errorf("Expected error from op %s, got %s (%s)", op, rterr.Op, rterr)
+	}
+}
+
+func TestVM_UnknownFilterError(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, "Hello")
+	bc.AppendOp(TXOPFilter, "no_such_filter")
+	bc.AppendOp(TXOPPrint)
+	bc.AppendOp(TXOPEnd)
+
+	assertRuntimeError(t, bc, nil, TXOPFilter)
+}
+
+func TestVM_Filters(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPPushmark)
+	bc.AppendOp(TXOPLiteral, 3)
+	bc.AppendOp(TXOPPush)
+	bc.AppendOp(TXOPLiteral, "Hello, World!")
+	bc.AppendOp(TXOPFilter, "truncate")
+	bc.AppendOp(TXOPPopmark)
+	bc.AppendOp(TXOPPrint)
+	bc.AppendOp(TXOPEnd)
+
+	vm := NewVM()
+	vm.SetFilters(Vars{
+		"truncate": func(s string, n int64) string { return s[:n] },
+	})
+
+	buf := &bytes.Buffer{}
+	if err := vm.Run(bc, nil, buf); err != nil {
+		t.Errorf("Failed to run bytecode: %s", err)
+		return
+	}
+	if buf.String() != "Hel" {
+		t.Errorf("Expected output 'Hel', got '%s'", buf.String())
+	}
+}
+
+func TestVM_FetchFieldError(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPFetchSymbol, "foo")
+	bc.AppendOp(TXOPFetchFieldSymbol, "value")
+	bc.AppendOp(TXOPPrintRaw)
+	bc.AppendOp(TXOPEnd)
+
+	assertRuntimeError(t, bc, Vars{"foo": 1}, TXOPFetchFieldSymbol)
+	assertRuntimeError(t, bc, Vars{"foo": struct{ Other int }{1}}, TXOPFetchFieldSymbol)
+
+	// missing map keys are not errors
+	assertOutput(t, bc, Vars{"foo": map[string]interface{}{}}, "")
+}
+
+func TestVM_LoopLimitError(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, make([]int, 2000))
+	bc.AppendOp(TXOPForStart, 0)
+	bc.AppendOp(TXOPLiteral, 0)
+	bc.AppendOp(TXOPForIter, 4)
+	bc.AppendOp(TXOPLoadLvar, 0)
+	bc.AppendOp(TXOPPrintRaw)
+	bc.AppendOp(TXOPGoto, -4)
+	bc.AppendOp(TXOPEnd)
+
+	// Default MaxLoopCount is 1000
+	assertLimitError(t, NewVM(), bc, "MaxLoopCount")
+}
+
+func TestVM_IncludeError(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, "foo.tx")
+	bc.AppendOp(TXOPInclude)
+	bc.AppendOp(TXOPEnd)
+
+	// No loader to load foo.tx with
+	assertRuntimeError(t, bc, nil, TXOPInclude)
+}
+
+func TestVM_RecoverPanic(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPFetchSymbol, "explode")
+	bc.AppendOp(TXOPFunCallOmni)
+	bc.AppendOp(TXOPEnd)
+
+	assertRuntimeError(t, bc, Vars{"explode": func() string { panic("boom") }}, TXOPFunCallOmni)
+}
+
+func TestVM_RunContext(t *testing.T) {
+	// An infinite loop
+	bc := NewByteCode()
+	bc.AppendOp(TXOPNoop)
+	bc.AppendOp(TXOPGoto, -1)
+	bc.AppendOp(TXOPEnd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	vm := NewVM()
+	if err := vm.RunContext(ctx, bc, nil, &bytes.Buffer{}); err != context.DeadlineExceeded {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// Already canceled contexts shouldn't run anything
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+
+	bc = NewByteCode()
+	bc.AppendOp(TXOPPrintRawConst, "Hello")
+	bc.AppendOp(TXOPEnd)
+
+	buf := &bytes.Buffer{}
+	if err := vm.RunContext(ctx, bc, nil, buf); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no output, got '%s'", buf.String())
+	}
+}
+
+func assertLimitError(t *testing.T, vm *VM, bc *ByteCode, limit string) {
+	err := vm.Run(bc, nil, &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("Expected limit error, got nil")
+		return
+	}
+
+	lerr, ok := err.(*LimitError)
+	if !ok {
+		t.Errorf("Expected *LimitError, got %T (%s)", err, err)
+		return
+	}
+
+	if lerr.Limit != limit {
+		t.Errorf("Expected limit %s to be exceeded, got %s", limit, lerr.Limit)
+	}
+}
+
+func TestVM_Limits(t *testing.T) {
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, make([]int, 100))
+	bc.AppendOp(TXOPForStart, 0)
+	bc.AppendOp(TXOPLiteral, 0)
+	bc.AppendOp(TXOPForIter, 4)
+	bc.AppendOp(TXOPLoadLvar, 0)
+	bc.AppendOp(TXOPPrintRaw)
+	bc.AppendOp(TXOPGoto, -4)
+	bc.AppendOp(TXOPEnd)
+
+	// 100 iterations of 5 ops each
+	vm := NewVM()
+	vm.SetLimits(Limits{MaxOps: 1000})
+	if err := vm.Run(bc, nil, &bytes.Buffer{}); err != nil {
+		t.Errorf("Failed to run bytecode: %s", err)
+	}
+
+	vm.SetLimits(Limits{MaxOps: 100})
+	assertLimitError(t, vm, bc, "MaxOps")
+
+	vm.SetLimits(Limits{MaxLoopCount: 50})
+	assertLimitError(t, vm, bc, "MaxLoopCount")
+
+	// 100 bytes of output
+	vm.SetLimits(Limits{MaxOutputBytes: 100})
+	if err := vm.Run(bc, nil, &bytes.Buffer{}); err != nil {
+		t.Errorf("Failed to run bytecode: %s", err)
+	}
+
+	vm.SetLimits(Limits{MaxOutputBytes: 99})
+	assertLimitError(t, vm, bc, "MaxOutputBytes")
+
+	// Output should stop at the limit
+	buf := &bytes.Buffer{}
+	vm.Run(bc, nil, buf)
+	if buf.Len() != 99 {
+		t.Errorf("Expected 99 bytes of output, got %d", buf.Len())
+	}
+}
+
+type recursiveLoader struct {
+	bc *ByteCode
+}
+
+func (l recursiveLoader) Load(string) (*ByteCode, error) {
+	return l.bc, nil
+}
+
+func TestVM_MaxDepth(t *testing.T) {
+	// A template that includes itself
+	bc := NewByteCode()
+	bc.AppendOp(TXOPLiteral, "self.tx")
+	bc.AppendOp(TXOPInclude)
+	bc.AppendOp(TXOPEnd)
+
+	vm := NewVM()
+	vm.Loader = recursiveLoader{bc}
+	assertLimitError(t, vm, bc, "MaxDepth")
+
+	vm.SetLimits(Limits{MaxDepth: 5})
+	assertLimitError(t, vm, bc, "MaxDepth")
+}
@@ -46,6 +46,7 @@ It is strongly recommended that you use the caching layer to boost performance.
 package xslate
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -53,13 +54,14 @@ import (
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/lestrrat-go/xslate/compiler"
 	"github.com/lestrrat-go/xslate/internal/rbpool"
 	"github.com/lestrrat-go/xslate/loader"
 	"github.com/lestrrat-go/xslate/parser"
-	"github.com/lestrrat-go/xslate/parser/kolonish"
-	"github.com/lestrrat-go/xslate/parser/tterse"
+	_ "github.com/lestrrat-go/xslate/parser/kolon"  // registers Kolon
+	_ "github.com/lestrrat-go/xslate/parser/tterse" // registers TTerse
 	"github.com/lestrrat-go/xslate/vm"
 	"github.com/pkg/errors"
 )
@@ -80,15 +82,28 @@ func init() {
 // not have to import two packages just to use Xslate
 type Vars vm.Vars
 
+// Raw is a string that is printed as is, even when auto escaping is on.
+// Use it to pass values that are already HTML-escaped to templates:
+//
+//    tx.Render("index.tx", xslate.Vars{ "body": xslate.Raw("<b>Hello</b>") })
+type Raw = vm.Raw
+
+// These are the values accepted by the "AutoEscape" option of New(),
+// and by SetAutoEscape()
+const (
+	AutoEscapeHTML = "html" // escape HTML special characters (default)
+	AutoEscapeNone = "none" // print values as is
+)
+
 // Xslate is the main package containing all the goodies to execute and
-// render an Xslate template
+// render an Xslate template. Once configured, the same Xslate instance
+// may be used to render templates from multiple goroutines
 type Xslate struct {
 	Flags    int32
 	VM       *vm.VM
 	Compiler compiler.Compiler
 	Parser   parser.Parser
 	Loader   loader.ByteCodeLoader
-	// XXX Need to make syntax pluggable
 }
 
 // ConfigureArgs is the interface to be passed to `Configure()` method.
@@ -111,20 +126,36 @@ func DefaultCompiler(tx *Xslate, args Args) error {
 }
 
 // DefaultParser sets up and assigns the default parser to be used by Xslate.
+// The "Syntax" key chooses one of the syntaxes registered with
+// parser.Register(). "TTerse" (the default) and "Kolon" are always
+// available. All the arguments are handed to the syntax, and TTerse and
+// Kolon take the following keys (see parser.Syntax):
+//
+//    * TagStart: Starts a tag, such as "[%" in TTerse
+//    * TagEnd: Ends a tag, such as "%]" in TTerse
+//    * LineStart: Starts a line of code, such as ":" in Kolon. An empty
+//      string disables lines of code
+//    * PreChomp: How to remove the whitespace before each tag, as a
+//      parser.ChompMode (or the equivalent int, as in Template-Toolkit)
+//    * PostChomp: How to remove the whitespace after each tag
+//    * Trim: Remove leading and trailing whitespace of templates, BLOCKs and MACROs
 func DefaultParser(tx *Xslate, args Args) error {
 	syntax, ok := args.Get("Syntax")
 	if !ok {
 		syntax = "TTerse"
 	}
 
-	switch syntax {
-	case "TTerse":
-		tx.Parser = tterse.New()
-	case "Kolon", "Kolonish":
-		tx.Parser = kolonish.New()
-	default:
-		return errors.New("sytanx '" + syntax.(string) + "' is not available")
+	name, _ := syntax.(string)
+	factory, ok := parser.Lookup(name)
+	if !ok {
+		return errors.Errorf("syntax '%v' is not available (available: %s)", syntax, strings.Join(parser.Syntaxes(), ", "))
 	}
+
+	p, err := factory(args)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create parser for syntax '%s'", name)
+	}
+	tx.Parser = p
 	return nil
 }
 
@@ -164,10 +195,37 @@ func DefaultLoader(tx *Xslate, args Args) error {
 	return nil
 }
 
-// DefaultVM sets up and assigns the default VM to be used by Xslate
+// DefaultVM sets up and assigns the default VM to be used by Xslate.
+// The execution limits (see vm.Limits) can be specified by the following
+// keys, each of which take an int. Zero means no limit:
+//
+//    * MaxOps: Maximum number of ops executed per render
+//    * MaxOutputBytes: Maximum number of bytes in the output
+//    * MaxDepth: Maximum nesting depth of INCLUDE, WRAPPER and macros (default: 100)
+//    * MaxLoopCount: Maximum number of iterations per FOREACH or WHILE loop (default: 1000)
 func DefaultVM(tx *Xslate, args Args) error {
 	dvm := vm.NewVM()
 	dvm.Loader = tx.Loader
+
+	limits := dvm.Limits()
+	for key, dst := range map[string]*int{
+		"MaxOps":         &limits.MaxOps,
+		"MaxOutputBytes": &limits.MaxOutputBytes,
+		"MaxDepth":       &limits.MaxDepth,
+		"MaxLoopCount":   &limits.MaxLoopCount,
+	} {
+		tmp, ok := args.Get(key)
+		if !ok {
+			continue
+		}
+		v, ok := tmp.(int)
+		if !ok || v < 0 {
+			return errors.Errorf("VM option '%s' must be a non-negative int", key)
+		}
+		*dst = v
+	}
+	dvm.SetLimits(limits)
+
 	tx.VM = dvm
 	return nil
 }
@@ -229,6 +287,24 @@ func (tx *Xslate) Configure(args ConfigureArgs) error {
 		tx.VM.SetFunctions(vm.Vars(funcs.(Args)))
 	}
 
+	if filters, ok := args.Get("Filters"); ok {
+		f, ok := filters.(Args)
+		if !ok {
+			return errors.New("Filters must be xslate.Args")
+		}
+		tx.VM.SetFilters(vm.Vars(f))
+	}
+
+	if mode, ok := args.Get("AutoEscape"); ok {
+		s, ok := mode.(string)
+		if !ok {
+			return errors.New("AutoEscape must be a string")
+		}
+		if err := tx.SetAutoEscape(s); err != nil {
+			return err
+		}
+	}
+
 	if Debug {
 		tx.DumpAST(true)
 		tx.DumpByteCode(true)
@@ -251,6 +327,9 @@ func (tx *Xslate) Configure(args ConfigureArgs) error {
 //    * Loader: Arbitrary arguments passed to ConfigureLoader function
 //    * Compiler: Arbitrary arguments passed to ConfigureCompiler function
 //    * VM: Arbitrary arguments passed to ConfigureVM function
+//    * Functions: Functions available to all templates
+//    * Filters: Functions available as filters to all templates. See vm.VM.SetFilters
+//    * AutoEscape: "html" (default) or "none". See SetAutoEscape
 func New(args ...Args) (*Xslate, error) {
 	tx := &Xslate{}
 
@@ -266,6 +345,22 @@ func New(args ...Args) (*Xslate, error) {
 	return tx, nil
 }
 
+// SetAutoEscape specifies how values are escaped when they are printed
+// from templates. By default ("html"), HTML special characters are
+// escaped unless the value is a Raw string, or has been through the
+// mark_raw or html filters. Specifying "none" prints all values as is
+func (tx *Xslate) SetAutoEscape(mode string) error {
+	switch mode {
+	case AutoEscapeHTML:
+		tx.VM.SetAutoEscape(vm.EscapeHTML)
+	case AutoEscapeNone:
+		tx.VM.SetAutoEscape(vm.EscapeNone)
+	default:
+		return errors.New("unknown AutoEscape mode '" + mode + "'")
+	}
+	return nil
+}
+
 // DumpAST sets the flag to dump the abstract syntax tree after parsing the
 // template. Use of this method is only really useful if you know the internal
 // repreentation of the templates
@@ -297,10 +392,18 @@ func (tx *Xslate) DumpByteCode(b bool) {
 // `Render()` returns the resulting text from processing the template.
 // `err` is nil on success, otherwise it contains an `error` value.
 func (tx Xslate) Render(name string, vars Vars) (string, error) {
+	return tx.RenderContext(context.Background(), name, vars)
+}
+
+// RenderContext is the same as Render(), but the execution of the
+// template is aborted when `ctx` is canceled or its deadline passes.
+// In that case the returned error's cause (see errors.Cause() in
+// github.com/pkg/errors) is ctx.Err()
+func (tx Xslate) RenderContext(ctx context.Context, name string, vars Vars) (string, error) {
 	buf := rbpool.Get()
 	defer rbpool.Release(buf)
 
-	err := tx.RenderInto(buf, name, vars)
+	err := tx.RenderIntoContext(ctx, buf, name, vars)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to render template")
 	}
@@ -326,7 +429,9 @@ func (tx *Xslate) RenderString(template string, vars Vars) (string, error) {
 	buf := rbpool.Get()
 	defer rbpool.Release(buf)
 
-	tx.VM.Run(bc, vm.Vars(vars), buf)
+	if err := tx.VM.Run(bc, vm.Vars(vars), buf); err != nil {
+		return "", errors.Wrap(err, "failed to render template string")
+	}
 	return buf.String(), nil
 }
 
@@ -334,10 +439,17 @@ func (tx *Xslate) RenderString(template string, vars Vars) (string, error) {
 // This is a convenience method for frameworks providing a Writer interface,
 // such as net/http's ServeHTTP()
 func (tx *Xslate) RenderInto(w io.Writer, template string, vars Vars) error {
+	return tx.RenderIntoContext(context.Background(), w, template, vars)
+}
+
+// RenderIntoContext is the same as RenderInto(), but the execution of
+// the template is aborted when `ctx` is canceled or its deadline passes,
+// in which case ctx.Err() is returned. Output generated up to that point
+// may have already been written to `w`
+func (tx *Xslate) RenderIntoContext(ctx context.Context, w io.Writer, template string, vars Vars) error {
 	bc, err := tx.Loader.Load(template)
 	if err != nil {
 		return err
 	}
-	tx.VM.Run(bc, vm.Vars(vars), w)
-	return nil
+	return tx.VM.RunContext(ctx, bc, vm.Vars(vars), w)
 }
@@ -1,13 +1,22 @@
 package xslate
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"github.com/lestrrat-go/xslate/test"
 	"log"
 	"os"
 	"reflect"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/lestrrat-go/xslate/parser"
+	"github.com/lestrrat-go/xslate/vm"
+	"github.com/pkg/errors"
 )
 
 type testctx struct {
@@ -118,4 +127,289 @@ func TestXslate_New_ParserSyntax(t *testing.T) {
 	if err != nil {
 		t.Errorf("Expected Syntax: TTerse to succeed, but got err: %s", err)
 	}
+
+	_, err = New(Args{"Parser": Args{"Syntax": "NoSuchSyntax"}})
+	if err == nil {
+		t.Errorf("Expected Syntax: NoSuchSyntax to fail")
+	}
+}
+
+// A syntax defined outside of xslate, with symbols of its own
+var shoutySymbols = parser.DefaultSymbolSet.Copy()
+
+func init() {
+	shoutySymbols.Set("$", parser.ItemVariable)
+	shoutySymbols.Set("WHEN", parser.ItemIf)
+	shoutySymbols.Set("OTHERWISE", parser.ItemElse)
+	shoutySymbols.Set("DONE", parser.ItemEnd)
+	shoutySymbols.Set("EACH", parser.ItemForeach)
+	shoutySymbols.Set("->", parser.ItemArrow, 1.0)
+
+	parser.Register("Shouty", func(opts parser.Options) (parser.Parser, error) {
+		p := &parser.Syntax{
+			Symbols:    shoutySymbols,
+			Delimiters: parser.Delimiters{TagStart: "{!", TagEnd: "!}"},
+		}
+		if err := p.Configure(opts); err != nil {
+			return nil, err
+		}
+		return p, nil
+	})
+}
+
+func TestXslate_RegisteredSyntax(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	pargs := c.XslateArgs["Parser"].(Args)
+	pargs["Syntax"] = "Shouty"
+	vars := Vars{"name": "Bob", "list": []int{1, 2, 3}}
+	c.renderStringAndCompare(`{! WHEN $name !}Hello, {! $name !}!{! OTHERWISE !}Nobody{! DONE !}`, vars, `Hello, Bob!`)
+	c.renderStringAndCompare(`{! EACH $list -> $i !}{! $i !}{! DONE !}`, vars, `123`)
+
+	// The common options apply to registered syntaxes, too
+	pargs["TagStart"] = "<!"
+	pargs["TagEnd"] = "!>"
+	c.renderStringAndCompare(`<! $name !>`, vars, `Bob`)
+
+	pargs["TagEnd"] = ""
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("Expected an empty TagEnd to be rejected")
+	}
+}
+
+func TestXslate_ConcurrentRender(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("concurrent/index.tx").WriteString(`[% FOREACH i IN list %][% name %]:[% i %],[% END %][% INCLUDE "concurrent/parts.tx" %]`)
+	c.File("concurrent/parts.tx").WriteString(`Bye, [% name %]!`)
+
+	tx := c.CreateTx()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			name := "user" + strconv.Itoa(i)
+			vars := Vars{"name": name, "list": []int{1, 2, 3}}
+			expected := name + ":1," + name + ":2," + name + ":3,Bye, " + name + "!"
+			for j := 0; j < 50; j++ {
+				output, err := tx.Render("concurrent/index.tx", vars)
+				if err != nil {
+					t.Errorf("Failed to render template: %s", err)
+					return
+				}
+				if output != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, output)
+					return
+				}
+
+				buf := &bytes.Buffer{}
+				if err := tx.RenderInto(buf, "concurrent/index.tx", vars); err != nil {
+					t.Errorf("Failed to render template: %s", err)
+					return
+				}
+				if buf.String() != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, buf.String())
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestXslate_ConcurrentRenderString(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	tx := c.CreateTx()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				output, err := tx.RenderString(`[% SET x = n * 2 %][% n %] * 2 = [% x %]`, Vars{"n": i})
+				if err != nil {
+					t.Errorf("Failed to render template: %s", err)
+					return
+				}
+				expected := strconv.Itoa(i) + " * 2 = " + strconv.Itoa(i*2)
+				if output != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, output)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestXslate_RenderContext(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("context/index.tx").WriteString(`[% INCLUDE "context/loop.tx" %]`)
+	c.File("context/loop.tx").WriteString(`[% FOREACH i IN list %][% cancel() %][% i %],[% END %]`)
+
+	tx := c.CreateTx()
+
+	list := make([]int, 900)
+	for i := range list {
+		list[i] = i
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	vars := Vars{
+		"list": list,
+		"cancel": func() string {
+			cancel()
+			return ""
+		},
+	}
+
+	output, err := tx.RenderContext(ctx, "context/index.tx", vars)
+	if err == nil {
+		t.Fatalf("Expected render to be canceled, got '%s'", output)
+	}
+
+	if errors.Cause(err) != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %s", err)
+	}
+
+	// Should work without cancellation
+	vars["cancel"] = func() string { return "" }
+	output, err = tx.RenderContext(context.Background(), "context/index.tx", vars)
+	if err != nil {
+		t.Fatalf("Failed to render template: %s", err)
+	}
+
+	if !strings.HasPrefix(output, "0,1,2,") {
+		t.Errorf("Unexpected output '%s'", output)
+	}
+}
+
+func TestXslate_RenderIntoContextCanceled(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("context/hello.tx").WriteString(`Hello, World!`)
+
+	tx := c.CreateTx()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	buf := &bytes.Buffer{}
+	if err := tx.RenderIntoContext(ctx, buf, "context/hello.tx", nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestXslate_Limits(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	c.File("limits/index.tx").WriteString(`[% FOREACH i IN list %][% i %],[% END %]`)
+	c.File("limits/while.tx").WriteString(`[% SET i = 0 %][% WHILE i < 100 %][% i = i + 1 %][% END %]`)
+	c.File("limits/recursive.tx").WriteString(`[% INCLUDE "limits/recursive.tx" %]`)
+
+	list := make([]int, 100)
+	vars := Vars{"list": list}
+
+	for _, limit := range []struct {
+		name  string
+		value int
+		file  string
+	}{
+		{"MaxOps", 50, "limits/index.tx"},
+		{"MaxOutputBytes", 20, "limits/index.tx"},
+		{"MaxLoopCount", 10, "limits/index.tx"},
+		{"MaxLoopCount", 10, "limits/while.tx"},
+		{"MaxDepth", 10, "limits/recursive.tx"},
+	} {
+		c.XslateArgs["VM"] = Args{limit.name: limit.value}
+		tx := c.CreateTx()
+
+		_, err := tx.Render(limit.file, vars)
+		if err == nil {
+			t.Errorf("Expected %s to be exceeded", limit.name)
+			continue
+		}
+
+		lerr, ok := errors.Cause(err).(*vm.LimitError)
+		if !ok {
+			t.Errorf("Expected *vm.LimitError, got %T (%s)", errors.Cause(err), err)
+			continue
+		}
+
+		if lerr.Limit != limit.name || lerr.Max != limit.value {
+			t.Errorf("Expected %s (%d) to be exceeded, got %s (%d)", limit.name, limit.value, lerr.Limit, lerr.Max)
+		}
+	}
+
+	// Bad values are rejected
+	c.XslateArgs["VM"] = Args{"MaxOps": "100"}
+	if _, err := New(c.XslateArgs); err == nil {
+		t.Errorf("Expected non-int MaxOps to be rejected")
+	}
+}
+
+func TestXslate_ParserDelimiters(t *testing.T) {
+	c := newTestCtx(t)
+	defer c.Cleanup()
+
+	vars := Vars{"a": 1, "list": []int{3, 4}}
+	for i, d := range []struct {
+		syntax   string
+		args     Args
+		template string
+		expected string
+	}{
+		// Delimiters that look like operators
+		{"TTerse", Args{"TagStart": "<<", "TagEnd": ">>"}, `<< IF a <= 1 >>le<< END >><< IF a>=1 >>ge<< END >><< IF a > 0>>gt<< END >><<a>>`, `legegt1`},
+		{"TTerse", Args{"TagStart": "<%", "TagEnd": "%>"}, `<% 10 % 3 %>,<%a%>,<%- a -%> x`, `1,1,1x`},
+		{"TTerse", Args{"TagStart": "{{", "TagEnd": "}}"}, `{{ SET h = { b => 2 } }}{{ h.b }} {{ "${a}" }}`, `2 1`},
+		{"TTerse", Args{"TagStart": `\VAR{`, "TagEnd": "}"}, `\VAR{ a } \VAR{list.size()}`, `1 2`},
+		{"TTerse", Args{"TagStart": "<!--", "TagEnd": "-->"}, `<!-- a --> <!-- a - 1 -->`, `1 0`},
+		// Line code
+		{"Kolon", Args{"TagStart": "{%", "TagEnd": "%}", "LineStart": "%%"}, "%% for $list -> $i {\n{% $i % 2 %}\n%% }\n", "1\n0\n"},
+		{"Kolon", Args{"TagStart": "%{", "TagEnd": "}%", "LineStart": "%"}, "%{ $a }%\n% if $a {\ny\n% }\n", "1\ny\n"},
+		{"Kolon", Args{"LineStart": ""}, ": $a\n<: $a :>", ": $a\n1"},
+		{"Kolon", Args{"TagStart": `\VAR{`, "TagEnd": "}"}, `:"${ $a }"` + "\n", `1`},
+	} {
+		args := Args{"Syntax": d.syntax}
+		for k, v := range d.args {
+			args[k] = v
+		}
+		c.XslateArgs["Parser"] = args
+		tx := c.CreateTx()
+
+		// Both templates from strings and from files
+		name := fmt.Sprintf("delimiters/%d.tx", i)
+		c.File(name).WriteString(d.template)
+		output, err := tx.RenderString(d.template, vars)
+		if err != nil {
+			t.Errorf("Failed to render '%s' with %v: %s", d.template, d.args, err)
+			continue
+		}
+		c.compareTemplateOutput(output, d.expected)
+		c.renderAndCompare(tx, name, vars, d.expected)
+	}
+
+	// Bad values are rejected
+	for _, args := range []Args{{"TagStart": ""}, {"TagEnd": 1}, {"LineStart": nil}} {
+		c.XslateArgs["Parser"] = args
+		if _, err := New(c.XslateArgs); err == nil {
+			t.Errorf("Expected %v to be rejected", args)
+		}
+	}
 }